@@ -22,6 +22,7 @@ func NewConfig() *Config {
 		LogPretty:        true,
 		HTTPTimeout:      300,
 		ValidateResponse: true,
+		MaxParallelSteps: 1,
 		RetryConfig:      retry.NewDefaultConfig(),
 	}
 }
@@ -40,27 +41,72 @@ type Config struct {
 	OutputFlag string `yaml:"-"`
 	// OutputFolder is the resolved absolute folder every step writes into,
 	// computed during preprocessing.
-	OutputFolder     string   `yaml:"-"`
-	HTTPTimeout      int      `yaml:"-"`
-	ValidateResponse bool     `yaml:"-"`
-	Version          string   `yaml:"version"`
-	EnvVars          []string `yaml:"envVars"`
+	OutputFolder     string `yaml:"-"`
+	HTTPTimeout      int    `yaml:"-"`
+	ValidateResponse bool   `yaml:"-"`
+	// MaxParallelSteps caps how many independent steps the runner executes at
+	// once (the --max-parallel-steps flag); 1 runs them one after another.
+	MaxParallelSteps int `yaml:"-"`
+	// Resume (the --resume flag) keeps the rows prompt steps already wrote and
+	// generates only the missing ones; complete steps are skipped.
+	Resume bool `yaml:"-"`
+	// Incremental (the --incremental flag) skips steps whose definition and
+	// inputs hash the same as when their output was produced.
+	Incremental bool `yaml:"-"`
+	// OnlyStep, FromStep and UntilStep (the --only/--from/--until flags) limit
+	// the run to a subset of steps; the rest are satisfied by their outputs.
+	OnlyStep  string   `yaml:"-"`
+	FromStep  string   `yaml:"-"`
+	UntilStep string   `yaml:"-"`
+	Version   string   `yaml:"version"`
+	EnvVars   []string `yaml:"envVars"`
 	// Output is the optional `output:` key: a relative path is resolved against
 	// the config file's directory, so it travels with the workflow.
 	Output      string       `yaml:"output"`
 	Steps       []Step       `yaml:"steps"`
 	RetryConfig retry.Config `yaml:"retryConfig"`
+	// Prices maps "provider:model" (a step's `model:` spelling) to dollars per
+	// million input/output tokens; Budget caps the run's tokens and cost.
+	Prices map[string]llm.Price `yaml:"prices"`
+	Budget llm.Budget           `yaml:"budget"`
+	// RateLimits paces requests per provider ("openai", ...) to its quota; a
+	// step's modelConfig.rateLimit adds a limit for its model alone.
+	RateLimits map[string]llm.RateLimit `yaml:"rateLimits"`
+	// Cache reuses stored responses for requests identical to earlier ones.
+	Cache bool `yaml:"cache"`
+	// Meter accounts tokens and cost for the current run (created by the runner).
+	Meter *llm.Meter `yaml:"-"`
+	// CacheDir (the --cache-dir flag) is where cached responses live; giving it
+	// turns the cache on. NoCache (--no-cache) turns it off whatever the config
+	// says. Both are settled during preprocessing into Cache and CacheDir.
+	CacheDir string `yaml:"-"`
+	NoCache  bool   `yaml:"-"`
+	// ResponseCache serves cached responses for the current run (created by the
+	// runner when Cache is on).
+	ResponseCache *llm.ResponseCache `yaml:"-"`
+	// Record and Replay (the --record/--replay flags) are cassette paths: record
+	// writes every response the run receives, replay answers from one instead of
+	// calling any model. Recorder and Cassette are their open forms (created by
+	// the runner).
+	Record   string        `yaml:"-"`
+	Replay   string        `yaml:"-"`
+	Recorder *llm.Recorder `yaml:"-"`
+	Cassette *llm.Cassette `yaml:"-"`
+	// RateLimiters holds the limiters shared by all steps of the current run
+	// (created by the runner).
+	RateLimiters *llm.RateLimiters `yaml:"-"`
 }
 
 type StepType string
 
 const (
-	PromptStepType    StepType = "prompt"
-	ShellStepType     StepType = "shell"
-	TransformStepType StepType = "transform"
-	ReadStepType      StepType = "read"
-	WriteStepType     StepType = "write"
-	UnknownStepType   StepType = "unknown"
+	PromptStepType       StepType = "prompt"
+	ShellStepType        StepType = "shell"
+	TransformStepType    StepType = "transform"
+	ReadStepType         StepType = "read"
+	WriteStepType        StepType = "write"
+	ConversationStepType StepType = "conversation"
+	UnknownStepType      StepType = "unknown"
 )
 
 const (
@@ -74,6 +120,15 @@ const (
 	ReadFormatJSONL = "jsonl" // one row per line (parsed JSON)
 )
 
+const (
+	OnErrorFail = "fail" // a row that can't be generated fails the step (default)
+	OnErrorSkip = "skip" // a row that can't be generated goes to <step>.rejects.jsonl
+)
+
+// ReasoningField is how a later template reads the reasoning a step with
+// keepReasoning kept: {{.step.reasoning}}.
+const ReasoningField = "reasoning"
+
 const (
 	WriteFormatCSV      = "csv"   // one record per row; keys become columns
 	WriteFormatJSON     = "json"  // a single pretty-printed JSON array of all rows
@@ -84,8 +139,10 @@ const (
 type Step struct {
 	Type           StepType    `yaml:"type,omitempty"`
 	Name           string      `yaml:"name"`
-	Model          string      `yaml:"model"`
+	Models         ModelChain  `yaml:"model"` // "provider:model", or a list of them to fall back through
+	Model          string      `yaml:"-"`     // the first of Models, set during preprocessing
 	Prompt         string      `yaml:"prompt"`
+	Messages       []Message   `yaml:"messages"` // prompt steps: the conversation to send, in place of prompt
 	Run            string      `yaml:"run"`
 	JQ             string      `yaml:"jq"`           // transform steps: jq program
 	Read           string      `yaml:"read"`         // read steps: file/glob/dir to load as rows
@@ -104,13 +161,32 @@ type Step struct {
 	ModelConfig    ModelConfig `yaml:"modelConfig"`
 	OutputFilename string      `yaml:"outputFilename"`
 	JSONSchemaRaw  interface{} `yaml:"jsonSchema"`
-	Image          string      `yaml:"image"` // prompt steps: file path (templatable) to attach as a vision image
-	ResolvedCount  int
-	JSONSchema     jsonschema.Schema
+	Image          string      `yaml:"image"`         // prompt steps: file path (templatable) to attach as a vision image
+	OnError        string      `yaml:"onError"`       // prompt steps: "fail" (default) stops the step on a failed row, "skip" records it in a rejects file
+	MaxErrors      int         `yaml:"maxErrors"`     // prompt steps with onError skip: fail once more rows than this were skipped (0 = no limit)
+	Batch          bool        `yaml:"batch"`         // prompt steps: send all rows as one OpenAI Batch API job instead of request by request
+	KeepReasoning  bool        `yaml:"keepReasoning"` // prompt steps: keep a reasoning model's thinking in each line's `reasoning` field
+	Repair         bool        `yaml:"repair"`        // prompt steps: answer an invalid response with its validation errors instead of resending the request
+	JSONRepair     bool        `yaml:"jsonRepair"`    // prompt steps: extract the JSON from surrounding text and fix common syntax errors before validating
+	// Conversation steps: the simulated user that talks to the step's model,
+	// the most user/assistant exchanges to simulate (default 3), and a jq
+	// condition on the transcript that ends the conversation early.
+	User          *ConversationUser `yaml:"user"`
+	MaxTurns      int               `yaml:"maxTurns"`
+	StopWhen      string            `yaml:"stopWhen"`
+	ResolvedCount int
+	JSONSchema    jsonschema.Schema
 	// JQProgram holds the compiled jq program (set during preprocessing);
 	// UsesParent records whether it references the $parent variable
 	JQProgram  *jq.Program
 	UsesParent bool
+	// StopProgram holds the compiled stopWhen condition (set during
+	// preprocessing).
+	StopProgram *jq.Program
+	// DependsOn names the earlier steps this one reads from (from, forEach and
+	// template references), set during preprocessing; the runner schedules a
+	// step once all of them have completed.
+	DependsOn []string `yaml:"-"`
 }
 
 type ModelConfig struct {
@@ -119,6 +195,94 @@ type ModelConfig struct {
 	BaseURL       string   `yaml:"baseUrl"`
 	Temperature   *float64 `yaml:"temperature"`
 	MaxTokens     *int     `yaml:"maxTokens"`
+	// Sampling settings, sent to providers that support them; see validate.go
+	// for which do. ExtraBody fields are merged into the request body as-is.
+	TopP             *float64               `yaml:"topP"`
+	Seed             *int                   `yaml:"seed"`
+	Stop             []string               `yaml:"stop"`
+	PresencePenalty  *float64               `yaml:"presencePenalty"`
+	FrequencyPenalty *float64               `yaml:"frequencyPenalty"`
+	ReasoningEffort  string                 `yaml:"reasoningEffort"`
+	ExtraBody        map[string]interface{} `yaml:"extraBody"`
+	// StructuredOutput is how an OpenAI client provider asks for output
+	// matching the step's schema: jsonSchema, jsonObject or prompt. Unset,
+	// it is detected from the server's answer to the first request.
+	StructuredOutput string `yaml:"structuredOutput"`
+	// APIKeyEnv names the environment variable holding the API key, in place
+	// of the provider's usual one (OPENAI_API_KEY, ...). Headers are added to
+	// every request; a value may reference environment variables. Organization
+	// and Project select an OpenAI organization and project.
+	APIKeyEnv    string            `yaml:"apiKeyEnv"`
+	Headers      map[string]string `yaml:"headers"`
+	Organization string            `yaml:"organization"`
+	Project      string            `yaml:"project"`
+	// Endpoints spreads the step's requests over several servers of the same
+	// model, in place of baseUrl; see Endpoint.
+	Endpoints []Endpoint `yaml:"endpoints"`
+	// RateLimit paces requests to this model, shared with every step using
+	// the same model and key; see Config.RateLimits for provider-wide ones.
+	RateLimit *llm.RateLimit `yaml:"rateLimit"`
+	// Options, KeepAlive and Think are Ollama's own request fields, sent as-is
+	// by the ollama-native provider: model options such as num_ctx or seed,
+	// how long the model stays loaded, and whether a thinking model thinks.
+	Options   map[string]interface{} `yaml:"options"`
+	KeepAlive string                 `yaml:"keepAlive"`
+	Think     *bool                  `yaml:"think"`
+}
+
+// Endpoint is one server of a load-balanced model: rows go to the endpoint
+// with the fewest requests in flight, up to Concurrency at once (default 1).
+type Endpoint struct {
+	URL         string `yaml:"url"`
+	Concurrency int    `yaml:"concurrency"`
+}
+
+// ModelChoice is one model of a step's `model:` list. A fallback written as a
+// plain "provider:model" shares the step's modelConfig; one written as a
+// mapping brings its own, for settings that only fit one provider (baseUrl,
+// apiKeyEnv, options, ...). After preprocessing every fallback's ModelConfig
+// is set, with its provider and model name resolved.
+type ModelChoice struct {
+	Model       string       `yaml:"model"`
+	ModelConfig *ModelConfig `yaml:"modelConfig"`
+}
+
+// ModelChain is a step's `model:`: a single model, or an ordered list whose
+// later entries are tried for a row once the ones before it gave up.
+type ModelChain []ModelChoice
+
+func (c *ModelChain) UnmarshalYAML(value *yaml.Node) error {
+	switch value.Kind {
+	case yaml.ScalarNode:
+		*c = ModelChain{{Model: value.Value}}
+		return nil
+	case yaml.SequenceNode:
+		chain := make(ModelChain, 0, len(value.Content))
+		for _, item := range value.Content {
+			var choice ModelChoice
+			switch item.Kind {
+			case yaml.ScalarNode:
+				choice.Model = item.Value
+			case yaml.MappingNode:
+				// node.Decode would not reject unknown keys the way ParseYAML does
+				data, err := yaml.Marshal(item)
+				if err != nil {
+					return err
+				}
+				decoder := yaml.NewDecoder(bytes.NewReader(data))
+				decoder.KnownFields(true)
+				if err := decoder.Decode(&choice); err != nil {
+					return fmt.Errorf("model at line %d: %w", item.Line, err)
+				}
+			default:
+				return fmt.Errorf("line %d: a model must be 'provider:model' or a mapping with model and modelConfig", item.Line)
+			}
+			chain = append(chain, choice)
+		}
+		*c = chain
+		return nil
+	}
+	return fmt.Errorf("line %d: model must be 'provider:model' or a list of them", value.Line)
 }
 
 // ParseYAML decodes a config strictly: unknown keys (typos, removed syntax
@@ -132,6 +296,28 @@ func ParseYAML(data []byte, cfg *Config) error {
 	return nil
 }
 
+// Fallbacks returns the models a prompt step falls back to, in order; their
+// ModelConfig is set once the config is preprocessed.
+func (s Step) Fallbacks() []ModelChoice {
+	if len(s.Models) < 2 {
+		return nil
+	}
+	return s.Models[1:]
+}
+
+// modelConfigs returns the settings of every model a step sends requests to:
+// its own, its fallbacks' and its simulated user's.
+func (s Step) modelConfigs() []ModelConfig {
+	configs := []ModelConfig{s.ModelConfig}
+	for _, fallback := range s.Fallbacks() {
+		configs = append(configs, *fallback.ModelConfig)
+	}
+	if s.User != nil {
+		configs = append(configs, s.User.ModelConfig)
+	}
+	return configs
+}
+
 func (c *Config) GetStepByName(name string) *Step {
 	for _, step := range c.Steps {
 		if step.Name == name {
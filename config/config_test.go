@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestNewConfig(t *testing.T) {
@@ -20,6 +21,7 @@ func TestNewConfig(t *testing.T) {
 	assert.Equal(t, "", cfg.OutputFlag)
 	assert.Equal(t, "", cfg.Output)
 	assert.Equal(t, 300, cfg.HTTPTimeout)
+	assert.Equal(t, 1, cfg.MaxParallelSteps)
 	assert.Equal(t, "", cfg.Version)
 	assert.Nil(t, cfg.Steps)
 	assert.True(t, cfg.RetryConfig.Enabled)
@@ -60,3 +62,51 @@ steps:
 	assert.Error(t, err, "removed/unknown keys must not be silently ignored")
 	assert.Contains(t, err.Error(), "maxResults")
 }
+
+func TestParseYAML_ModelChain(t *testing.T) {
+	yamlText := `
+version: 1.0
+steps:
+  - name: single
+    model: ollama:m
+    prompt: hi
+  - name: chain
+    model:
+      - openai:gpt-4o-mini
+      - openrouter:meta-llama/llama-3.2-3b
+      - model: ollama:llama3.2
+        modelConfig:
+          baseUrl: http://gpu-box:11434/v1
+    prompt: hi
+`
+	var cfg Config
+	require.NoError(t, ParseYAML([]byte(yamlText), &cfg))
+
+	assert.Equal(t, ModelChain{{Model: "ollama:m"}}, cfg.Steps[0].Models)
+	assert.Empty(t, cfg.Steps[0].Fallbacks())
+
+	chain := cfg.Steps[1].Models
+	require.Len(t, chain, 3)
+	assert.Equal(t, "openai:gpt-4o-mini", chain[0].Model)
+	assert.Nil(t, chain[1].ModelConfig)
+	require.NotNil(t, chain[2].ModelConfig)
+	assert.Equal(t, "http://gpu-box:11434/v1", chain[2].ModelConfig.BaseURL)
+	assert.Len(t, cfg.Steps[1].Fallbacks(), 2)
+}
+
+func TestParseYAML_ModelChainUnknownFieldsRejected(t *testing.T) {
+	yamlText := `
+version: 1.0
+steps:
+  - name: chain
+    model:
+      - openai:gpt-4o-mini
+      - model: ollama:llama3.2
+        modelConfig:
+          baseURL: http://gpu-box:11434/v1
+    prompt: hi
+`
+	var cfg Config
+	err := ParseYAML([]byte(yamlText), &cfg)
+	assert.ErrorContains(t, err, "baseURL")
+}
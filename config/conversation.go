@@ -0,0 +1,32 @@
+package config
+
+const (
+	// DefaultMaxTurns is how many exchanges a conversation step simulates
+	// when maxTurns is not set.
+	DefaultMaxTurns = 3
+	// DefaultConversationOpener is what the simulated user is asked when its
+	// prompt is not set: to write the message that opens the conversation.
+	DefaultConversationOpener = "Write your first message to start the conversation."
+)
+
+// ConversationUser is the simulated user of a conversation step: a model of
+// its own, told who it plays by SystemPrompt, that talks to the step's model.
+// Prompt asks it for its opening message; later, it is shown each answer as
+// the next message to reply to. Without a model, the step's own model and
+// modelConfig play the user.
+type ConversationUser struct {
+	Model        string      `yaml:"model"`
+	ModelConfig  ModelConfig `yaml:"modelConfig"`
+	SystemPrompt string      `yaml:"systemPrompt"`
+	Prompt       string      `yaml:"prompt"`
+}
+
+// Templates returns a step's templates that are rendered against each row:
+// the prompt or messages of a prompt step, and the system prompts and opening
+// prompt of a conversation step, whose first entry is the opening prompt.
+func (s Step) Templates() []string {
+	if s.User != nil {
+		return []string{s.User.Prompt, s.User.SystemPrompt, s.SystemPrompt}
+	}
+	return []string{s.PromptTemplate()}
+}
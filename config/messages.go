@@ -0,0 +1,59 @@
+package config
+
+import (
+	"strings"
+
+	"github.com/mirpo/datamatic/llm"
+)
+
+// Message is one entry of a prompt step's `messages:`: a turn whose content
+// is a template rendered against the row, or, with Range, the turns of
+// Messages repeated for every element of a list (a template pipeline such as
+// .examples.pairs), with dot set to the element as in {{range}}.
+type Message struct {
+	Role     string    `yaml:"role"`
+	Content  string    `yaml:"content"`
+	Range    string    `yaml:"range"`
+	Messages []Message `yaml:"messages"`
+}
+
+// Turns are marked in the rendered conversation by control characters no
+// prompt contains: turnStart, the role, turnContent, the content.
+const (
+	turnStart   = "\x1e"
+	turnContent = "\x1f"
+)
+
+// PromptTemplate returns the template a prompt step renders for every row:
+// its prompt, or its messages as one template, so that they are parsed,
+// checked and rendered like a prompt. SplitMessages takes the rendered
+// conversation apart.
+func (s Step) PromptTemplate() string {
+	if len(s.Messages) == 0 {
+		return s.Prompt
+	}
+	return messagesTemplate(s.Messages)
+}
+
+func messagesTemplate(messages []Message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		if m.Range != "" {
+			b.WriteString("{{range " + m.Range + "}}" + messagesTemplate(m.Messages) + "{{end}}")
+			continue
+		}
+		b.WriteString(turnStart + m.Role + turnContent + m.Content)
+	}
+	return b.String()
+}
+
+// SplitMessages returns the turns of a conversation rendered from a step's
+// PromptTemplate, with their content trimmed.
+func SplitMessages(rendered string) []llm.Message {
+	var messages []llm.Message
+	for _, turn := range strings.Split(rendered, turnStart)[1:] {
+		role, content, _ := strings.Cut(turn, turnContent)
+		messages = append(messages, llm.Message{Role: role, Content: strings.TrimSpace(content)})
+	}
+	return messages
+}
@@ -1,12 +1,15 @@
 package config
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/url"
 	"path/filepath"
+	"slices"
 	"strings"
 
+	"github.com/mirpo/datamatic/llm"
 	"github.com/mirpo/datamatic/retry"
 	"github.com/rs/zerolog/log"
 )
@@ -41,6 +44,9 @@ func validateModelConfig(step ModelConfig) error {
 		if *step.Temperature < 0 || *step.Temperature > 2 {
 			return errors.New("temperature must be between 0 and 2")
 		}
+		if step.ModelProvider == llm.ProviderAnthropic && *step.Temperature > 1 {
+			return errors.New("temperature must be between 0 and 1 for anthropic")
+		}
 	}
 
 	if step.MaxTokens != nil {
@@ -49,6 +55,53 @@ func validateModelConfig(step ModelConfig) error {
 		}
 	}
 
+	if err := validateSampling(step); err != nil {
+		return err
+	}
+
+	if err := validateStructuredOutput(step); err != nil {
+		return err
+	}
+
+	if step.ModelProvider != llm.ProviderOllamaNative && (len(step.Options) > 0 || step.KeepAlive != "" || step.Think != nil) {
+		return fmt.Errorf("options, keepAlive and think are only supported by the %s provider", llm.ProviderOllamaNative)
+	}
+
+	if step.ModelProvider == llm.ProviderOpenAICompatible && step.BaseURL == "" && len(step.Endpoints) == 0 {
+		return fmt.Errorf("baseUrl is required for the %s provider", llm.ProviderOpenAICompatible)
+	}
+
+	if !usesOpenAIClient(step.ModelProvider) && (len(step.Headers) > 0 || step.Organization != "" || step.Project != "") {
+		return fmt.Errorf("headers, organization and project are not supported by the %s provider", step.ModelProvider)
+	}
+
+	if step.APIKeyEnv != "" && (step.ModelProvider == llm.ProviderMock || step.ModelProvider == llm.ProviderOllamaNative) {
+		return fmt.Errorf("apiKeyEnv is not supported by the %s provider", step.ModelProvider)
+	}
+
+	if step.RateLimit != nil {
+		if err := validateRateLimit(*step.RateLimit); err != nil {
+			return fmt.Errorf("rateLimit: %w", err)
+		}
+	}
+
+	if len(step.Endpoints) > 0 {
+		if step.BaseURL != "" {
+			return errors.New("baseUrl and endpoints can't both be set")
+		}
+		if step.ModelProvider == llm.ProviderMock {
+			return fmt.Errorf("endpoints are not supported by the %s provider", llm.ProviderMock)
+		}
+		for _, e := range step.Endpoints {
+			if err := validateURL(e.URL); err != nil {
+				return fmt.Errorf("invalid endpoint url '%s': %w", e.URL, err)
+			}
+			if e.Concurrency < 0 {
+				return fmt.Errorf("endpoint '%s': concurrency must be >= 0 (0 means 1)", e.URL)
+			}
+		}
+	}
+
 	if step.BaseURL != "" {
 		if err := validateURL(step.BaseURL); err != nil {
 			return fmt.Errorf("invalid baseUrl: %w", err)
@@ -58,6 +111,81 @@ func validateModelConfig(step ModelConfig) error {
 	return nil
 }
 
+// reasoningEfforts are the values OpenAI's reasoning_effort takes.
+var reasoningEfforts = []string{"none", "minimal", "low", "medium", "high"}
+
+// validateSampling checks the sampling settings beyond temperature and
+// maxTokens, and that the provider has them: Anthropic has no seed or
+// penalties, and only the OpenAI chat API takes a reasoning effort.
+func validateSampling(step ModelConfig) error {
+	if step.TopP != nil && (*step.TopP < 0 || *step.TopP > 1) {
+		return errors.New("topP must be between 0 and 1")
+	}
+	if step.PresencePenalty != nil && (*step.PresencePenalty < -2 || *step.PresencePenalty > 2) {
+		return errors.New("presencePenalty must be between -2 and 2")
+	}
+	if step.FrequencyPenalty != nil && (*step.FrequencyPenalty < -2 || *step.FrequencyPenalty > 2) {
+		return errors.New("frequencyPenalty must be between -2 and 2")
+	}
+	for _, stop := range step.Stop {
+		if stop == "" {
+			return errors.New("stop sequences must not be empty")
+		}
+	}
+
+	if step.ModelProvider == llm.ProviderAnthropic && (step.Seed != nil || step.PresencePenalty != nil || step.FrequencyPenalty != nil) {
+		return fmt.Errorf("seed, presencePenalty and frequencyPenalty are not supported by the %s provider", llm.ProviderAnthropic)
+	}
+	if step.ReasoningEffort != "" {
+		if !usesOpenAIClient(step.ModelProvider) {
+			return fmt.Errorf("reasoningEffort is not supported by the %s provider", step.ModelProvider)
+		}
+		if !slices.Contains(reasoningEfforts, step.ReasoningEffort) {
+			return fmt.Errorf("unknown reasoningEffort '%s' (expected one of: %s)", step.ReasoningEffort, strings.Join(reasoningEfforts, ", "))
+		}
+	}
+
+	if len(step.ExtraBody) > 0 {
+		if _, err := json.Marshal(step.ExtraBody); err != nil {
+			return fmt.Errorf("extraBody can't be sent as JSON: %w", err)
+		}
+	}
+	return nil
+}
+
+// structuredOutputs are the ways the OpenAI client can ask for schema output.
+var structuredOutputs = []string{llm.StructuredOutputJSONSchema, llm.StructuredOutputJSONObject, llm.StructuredOutputPrompt}
+
+func validateStructuredOutput(step ModelConfig) error {
+	if step.StructuredOutput == "" {
+		return nil
+	}
+	if !usesOpenAIClient(step.ModelProvider) {
+		return fmt.Errorf("structuredOutput is not supported by the %s provider", step.ModelProvider)
+	}
+	if !slices.Contains(structuredOutputs, step.StructuredOutput) {
+		return fmt.Errorf("unknown structuredOutput '%s' (expected one of: %s)", step.StructuredOutput, strings.Join(structuredOutputs, ", "))
+	}
+	return nil
+}
+
+func validateRateLimit(limit llm.RateLimit) error {
+	if limit.RequestsPerMinute < 0 || limit.TokensPerMinute < 0 {
+		return errors.New("requestsPerMinute and tokensPerMinute must be >= 0")
+	}
+	return nil
+}
+
+// usesOpenAIClient reports whether a provider talks the OpenAI chat API.
+func usesOpenAIClient(provider llm.ProviderType) bool {
+	switch provider {
+	case llm.ProviderOpenAI, llm.ProviderOpenRouter, llm.ProviderGemini, llm.ProviderOllama,
+		llm.ProviderLmStudio, llm.ProviderOpenAICompatible:
+		return true
+	}
+	return false
+}
+
 func validateRetryConfig(cfg retry.Config) error {
 	if cfg.MaxAttempts <= 0 {
 		return errors.New("maxAttempts must be greater than 0")
@@ -78,6 +206,46 @@ func validateRetryConfig(cfg retry.Config) error {
 	return nil
 }
 
+// validatePricing checks the price table and budget. A budget can only be
+// enforced when every model of a prompt or conversation step caps its
+// completions with maxTokens: each request reserves its prompt plus that cap
+// before it is sent, and without one the completion is unbounded. A cost
+// budget also needs a price for every such model.
+func validatePricing(c *Config) error {
+	for key, price := range c.Prices {
+		if price.Input < 0 || price.Output < 0 {
+			return fmt.Errorf("prices: '%s': prices must be >= 0", key)
+		}
+	}
+
+	if c.Budget.MaxTokens < 0 {
+		return errors.New("budget: maxTokens must be >= 0")
+	}
+	if c.Budget.MaxCost < 0 {
+		return errors.New("budget: maxCost must be >= 0")
+	}
+
+	if c.Budget.MaxTokens == 0 && c.Budget.MaxCost == 0 {
+		return nil
+	}
+	for _, step := range c.Steps {
+		if step.Type != PromptStepType && step.Type != ConversationStepType {
+			continue
+		}
+		for _, modelConfig := range step.modelConfigs() {
+			key := llm.PriceKey(modelConfig.ModelProvider, modelConfig.ModelName)
+			if modelConfig.MaxTokens == nil {
+				return fmt.Errorf("budget: step '%s' uses '%s' without modelConfig.maxTokens, so its requests can't be reserved against the budget", step.Name, key)
+			}
+			if _, ok := c.Prices[key]; !ok && c.Budget.MaxCost > 0 {
+				return fmt.Errorf("budget: maxCost is set but step '%s' uses '%s', which has no entry in prices", step.Name, key)
+			}
+		}
+	}
+
+	return nil
+}
+
 func (c *Config) Validate() error {
 	if err := validateVersion(c.Version); err != nil {
 		return err
@@ -87,6 +255,16 @@ func (c *Config) Validate() error {
 		return fmt.Errorf("retry config validation failed: %w", err)
 	}
 
+	if err := validatePricing(c); err != nil {
+		return err
+	}
+
+	for provider, limit := range c.RateLimits {
+		if err := validateRateLimit(limit); err != nil {
+			return fmt.Errorf("rateLimits: %s: %w", provider, err)
+		}
+	}
+
 	for index := range c.Steps {
 		step := &c.Steps[index]
 
@@ -109,10 +287,23 @@ func (c *Config) Validate() error {
 					log.Warn().Msgf("step '%s': schema is not strict-mode compatible (may be rejected by OpenAI): %s", step.Name, issue)
 				}
 			}
+		}
 
+		if stepType == PromptStepType || stepType == ConversationStepType {
 			if err := validateModelConfig(step.ModelConfig); err != nil {
 				return fmt.Errorf("step '%s': model config validation failed: %w", step.Name, err)
 			}
+			for _, fallback := range step.Fallbacks() {
+				if err := validateModelConfig(*fallback.ModelConfig); err != nil {
+					return fmt.Errorf("step '%s': fallback model '%s': model config validation failed: %w", step.Name, fallback.Model, err)
+				}
+			}
+		}
+
+		if step.User != nil {
+			if err := validateModelConfig(step.User.ModelConfig); err != nil {
+				return fmt.Errorf("step '%s': user model '%s': model config validation failed: %w", step.Name, step.User.Model, err)
+			}
 		}
 	}
 
@@ -4,6 +4,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/mirpo/datamatic/llm"
 	"github.com/mirpo/datamatic/retry"
 	"github.com/stretchr/testify/assert"
 )
@@ -50,6 +51,10 @@ func TestValidateModelConfig(t *testing.T) {
 	maxTokensNeg := -1
 	maxTokensLarge := 9999
 
+	topP0 := 0.0
+	seed := 42
+	penaltyOver := 2.5
+
 	tests := []struct {
 		name    string
 		config  ModelConfig
@@ -63,6 +68,29 @@ func TestValidateModelConfig(t *testing.T) {
 		{"Valid Nil Temp", ModelConfig{Temperature: nil, MaxTokens: &maxTokens100, BaseURL: ""}, false, ""},
 		{"Invalid Temp Below 0", ModelConfig{Temperature: &tempNeg, MaxTokens: &maxTokens100}, true, "temperature must be between 0 and 2"},
 		{"Invalid Temp Above 2", ModelConfig{Temperature: &tempOver, MaxTokens: &maxTokens100}, true, "temperature must be between 0 and 2"},
+		{"Valid Anthropic Max 1.0", ModelConfig{ModelProvider: llm.ProviderAnthropic, Temperature: &temp1_0}, false, ""},
+		{"Valid Ollama-Native Options", ModelConfig{ModelProvider: llm.ProviderOllamaNative, Options: map[string]interface{}{"num_ctx": 8192}, KeepAlive: "5m"}, false, ""},
+		{"Invalid Options Elsewhere", ModelConfig{ModelProvider: llm.ProviderOllama, Options: map[string]interface{}{"num_ctx": 8192}}, true, "only supported by the ollama-native provider"},
+		{"Valid OpenAI-Compatible", ModelConfig{ModelProvider: llm.ProviderOpenAICompatible, BaseURL: "http://localhost:8000/v1", APIKeyEnv: "KEY", Headers: map[string]string{"X-Tenant": "a"}}, false, ""},
+		{"Invalid OpenAI-Compatible Without BaseUrl", ModelConfig{ModelProvider: llm.ProviderOpenAICompatible}, true, "baseUrl is required"},
+		{"Invalid Headers For Anthropic", ModelConfig{ModelProvider: llm.ProviderAnthropic, Headers: map[string]string{"X-Tenant": "a"}}, true, "not supported by the anthropic provider"},
+		{"Invalid ApiKeyEnv For Mock", ModelConfig{ModelProvider: llm.ProviderMock, APIKeyEnv: "KEY"}, true, "apiKeyEnv is not supported"},
+		{"Valid Endpoints", ModelConfig{ModelProvider: llm.ProviderOllama, Endpoints: []Endpoint{{URL: "http://box1:11434/v1", Concurrency: 2}, {URL: "http://box2:11434/v1"}}}, false, ""},
+		{"Invalid Endpoints With BaseUrl", ModelConfig{ModelProvider: llm.ProviderOllama, BaseURL: "http://box1:11434/v1", Endpoints: []Endpoint{{URL: "http://box2:11434/v1"}}}, true, "baseUrl and endpoints"},
+		{"Invalid Endpoint Url", ModelConfig{ModelProvider: llm.ProviderOllama, Endpoints: []Endpoint{{URL: "box1"}}}, true, "invalid endpoint url"},
+		{"Invalid Negative Endpoint Concurrency", ModelConfig{ModelProvider: llm.ProviderOllama, Endpoints: []Endpoint{{URL: "http://box1:11434/v1", Concurrency: -1}}}, true, "concurrency must be >= 0 (0 means 1)"},
+		{"Invalid Negative Rate Limit", ModelConfig{ModelProvider: llm.ProviderOpenAI, RateLimit: &llm.RateLimit{RequestsPerMinute: -1}}, true, "rateLimit"},
+		{"Invalid Anthropic Above 1", ModelConfig{ModelProvider: llm.ProviderAnthropic, Temperature: &temp1_5}, true, "temperature must be between 0 and 1 for anthropic"},
+		{"Valid Sampling", ModelConfig{ModelProvider: llm.ProviderOpenAI, TopP: &topP0, Seed: &seed, Stop: []string{"\n\n"}, ReasoningEffort: "low", ExtraBody: map[string]interface{}{"service_tier": "flex"}}, false, ""},
+		{"Invalid TopP Above 1", ModelConfig{TopP: &temp1_5}, true, "topP must be between 0 and 1"},
+		{"Invalid Penalty", ModelConfig{PresencePenalty: &penaltyOver}, true, "presencePenalty must be between -2 and 2"},
+		{"Invalid Empty Stop", ModelConfig{Stop: []string{""}}, true, "stop sequences must not be empty"},
+		{"Invalid Seed For Anthropic", ModelConfig{ModelProvider: llm.ProviderAnthropic, Seed: &seed}, true, "not supported by the anthropic provider"},
+		{"Invalid ReasoningEffort For Ollama-Native", ModelConfig{ModelProvider: llm.ProviderOllamaNative, ReasoningEffort: "low"}, true, "reasoningEffort is not supported"},
+		{"Invalid ReasoningEffort Value", ModelConfig{ModelProvider: llm.ProviderOpenAI, ReasoningEffort: "max"}, true, "unknown reasoningEffort 'max'"},
+		{"Valid StructuredOutput", ModelConfig{ModelProvider: llm.ProviderOpenAICompatible, BaseURL: "http://localhost:8000/v1", StructuredOutput: "jsonObject"}, false, ""},
+		{"Invalid StructuredOutput For Anthropic", ModelConfig{ModelProvider: llm.ProviderAnthropic, StructuredOutput: "prompt"}, true, "structuredOutput is not supported"},
+		{"Invalid StructuredOutput Value", ModelConfig{ModelProvider: llm.ProviderOllama, StructuredOutput: "grammar"}, true, "unknown structuredOutput 'grammar'"},
 		{"Invalid MaxTokens Negative", ModelConfig{Temperature: &temp0_5, MaxTokens: &maxTokensNeg}, true, "maxTokens must be > 0"},
 		{"Invalid BaseUrl", ModelConfig{Temperature: &temp0_5, MaxTokens: &maxTokens100, BaseURL: "not a url"}, true, "invalid baseUrl"},
 	}
@@ -365,3 +393,55 @@ func TestConfigValidateRetryConfig(t *testing.T) {
 		assert.NoError(t, err)
 	})
 }
+
+func TestValidatePricing(t *testing.T) {
+	maxTokens := 500
+	newCfg := func() *Config {
+		return &Config{
+			Version:     "1.0",
+			RetryConfig: retry.NewDefaultConfig(),
+			Steps: []Step{{
+				Name: "gen", Type: PromptStepType, Model: "openai:gpt-4o-mini",
+				ModelConfig: ModelConfig{ModelProvider: llm.ProviderOpenAI, ModelName: "gpt-4o-mini", MaxTokens: &maxTokens},
+			}},
+		}
+	}
+
+	t.Run("token budget needs no prices", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.Budget.MaxTokens = 1000
+		assert.NoError(t, cfg.Validate())
+	})
+
+	t.Run("cost budget needs a price for every prompt step", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.Budget.MaxCost = 5
+		assert.ErrorContains(t, cfg.Validate(), "'openai:gpt-4o-mini', which has no entry in prices")
+
+		cfg.Prices = map[string]llm.Price{"openai:gpt-4o-mini": {Input: 0.15, Output: 0.6}}
+		assert.NoError(t, cfg.Validate())
+	})
+
+	t.Run("budget needs maxTokens on every model", func(t *testing.T) {
+		// without a completion cap a request reserves only its prompt, so
+		// every completion in flight could run past the budget
+		cfg := newCfg()
+		cfg.Budget.MaxTokens = 1000
+		cfg.Steps[0].ModelConfig.MaxTokens = nil
+		assert.ErrorContains(t, cfg.Validate(), "step 'gen' uses 'openai:gpt-4o-mini' without modelConfig.maxTokens")
+
+		cfg.Steps[0].ModelConfig.MaxTokens = &maxTokens
+		fallback := ModelConfig{ModelProvider: llm.ProviderOllama, ModelName: "llama3.2"}
+		cfg.Steps[0].Models = ModelChain{{Model: "openai:gpt-4o-mini"}, {Model: "ollama:llama3.2", ModelConfig: &fallback}}
+		assert.ErrorContains(t, cfg.Validate(), "uses 'ollama:llama3.2' without modelConfig.maxTokens")
+
+		cfg.Budget.MaxTokens = 0
+		assert.NoError(t, cfg.Validate(), "without a budget nothing is reserved")
+	})
+
+	t.Run("negative price", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.Prices = map[string]llm.Price{"openai:gpt-4o-mini": {Input: -1}}
+		assert.ErrorContains(t, cfg.Validate(), "prices must be >= 0")
+	})
+}
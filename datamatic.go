@@ -7,10 +7,14 @@ import (
 	"log/slog"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
+	"time"
 
 	"github.com/goforj/godump"
 	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/llm"
 	"github.com/mirpo/datamatic/logger"
 	"github.com/mirpo/datamatic/runner"
 	"github.com/mirpo/datamatic/utils"
@@ -23,11 +27,20 @@ var (
 )
 
 func main() {
-	// subcommand form: `datamatic validate -config x.yaml`
+	// subcommand form: `datamatic validate -config x.yaml`, `datamatic plan ...`,
+	// `datamatic cache prune ...`
 	validateOnly := len(os.Args) > 1 && os.Args[1] == "validate"
+	planOnly := len(os.Args) > 1 && os.Args[1] == "plan"
+	cachePrune := len(os.Args) > 2 && os.Args[1] == "cache" && os.Args[2] == "prune"
 	args := os.Args[1:]
-	if validateOnly {
+	switch {
+	case validateOnly || planOnly:
 		args = os.Args[2:]
+	case cachePrune:
+		args = os.Args[3:]
+	case len(os.Args) > 1 && os.Args[1] == "cache":
+		fmt.Fprintln(os.Stderr, "usage: datamatic cache prune --older-than <age> [--cache-dir <dir> | -config <file>]")
+		os.Exit(2)
 	}
 
 	cfg := config.NewConfig()
@@ -40,6 +53,18 @@ func main() {
 	flag.StringVar(&cfg.OutputFlag, "output", "", "Output folder path, relative to the working directory (default: 'dataset' next to the config file)")
 	flag.IntVar(&cfg.HTTPTimeout, "http-timeout", cfg.HTTPTimeout, "HTTP timeout: 0 - no timeout, if number - recommended to put high on poor hardware")
 	flag.BoolVar(&cfg.ValidateResponse, "validate-response", cfg.ValidateResponse, "Validate JSON response from server to match the schema")
+	flag.BoolVar(&cfg.Resume, "resume", cfg.Resume, "Keep rows already generated by an interrupted run and generate only the rest")
+	flag.BoolVar(&cfg.Incremental, "incremental", cfg.Incremental, "Reuse the output of steps whose definition and inputs are unchanged since the last run")
+	flag.StringVar(&cfg.OnlyStep, "only", "", "Run only this step; the steps it reads from must already have output")
+	flag.StringVar(&cfg.FromStep, "from", "", "Start the run at this step; earlier steps are satisfied by their existing output")
+	flag.StringVar(&cfg.UntilStep, "until", "", "Stop the run after this step")
+	planRows := flag.Int("plan-rows", 2, "plan: how many rows to render per prompt step")
+	flag.StringVar(&cfg.CacheDir, "cache-dir", "", "Cache responses in this folder (default with 'cache: true': '.datamatic-cache' next to the config file)")
+	flag.BoolVar(&cfg.NoCache, "no-cache", cfg.NoCache, "Neither read nor write cached responses")
+	flag.StringVar(&cfg.Record, "record", "", "Record every model response of the run to this cassette file")
+	flag.StringVar(&cfg.Replay, "replay", "", "Answer every model request from this cassette file instead of calling models")
+	olderThan := flag.String("older-than", "", "cache prune: remove entries not used for this long, e.g. 72h or 30d")
+	flag.IntVar(&cfg.MaxParallelSteps, "max-parallel-steps", cfg.MaxParallelSteps, "How many independent steps may run at the same time")
 
 	flag.CommandLine.Parse(args) //nolint:errcheck // flag.ExitOnError exits on failure
 
@@ -54,10 +79,27 @@ func main() {
 	}
 	logger.ConfigLogger(loggerConfig)
 
+	if cachePrune {
+		pruneCache(cfg, *olderThan)
+		return
+	}
+
 	if len(cfg.ConfigFile) == 0 {
 		log.Fatal().Msg("Config path is required")
 	}
 
+	if cfg.MaxParallelSteps < 1 {
+		log.Fatal().Msg("--max-parallel-steps must be >= 1")
+	}
+
+	if cfg.OnlyStep != "" && (cfg.FromStep != "" || cfg.UntilStep != "") {
+		log.Fatal().Msg("--only cannot be combined with --from or --until")
+	}
+
+	if cfg.Record != "" && cfg.Replay != "" {
+		log.Fatal().Msg("--record cannot be combined with --replay")
+	}
+
 	if err := utils.LoadConfigFile(cfg); err != nil {
 		log.Fatal().Err(err).Msg("Config check failed")
 	}
@@ -76,7 +118,64 @@ func main() {
 	defer stop()
 
 	r := runner.NewRunner(cfg)
+
+	if planOnly {
+		if *planRows < 1 {
+			log.Fatal().Msg("--plan-rows must be >= 1")
+		}
+		if err := r.Plan(ctx, os.Stdout, *planRows); err != nil {
+			log.Fatal().Err(err).Msg("plan failed")
+		}
+		return
+	}
+
 	if err := r.Run(ctx); err != nil {
 		log.Fatal().Err(err).Msg("failed to execute runner")
 	}
 }
+
+// pruneCache removes cached responses that were not used for the given age.
+// The cache is found like a run finds it, without loading the config: from
+// --cache-dir, or next to the -config file.
+func pruneCache(cfg *config.Config, olderThan string) {
+	if olderThan == "" {
+		log.Fatal().Msg("--older-than is required")
+	}
+	age, err := parseAge(olderThan)
+	if err != nil {
+		log.Fatal().Err(err).Msg("invalid --older-than")
+	}
+	if cfg.CacheDir == "" && cfg.ConfigFile == "" {
+		log.Fatal().Msg("--cache-dir or -config is required")
+	}
+
+	dir, err := utils.CacheDir(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cache prune failed")
+	}
+	removed, err := llm.NewResponseCache(dir).Prune(age)
+	if err != nil {
+		log.Fatal().Err(err).Msg("cache prune failed")
+	}
+	fmt.Printf("Removed %d cached response(s) from %s\n", removed, dir)
+}
+
+// parseAge is time.ParseDuration plus a day unit ("30d"), the natural way to
+// say how old a cache entry may get.
+func parseAge(value string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(value, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("'%s' is not a number of days", value)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	age, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, err
+	}
+	if age < 0 {
+		return 0, fmt.Errorf("'%s' is negative", value)
+	}
+	return age, nil
+}
@@ -22,7 +22,8 @@ func NewLineScanner(r io.Reader) *bufio.Scanner {
 }
 
 // lineCountCache caches line counts per path. Safe because step outputs are
-// immutable once the producing step completes and steps run sequentially.
+// immutable once the producing step completes, and a step only starts after
+// every step it reads from has completed.
 var lineCountCache sync.Map // path -> int
 
 func ReadLineFromFile(path string, lineNumber int) (string, error) {
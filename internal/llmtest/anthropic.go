@@ -0,0 +1,115 @@
+package llmtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// AnthropicServer is a mock Anthropic Messages API. Scripted responses are
+// returned as a text block, or, when the request forces a tool call, parsed as
+// JSON and returned as that tool's input.
+type AnthropicServer struct {
+	URL string
+	// FailFirst answers the first n requests with FailStatus (default 529,
+	// "overloaded"); scripted responses start after them.
+	FailFirst  int
+	FailStatus int
+	// InputTokens and OutputTokens are reported as every response's usage.
+	InputTokens  int
+	OutputTokens int
+
+	server    *httptest.Server
+	mu        sync.Mutex
+	responses []string
+	requests  []map[string]interface{}
+	headers   []http.Header
+}
+
+// NewAnthropicServer returns a mock Messages API server that answers with the
+// given contents in order; the last response repeats for extra calls.
+func NewAnthropicServer(t *testing.T, responses ...string) *AnthropicServer {
+	t.Helper()
+	s := &AnthropicServer{responses: responses}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/messages" {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		var req map[string]interface{}
+		_ = json.Unmarshal(body, &req)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		s.headers = append(s.headers, r.Header.Clone())
+		idx := len(s.requests) - 1
+		if idx < s.FailFirst {
+			status := s.FailStatus
+			if status == 0 {
+				status = 529
+			}
+			s.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(status)
+			_, _ = fmt.Fprintf(w, `{"type":"error","error":{"type":"overloaded_error","message":"mock status %d"}}`, status)
+			return
+		}
+		idx = min(idx-s.FailFirst, len(s.responses)-1)
+		content := ""
+		if idx >= 0 {
+			content = s.responses[idx]
+		}
+		s.mu.Unlock()
+
+		block := map[string]interface{}{"type": "text", "text": content}
+		stopReason := "end_turn"
+		if choice, ok := req["tool_choice"].(map[string]interface{}); ok {
+			block = map[string]interface{}{"type": "tool_use", "id": "toolu_mock", "name": choice["name"], "input": json.RawMessage(content)}
+			stopReason = "tool_use"
+		}
+
+		model, _ := req["model"].(string)
+		resp := map[string]interface{}{
+			"id":          "msg_mock",
+			"type":        "message",
+			"role":        "assistant",
+			"model":       model,
+			"content":     []interface{}{block},
+			"stop_reason": stopReason,
+			"usage":       map[string]interface{}{"input_tokens": s.InputTokens, "output_tokens": s.OutputTokens},
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(s.server.Close)
+
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *AnthropicServer) CallCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// Requests returns the decoded JSON bodies of all received requests.
+func (s *AnthropicServer) Requests() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]interface{}(nil), s.requests...)
+}
+
+// Headers returns the headers of all received requests.
+func (s *AnthropicServer) Headers() []http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]http.Header(nil), s.headers...)
+}
@@ -0,0 +1,247 @@
+package llmtest
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// BatchServer is a mock of OpenAI's Batch API: file upload, batch creation
+// and polling, and output file download. Point the client's baseUrl at URL.
+// Every request line of a batch is answered like a chat completion, with the
+// scripted contents in the order lines arrive across batches.
+type BatchServer struct {
+	URL string
+	// PendingPolls is how many times a new batch reports in_progress before
+	// it completes.
+	PendingPolls int
+	// FailFirst answers the first n request lines with an HTTP 500, which
+	// lands in the batch's error file; scripted responses start after them.
+	FailFirst int
+	// EchoPrompt answers each line with its last user message instead.
+	EchoPrompt bool
+	// PromptTokens and CompletionTokens are reported as every line's usage.
+	PromptTokens     int
+	CompletionTokens int
+
+	server    *httptest.Server
+	mu        sync.Mutex
+	responses []string
+	lines     int
+	files     map[string][]byte
+	batches   map[string]*mockBatch
+	submitted [][]map[string]interface{}
+	polls     int
+}
+
+type mockBatch struct {
+	id           string
+	pending      int
+	total        int
+	outputFileID string
+	errorFileID  string
+}
+
+// NewBatchServer returns a mock Batch API answering request lines with the
+// given message contents in order; the last response repeats for extra lines.
+func NewBatchServer(t *testing.T, responses ...string) *BatchServer {
+	t.Helper()
+	s := &BatchServer{responses: responses, files: map[string][]byte{}, batches: map[string]*mockBatch{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /files", s.uploadFile)
+	mux.HandleFunc("POST /batches", s.createBatch)
+	mux.HandleFunc("GET /batches/{id}", s.retrieveBatch)
+	mux.HandleFunc("GET /files/{id}/content", s.fileContent)
+
+	s.server = httptest.NewServer(mux)
+	t.Cleanup(s.server.Close)
+
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *BatchServer) uploadFile(w http.ResponseWriter, r *http.Request) {
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	content, _ := io.ReadAll(file)
+
+	s.mu.Lock()
+	id := fmt.Sprintf("file-%d", len(s.files)+1)
+	s.files[id] = content
+	s.mu.Unlock()
+
+	writeJSON(w, map[string]interface{}{"id": id, "object": "file", "purpose": r.FormValue("purpose")})
+}
+
+func (s *BatchServer) createBatch(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		InputFileID string `json:"input_file_id"`
+	}
+	_ = json.NewDecoder(r.Body).Decode(&req)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	input, ok := s.files[req.InputFileID]
+	if !ok {
+		http.Error(w, `{"error":{"message":"no such file"}}`, http.StatusNotFound)
+		return
+	}
+
+	var requests []map[string]interface{}
+	var output, errors bytes.Buffer
+	scanner := bufio.NewScanner(bytes.NewReader(input))
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var line struct {
+			CustomID string                 `json:"custom_id"`
+			Body     map[string]interface{} `json:"body"`
+		}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			http.Error(w, `{"error":{"message":"invalid input line"}}`, http.StatusBadRequest)
+			return
+		}
+		requests = append(requests, line.Body)
+		s.answer(line.CustomID, line.Body, &output, &errors)
+	}
+	s.submitted = append(s.submitted, requests)
+
+	b := &mockBatch{id: fmt.Sprintf("batch-%d", len(s.batches)+1), pending: s.PendingPolls, total: len(requests)}
+	if output.Len() > 0 {
+		b.outputFileID = b.id + "-output"
+		s.files[b.outputFileID] = output.Bytes()
+	}
+	if errors.Len() > 0 {
+		b.errorFileID = b.id + "-errors"
+		s.files[b.errorFileID] = errors.Bytes()
+	}
+	s.batches[b.id] = b
+
+	writeJSON(w, s.batchJSON(b))
+}
+
+// answer writes the result of one request line to the output or error file.
+func (s *BatchServer) answer(customID string, body map[string]interface{}, output, errors *bytes.Buffer) {
+	idx := s.lines
+	s.lines++
+	if idx < s.FailFirst {
+		line, _ := json.Marshal(map[string]interface{}{
+			"custom_id": customID,
+			"response": map[string]interface{}{
+				"status_code": http.StatusInternalServerError,
+				"body":        map[string]interface{}{"error": map[string]interface{}{"message": "mock failure"}},
+			},
+		})
+		errors.Write(append(line, '\n'))
+		return
+	}
+
+	idx = min(idx-s.FailFirst, len(s.responses)-1)
+	content := ""
+	switch {
+	case s.EchoPrompt:
+		content = lastUserMessage(body)
+	case idx >= 0:
+		content = s.responses[idx]
+	}
+	model, _ := body["model"].(string)
+	line, _ := json.Marshal(map[string]interface{}{
+		"custom_id": customID,
+		"response": map[string]interface{}{
+			"status_code": http.StatusOK,
+			"body": map[string]interface{}{
+				"object": "chat.completion",
+				"model":  model,
+				"choices": []map[string]interface{}{
+					{"index": 0, "finish_reason": "stop", "message": map[string]interface{}{"role": "assistant", "content": content}},
+				},
+				"usage": map[string]interface{}{
+					"prompt_tokens":     s.PromptTokens,
+					"completion_tokens": s.CompletionTokens,
+					"total_tokens":      s.PromptTokens + s.CompletionTokens,
+				},
+			},
+		},
+	})
+	output.Write(append(line, '\n'))
+}
+
+func (s *BatchServer) retrieveBatch(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.polls++
+	b, ok := s.batches[r.PathValue("id")]
+	if !ok {
+		http.Error(w, `{"error":{"message":"no such batch"}}`, http.StatusNotFound)
+		return
+	}
+	resp := s.batchJSON(b)
+	if b.pending > 0 {
+		b.pending--
+	}
+	writeJSON(w, resp)
+}
+
+func (s *BatchServer) batchJSON(b *mockBatch) map[string]interface{} {
+	resp := map[string]interface{}{
+		"id":                b.id,
+		"object":            "batch",
+		"endpoint":          "/v1/chat/completions",
+		"completion_window": "24h",
+		"status":            "completed",
+		"request_counts":    map[string]int{"total": b.total},
+	}
+	if b.pending > 0 {
+		resp["status"] = "in_progress"
+		return resp
+	}
+	if b.outputFileID != "" {
+		resp["output_file_id"] = b.outputFileID
+	}
+	if b.errorFileID != "" {
+		resp["error_file_id"] = b.errorFileID
+	}
+	return resp
+}
+
+func (s *BatchServer) fileContent(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	content, ok := s.files[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		http.Error(w, `{"error":{"message":"no such file"}}`, http.StatusNotFound)
+		return
+	}
+	_, _ = w.Write(content)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// Batches returns the request bodies of every submitted batch, in order.
+func (s *BatchServer) Batches() [][]map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]map[string]interface{}(nil), s.submitted...)
+}
+
+// Polls returns how many times a batch's status was retrieved.
+func (s *BatchServer) Polls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.polls
+}
@@ -0,0 +1,90 @@
+package llmtest
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// OllamaServer is a mock of Ollama's native /api/chat endpoint.
+type OllamaServer struct {
+	URL string
+	// PromptEvalCount and EvalCount are reported as every response's token
+	// counts.
+	PromptEvalCount int
+	EvalCount       int
+	// FailFirst answers the first n requests with an HTTP 500 error; scripted
+	// responses start after them.
+	FailFirst int
+
+	server    *httptest.Server
+	mu        sync.Mutex
+	responses []string
+	requests  []map[string]interface{}
+}
+
+// NewOllamaServer returns a mock /api/chat server that answers with the given
+// message contents in order; the last response repeats for extra calls.
+func NewOllamaServer(t *testing.T, responses ...string) *OllamaServer {
+	t.Helper()
+	s := &OllamaServer{responses: responses}
+
+	s.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/chat" {
+			http.NotFound(w, r)
+			return
+		}
+
+		body, _ := io.ReadAll(r.Body)
+		var req map[string]interface{}
+		_ = json.Unmarshal(body, &req)
+
+		s.mu.Lock()
+		s.requests = append(s.requests, req)
+		idx := len(s.requests) - 1
+		if idx < s.FailFirst {
+			s.mu.Unlock()
+			http.Error(w, `{"error":"mock failure"}`, http.StatusInternalServerError)
+			return
+		}
+		idx = min(idx-s.FailFirst, len(s.responses)-1)
+		content := ""
+		if idx >= 0 {
+			content = s.responses[idx]
+		}
+		promptEval, eval := s.PromptEvalCount, s.EvalCount
+		s.mu.Unlock()
+
+		model, _ := req["model"].(string)
+		resp := map[string]interface{}{
+			"model":             model,
+			"message":           map[string]interface{}{"role": "assistant", "content": content},
+			"done":              true,
+			"done_reason":       "stop",
+			"prompt_eval_count": promptEval,
+			"eval_count":        eval,
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	t.Cleanup(s.server.Close)
+
+	s.URL = s.server.URL
+	return s
+}
+
+func (s *OllamaServer) CallCount() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.requests)
+}
+
+// Requests returns the decoded JSON bodies of all received requests.
+func (s *OllamaServer) Requests() []map[string]interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]map[string]interface{}(nil), s.requests...)
+}
@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/http/httptest"
+	"slices"
 	"sync"
 	"testing"
 	"time"
@@ -15,11 +16,28 @@ type Server struct {
 	URL        string
 	Delay      time.Duration // set before first request; simulates a slow server
 	EchoPrompt bool          // when true, respond with the last user message instead of scripted content
+	// PromptTokens and CompletionTokens are reported as every response's usage.
+	PromptTokens     int
+	CompletionTokens int
+	// Reasoning is sent as every response's reasoning_content, as reasoning
+	// models behind OpenAI-compatible servers do.
+	Reasoning string
+	// RejectFormats answers requests with a listed response_format type
+	// (json_schema, json_object) with a 400, like servers lacking them.
+	RejectFormats []string
+	// FailFirst answers the first n requests with an HTTP error, FailStatus
+	// (default 500) with FailHeader and FailMessage (default "mock failure");
+	// scripted responses start after them.
+	FailFirst   int
+	FailStatus  int
+	FailHeader  http.Header
+	FailMessage string
 
 	server    *httptest.Server
 	mu        sync.Mutex
 	responses []string
 	requests  []map[string]interface{}
+	headers   []http.Header
 	inFlight  int
 	maxInFlt  int
 }
@@ -48,7 +66,32 @@ func NewServer(t *testing.T, responses ...string) *Server {
 
 		s.mu.Lock()
 		s.requests = append(s.requests, req)
+		s.headers = append(s.headers, r.Header.Clone())
 		idx := len(s.requests) - 1
+		if idx < s.FailFirst {
+			status := s.FailStatus
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			for name, values := range s.FailHeader {
+				w.Header()[name] = values
+			}
+			message := s.FailMessage
+			if message == "" {
+				message = "mock failure"
+			}
+			s.mu.Unlock()
+			body, _ := json.Marshal(map[string]interface{}{"error": map[string]interface{}{"message": message}})
+			http.Error(w, string(body), status)
+			return
+		}
+		format, _ := req["response_format"].(map[string]interface{})
+		if formatType, _ := format["type"].(string); slices.Contains(s.RejectFormats, formatType) {
+			s.mu.Unlock()
+			http.Error(w, `{"error":{"message":"unsupported response_format"}}`, http.StatusBadRequest)
+			return
+		}
+		idx -= s.FailFirst
 		if idx >= len(s.responses) {
 			idx = len(s.responses) - 1
 		}
@@ -61,6 +104,10 @@ func NewServer(t *testing.T, responses ...string) *Server {
 		}
 		s.mu.Unlock()
 
+		message := map[string]interface{}{"role": "assistant", "content": content}
+		if s.Reasoning != "" {
+			message["reasoning_content"] = s.Reasoning
+		}
 		model, _ := req["model"].(string)
 		resp := map[string]interface{}{
 			"id":     "mock",
@@ -70,9 +117,14 @@ func NewServer(t *testing.T, responses ...string) *Server {
 				{
 					"index":         0,
 					"finish_reason": "stop",
-					"message":       map[string]interface{}{"role": "assistant", "content": content},
+					"message":       message,
 				},
 			},
+			"usage": map[string]interface{}{
+				"prompt_tokens":     s.PromptTokens,
+				"completion_tokens": s.CompletionTokens,
+				"total_tokens":      s.PromptTokens + s.CompletionTokens,
+			},
 		}
 
 		w.Header().Set("Content-Type", "application/json")
@@ -135,3 +187,10 @@ func (s *Server) Requests() []map[string]interface{} {
 	defer s.mu.Unlock()
 	return append([]map[string]interface{}(nil), s.requests...)
 }
+
+// Headers returns the headers of all received requests.
+func (s *Server) Headers() []http.Header {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]http.Header(nil), s.headers...)
+}
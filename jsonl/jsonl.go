@@ -1,8 +1,11 @@
 package jsonl
 
 import (
+	"bufio"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
 
 	"github.com/rs/zerolog/log"
@@ -26,6 +29,72 @@ func NewWriter(path string) (*Writer, error) {
 	return &Writer{file: file}, nil
 }
 
+// NewResumeWriter reopens a step's output to continue a previous run: the first
+// size bytes (the valid prefix found by ValidPrefix) are kept, anything after
+// them — typically a half-written line from a crash — is cut off, and new rows
+// are appended.
+func NewResumeWriter(path string, size int64) (*Writer, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to cut file to its valid prefix: %w", err)
+	}
+	if _, err := file.Seek(size, io.SeekStart); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to seek to end of valid prefix: %w", err)
+	}
+
+	log.Debug().Msgf("reopened file for output at byte %d: %s", size, path)
+
+	return &Writer{file: file}, nil
+}
+
+// ValidPrefix scans a prompt step's output and returns the index of the next
+// row to generate and the byte length of the valid prefix: the leading lines
+// that are complete rows, newline-terminated and decoding as a LineEntity.
+// Scanning stops at the first line that is not, so a crash mid-write never
+// counts as a row. Rows carry their index when the step skips failed rows, so
+// the next row follows the last one written rather than the line count. A
+// missing file is an empty prefix.
+func ValidPrefix(path string) (int, int64, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	next := 0
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return next, size, nil // an unterminated tail is not a row
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read file: %w", err)
+		}
+
+		var entity LineEntity
+		if json.Unmarshal(line, &entity) != nil || entity.ID == "" {
+			return next, size, nil
+		}
+		if entity.Row != nil {
+			next = *entity.Row + 1
+		} else {
+			next++
+		}
+		size += int64(len(line))
+	}
+}
+
 func (w *Writer) WriteLine(entity LineEntity) error {
 	return w.WriteJSON(entity)
 }
@@ -42,6 +42,55 @@ func TestNewWriter_TruncatesExistingFile(t *testing.T) {
 		"reopening a step's output must replace the previous run's rows, not append to them")
 }
 
+func TestValidPrefix_StopsAtTornLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "step.jsonl")
+	good := `{"id":"a","format":"text","prompt":"p","response":"one"}` + "\n" +
+		`{"id":"b","format":"text","prompt":"p","response":"two"}` + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(good+`{"id":"c","format":"te`), 0o644))
+
+	rows, size, err := ValidPrefix(path)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, rows)
+	assert.Equal(t, int64(len(good)), size)
+}
+
+func TestValidPrefix_NextRowFollowsRecordedIndex(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "step.jsonl")
+	// rows 1 and 2 were skipped: the next row to generate is 4, not 2
+	content := `{"id":"a","format":"text","prompt":"p","response":"one","row":0}` + "\n" +
+		`{"id":"b","format":"text","prompt":"p","response":"two","row":3}` + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(content), 0o644))
+
+	next, _, err := ValidPrefix(path)
+
+	require.NoError(t, err)
+	assert.Equal(t, 4, next)
+}
+
+func TestValidPrefix_MissingFileIsEmpty(t *testing.T) {
+	rows, size, err := ValidPrefix(filepath.Join(t.TempDir(), "missing.jsonl"))
+
+	require.NoError(t, err)
+	assert.Zero(t, rows)
+	assert.Zero(t, size)
+}
+
+func TestNewResumeWriter_KeepsPrefixAndDropsTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "step.jsonl")
+	good := `{"id":"a","format":"text","prompt":"p","response":"one"}` + "\n"
+	require.NoError(t, os.WriteFile(path, []byte(good+`{"id":"b","for`), 0o644))
+
+	writer, err := NewResumeWriter(path, int64(len(good)))
+	require.NoError(t, err)
+	require.NoError(t, writer.WriteJSON(map[string]string{"id": "c"}))
+	require.NoError(t, writer.Close())
+
+	content, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, good+`{"id":"c"}`+"\n", string(content))
+}
+
 func TestWriteLine(t *testing.T) {
 	tmpFile, err := os.CreateTemp("", "test*.jsonl")
 	assert.NoError(t, err)
@@ -5,6 +5,7 @@ import (
 	"strings"
 
 	"github.com/google/uuid"
+	"github.com/mirpo/datamatic/llm"
 	"github.com/mirpo/datamatic/promptbuilder"
 )
 
@@ -14,9 +15,53 @@ type LineEntity struct {
 	Prompt   string                              `json:"prompt"`
 	Response interface{}                         `json:"response"`
 	Values   map[string]promptbuilder.ValueShort `json:"values,omitempty"`
+	// Row is the iteration index that produced the line, recorded when the
+	// step skips failed rows (onError: skip): line numbers then have gaps, and
+	// steps reading this one use Row to stay aligned with the rows upstream.
+	Row *int `json:"row,omitempty"`
+	// Usage is the tokens the row took, summed over every attempt it needed;
+	// omitted when the provider reports none.
+	Usage *llm.Usage `json:"usage,omitempty"`
+	// Model is the "provider:model" that answered, recorded when the step has
+	// fallback models.
+	Model string `json:"model,omitempty"`
+	// Reasoning is the model's thinking, kept when the step sets
+	// keepReasoning.
+	Reasoning string `json:"reasoning,omitempty"`
+	// JSONRepaired is set when the response only became valid JSON through
+	// the step's jsonRepair.
+	JSONRepaired bool `json:"jsonRepaired,omitempty"`
+	// Messages is the conversation the step sent, written by steps with
+	// messages; Prompt is its last turn.
+	Messages []llm.Message `json:"messages,omitempty"`
+}
+
+// SplitReasoning separates a reasoning model's <think> block from its answer.
+// Some chat templates open the block in the prompt, so the response may only
+// close it; a block cut off by maxTokens is all reasoning and no answer.
+func SplitReasoning(response string) (answer, reasoning string) {
+	trimmed := strings.TrimSpace(response)
+	end := strings.Index(trimmed, "</think>")
+	if end < 0 {
+		if strings.HasPrefix(trimmed, "<think>") {
+			return "", strings.TrimSpace(strings.TrimPrefix(trimmed, "<think>"))
+		}
+		return response, ""
+	}
+
+	before := trimmed[:end]
+	start := strings.Index(before, "<think>")
+	if start > 0 && strings.TrimSpace(before[:start]) != "" {
+		return response, "" // the tags are part of the answer
+	}
+	if start >= 0 {
+		before = before[start+len("<think>"):]
+	}
+	return strings.TrimSpace(trimmed[end+len("</think>"):]), strings.TrimSpace(before)
 }
 
 func cleanResponse(input string) string {
+	input, _ = SplitReasoning(input)
 	input = strings.TrimSpace(input)
 
 	if strings.HasPrefix(input, "```") {
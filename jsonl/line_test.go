@@ -49,6 +49,11 @@ func TestCleanResponse(t *testing.T) {
 			input:    "already clean",
 			expected: "already clean",
 		},
+		{
+			name:     "drops a think block before fenced JSON",
+			input:    "<think>\nthe user wants JSON\n</think>\n\n```json\n{\"key\":\"value\"}\n```",
+			expected: `{"key":"value"}`,
+		},
 	}
 
 	for _, tt := range tests {
@@ -59,6 +64,30 @@ func TestCleanResponse(t *testing.T) {
 	}
 }
 
+func TestSplitReasoning(t *testing.T) {
+	tests := []struct {
+		name      string
+		input     string
+		answer    string
+		reasoning string
+	}{
+		{"think block", "<think>\nLet me see.\n</think>\n\nParis", "Paris", "Let me see."},
+		{"only the closing tag", "Let me see.\n</think>\nParis", "Paris", "Let me see."},
+		{"cut off while thinking", "<think>\nLet me", "", "Let me"},
+		{"empty think block", "<think>\n\n</think>\n\nParis", "Paris", ""},
+		{"no reasoning", "Paris", "Paris", ""},
+		{"tags inside the answer", "Use <think> and </think> tags.", "Use <think> and </think> tags.", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			answer, reasoning := SplitReasoning(tt.input)
+			assert.Equal(t, tt.answer, answer)
+			assert.Equal(t, tt.reasoning, reasoning)
+		})
+	}
+}
+
 func TestNewLineEntity_PromptOnlyTrimmed(t *testing.T) {
 	prompt := "  ```json\nreturn this schema\n```  "
 
@@ -0,0 +1,190 @@
+package jsonl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrTruncated is returned by RepairJSON for a response that stops before its
+// JSON is complete, typically cut off by maxTokens. No repair can recover the
+// missing part, and a retry with the same limit is likely to stop there too.
+var ErrTruncated = errors.New("response ends before its JSON is complete (maxTokens too low?)")
+
+// RepairJSON makes what local models commonly answer into valid JSON: the
+// outermost object or array is taken out of any prose or code fence around
+// it, and trailing commas, single-quoted strings, raw newlines in strings and
+// Python's True, False and None are fixed. It returns the JSON and whether
+// that took any change.
+func RepairJSON(response string) (string, bool, error) {
+	trimmed := strings.TrimSpace(response)
+	if json.Valid([]byte(trimmed)) {
+		return trimmed, false, nil
+	}
+
+	// prose may have brackets of its own ("[see below]"): the JSON starts at
+	// the first one that opens a value that can be repaired
+	var firstErr, lastErr error
+	for start := 0; ; start++ {
+		next := strings.IndexAny(trimmed[start:], "{[")
+		if next < 0 {
+			break
+		}
+		start += next
+
+		repaired, err := repairValue(trimmed[start:])
+		if err == nil {
+			return repaired, true, nil
+		}
+		var cut *cutOff
+		if errors.As(err, &cut) {
+			if cut.stringStart < 0 {
+				return "", false, ErrTruncated // any later bracket is inside the cut-off value
+			}
+			// brackets up to the string that never closed are inside the
+			// value; past its quote, which may be an apostrophe in prose
+			// ("[it's]"), they may open the JSON
+			start += cut.stringStart
+		}
+		lastErr = err
+		if firstErr == nil && cut == nil {
+			firstErr = err
+		}
+	}
+	if errors.Is(lastErr, ErrTruncated) {
+		return "", false, ErrTruncated
+	}
+	if firstErr == nil {
+		firstErr = errors.New("response has no JSON object or array")
+	}
+	return "", false, firstErr
+}
+
+// cutOff is the ErrTruncated of a value that runs to the end of the response,
+// with where the string it ends in starts, or -1 if it doesn't end in one.
+type cutOff struct {
+	stringStart int
+}
+
+func (c *cutOff) Error() string { return ErrTruncated.Error() }
+func (c *cutOff) Unwrap() error { return ErrTruncated }
+
+func repairValue(s string) (string, error) {
+	repaired, err := rewriteJSON(s)
+	if err != nil {
+		return "", err
+	}
+	var value interface{}
+	if err := json.Unmarshal(repaired, &value); err != nil {
+		return "", fmt.Errorf("response JSON can't be repaired: %w", err)
+	}
+	return string(repaired), nil
+}
+
+// rewriteJSON copies the JSON value s starts with, fixing it on the way, and
+// drops whatever follows it.
+func rewriteJSON(s string) ([]byte, error) {
+	out := make([]byte, 0, len(s))
+	var closers []byte
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\'':
+			str, n, ok := rewriteString(s[i:])
+			if !ok {
+				return nil, &cutOff{stringStart: i}
+			}
+			out = append(out, str...)
+			i += n
+			continue
+
+		case c == '{':
+			closers = append(closers, '}')
+		case c == '[':
+			closers = append(closers, ']')
+
+		case c == '}' || c == ']':
+			if len(closers) == 0 || closers[len(closers)-1] != c {
+				return nil, fmt.Errorf("response JSON has an unbalanced '%c'", c)
+			}
+			closers = closers[:len(closers)-1]
+			out = append(dropTrailingComma(out), c)
+			if len(closers) == 0 {
+				return out, nil
+			}
+			i++
+			continue
+
+		case isWordByte(c):
+			end := i
+			for end < len(s) && isWordByte(s[end]) {
+				end++
+			}
+			word := s[i:end]
+			if literal, ok := pythonLiterals[word]; ok {
+				word = literal
+			}
+			out = append(out, word...)
+			i = end
+			continue
+		}
+		out = append(out, c)
+		i++
+	}
+	return nil, &cutOff{stringStart: -1}
+}
+
+var pythonLiterals = map[string]string{"True": "true", "False": "false", "None": "null"}
+
+func isWordByte(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_'
+}
+
+// rewriteString turns the string literal s starts with, in single or double
+// quotes, into a JSON string. It returns how much of s it took, and false if
+// s ends inside the string.
+func rewriteString(s string) ([]byte, int, bool) {
+	quote := s[0]
+	out := []byte{'"'}
+	for i := 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == quote:
+			return append(out, '"'), i + 1, true
+		case c == '\\':
+			if i+1 == len(s) {
+				return nil, 0, false
+			}
+			i++
+			if s[i] == '\'' {
+				out = append(out, '\'') // not an escape JSON has
+			} else {
+				out = append(out, c, s[i])
+			}
+		case c == '"':
+			out = append(out, '\\', '"') // inside single quotes
+		case c == '\n':
+			out = append(out, '\\', 'n')
+		case c == '\r':
+			out = append(out, '\\', 'r')
+		case c == '\t':
+			out = append(out, '\\', 't')
+		default:
+			out = append(out, c)
+		}
+	}
+	return nil, 0, false
+}
+
+// dropTrailingComma removes a comma left before a closing bracket.
+func dropTrailingComma(out []byte) []byte {
+	end := len(out)
+	for end > 0 && strings.ContainsRune(" \t\r\n", rune(out[end-1])) {
+		end--
+	}
+	if end > 0 && out[end-1] == ',' {
+		return append(out[:end-1], out[end:]...)
+	}
+	return out
+}
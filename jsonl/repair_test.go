@@ -0,0 +1,59 @@
+package jsonl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepairJSON(t *testing.T) {
+	tests := []struct {
+		name     string
+		response string
+		expected string
+		repaired bool
+	}{
+		{"valid JSON is left alone", ` {"a": 1} `, `{"a": 1}`, false},
+		{"prose around the JSON", `Here is the JSON: {"a": 1} Hope it helps!`, `{"a": 1}`, true},
+		{"code fence", "```json\n[1, 2]\n```", `[1, 2]`, true},
+		{"brackets in the prose", `Answer [see below]: {"a": [1]}`, `{"a": [1]}`, true},
+		{"apostrophe in bracketed prose", `Note [it's important]: {"a":1}`, `{"a":1}`, true},
+		{"trailing commas", `{"a": [1, 2, ], "b": 3,}`, `{"a": [1, 2 ], "b": 3}`, true},
+		{"single quotes", `{'a': 'it\'s "x"'}`, `{"a": "it's \"x\""}`, true},
+		{"raw newline in a string", "{\"a\": \"line\nbreak\"}", `{"a": "line\nbreak"}`, true},
+		{"python literals", `{"a": True, "b": None, "c": "True"}`, `{"a": true, "b": null, "c": "True"}`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, repaired, err := RepairJSON(tt.response)
+			require.NoError(t, err)
+			assert.Equal(t, tt.expected, got)
+			assert.Equal(t, tt.repaired, repaired)
+		})
+	}
+}
+
+func TestRepairJSON_Failures(t *testing.T) {
+	tests := []struct {
+		name      string
+		response  string
+		truncated bool
+	}{
+		{"cut off in a value", `{"a": [1, 2`, true},
+		{"cut off in a string", `Sure: {"a": "unfinis`, true},
+		{"cut off with a complete object inside", `{"a": {"b": 1}`, true},
+		{"cut off after an apostrophe in bracketed prose", `Note [it's: {"a": 1`, true},
+		{"unrepairable after an apostrophe in bracketed prose", `Note [it's: {"a" 1}`, false},
+		{"no JSON at all", `I can't help with that.`, false},
+		{"unrepairable", `{"a" 1}`, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := RepairJSON(tt.response)
+			require.Error(t, err)
+			assert.Equal(t, tt.truncated, errors.Is(err, ErrTruncated))
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package jsonschema
+
+import (
+	"slices"
+
+	"github.com/kaptinlin/jsonschema"
+)
+
+// Placeholder returns a value shaped like the schema, for previewing prompts
+// before the step that produces real values has run: strings read "<path>"
+// under the given root (e.g. "<author.name>") so it is obvious where each one
+// is used, enums and consts use their first allowed value, numbers 0, booleans
+// false, and arrays hold a single element.
+func (s *Schema) Placeholder(root string) interface{} {
+	if !s.HasSchemaDefinition() {
+		return nil
+	}
+	return placeholderFor(s.schema, root)
+}
+
+func placeholderFor(node *jsonschema.Schema, path string) interface{} {
+	if node == nil {
+		return "<" + path + ">"
+	}
+	if node.ResolvedRef != nil {
+		return placeholderFor(node.ResolvedRef, path)
+	}
+	if node.Const != nil && node.Const.IsSet {
+		return node.Const.Value
+	}
+	if len(node.Enum) > 0 {
+		return node.Enum[0]
+	}
+	for _, branches := range [][]*jsonschema.Schema{node.AnyOf, node.OneOf, node.AllOf} {
+		if len(branches) > 0 {
+			return placeholderFor(branches[0], path)
+		}
+	}
+
+	switch {
+	case node.Properties != nil || slices.Contains(node.Type, "object"):
+		obj := map[string]interface{}{}
+		if node.Properties != nil {
+			for name, child := range *node.Properties {
+				obj[name] = placeholderFor(child, path+"."+name)
+			}
+		}
+		return obj
+	case slices.Contains(node.Type, "array"):
+		return []interface{}{placeholderFor(node.Items, path+"[]")}
+	case slices.Contains(node.Type, "integer"), slices.Contains(node.Type, "number"):
+		return 0
+	case slices.Contains(node.Type, "boolean"):
+		return false
+	case slices.Contains(node.Type, "null"):
+		return nil
+	}
+	return "<" + path + ">"
+}
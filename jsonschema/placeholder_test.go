@@ -0,0 +1,39 @@
+package jsonschema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPlaceholder(t *testing.T) {
+	s, err := LoadSchema(`{
+		"type": "object",
+		"properties": {
+			"name": {"type": "string"},
+			"tier": {"type": "string", "enum": ["gold", "silver"]},
+			"age": {"type": "integer"},
+			"active": {"type": "boolean"},
+			"tags": {"type": "array", "items": {"type": "string"}},
+			"address": {"type": "object", "properties": {"city": {"type": "string"}}}
+		}
+	}`)
+	require.NoError(t, err)
+
+	got := s.Placeholder("person")
+
+	assert.Equal(t, map[string]interface{}{
+		"name":    "<person.name>",
+		"tier":    "gold",
+		"age":     0,
+		"active":  false,
+		"tags":    []interface{}{"<person.tags[]>"},
+		"address": map[string]interface{}{"city": "<person.address.city>"},
+	}, got)
+}
+
+func TestPlaceholder_NoSchema(t *testing.T) {
+	var s *Schema
+	assert.Nil(t, s.Placeholder("x"))
+}
@@ -0,0 +1,290 @@
+package jsonschema
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strings"
+
+	"github.com/kaptinlin/jsonschema"
+)
+
+// sampleWords is the vocabulary generated strings are made of.
+var sampleWords = []string{
+	"amber", "basin", "cobalt", "delta", "ember", "fjord", "granite", "harbor",
+	"island", "juniper", "kestrel", "lantern", "meadow", "nimbus", "orchard",
+	"prairie", "quartz", "river", "summit", "tundra", "umber", "valley",
+	"willow", "xenon", "yarrow", "zephyr",
+}
+
+// Sample returns a value that satisfies the schema, generated from the seed:
+// the same seed always gives the same value. It covers const and enum, anyOf,
+// oneOf and allOf (one branch), $ref, objects with every property filled in,
+// arrays within minItems/maxItems (uniqueItems honored), numbers within
+// minimum/maximum (exclusive bounds and multipleOf honored), strings within
+// minLength/maxLength, and the common string formats. A `pattern` is not
+// generated from, so a string with one may not match it.
+func (s *Schema) Sample(seed uint64) interface{} {
+	if !s.HasSchemaDefinition() {
+		return nil
+	}
+	g := &sampler{rng: rand.New(rand.NewPCG(seed, seed^0x9e3779b97f4a7c15))}
+	return g.value(s.schema, "value", 0)
+}
+
+type sampler struct {
+	rng *rand.Rand
+}
+
+// maxSampleDepth stops recursive schemas; below it only what is required is
+// generated, and arrays are as short as allowed.
+const maxSampleDepth = 8
+
+func (g *sampler) value(node *jsonschema.Schema, name string, depth int) interface{} {
+	if node == nil {
+		return g.words(1, 3)
+	}
+	if node.ResolvedRef != nil {
+		return g.value(node.ResolvedRef, name, depth)
+	}
+	if node.Const != nil && node.Const.IsSet {
+		return node.Const.Value
+	}
+	if len(node.Enum) > 0 {
+		return node.Enum[g.rng.IntN(len(node.Enum))]
+	}
+	for _, branches := range [][]*jsonschema.Schema{node.AnyOf, node.OneOf} {
+		if len(branches) > 0 {
+			return g.value(branches[g.rng.IntN(len(branches))], name, depth)
+		}
+	}
+	if len(node.AllOf) > 0 && len(node.Type) == 0 && node.Properties == nil {
+		return g.value(node.AllOf[0], name, depth)
+	}
+
+	types := node.Type
+	if len(types) == 0 {
+		switch {
+		case node.Properties != nil:
+			types = []string{"object"}
+		case node.Items != nil || len(node.PrefixItems) > 0:
+			types = []string{"array"}
+		default:
+			types = []string{"string"}
+		}
+	}
+	// with several types allowed, prefer a non-null one
+	kind := types[0]
+	if kind == "null" && len(types) > 1 {
+		kind = types[1]
+	}
+
+	switch kind {
+	case "object":
+		return g.object(node, depth)
+	case "array":
+		return g.array(node, name, depth)
+	case "integer":
+		return g.integer(node)
+	case "number":
+		return g.number(node)
+	case "boolean":
+		return g.rng.IntN(2) == 1
+	case "null":
+		return nil
+	}
+	return g.string(node, name)
+}
+
+func (g *sampler) object(node *jsonschema.Schema, depth int) interface{} {
+	obj := map[string]interface{}{}
+	if node.Properties == nil {
+		return obj
+	}
+
+	// sorted, so the random stream is consumed in the same order every time
+	names := make([]string, 0, len(*node.Properties))
+	for name := range *node.Properties {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	for _, name := range names {
+		if depth >= maxSampleDepth && !slices.Contains(node.Required, name) {
+			continue
+		}
+		obj[name] = g.value((*node.Properties)[name], name, depth+1)
+	}
+	return obj
+}
+
+func (g *sampler) array(node *jsonschema.Schema, name string, depth int) interface{} {
+	minItems, maxItems := len(node.PrefixItems), len(node.PrefixItems)+3
+	if node.MinItems != nil {
+		minItems = max(minItems, int(*node.MinItems))
+	}
+	if node.MaxItems != nil {
+		maxItems = int(*node.MaxItems)
+	}
+	if maxItems < minItems {
+		maxItems = minItems
+	}
+	if minItems == 0 && maxItems > 0 {
+		minItems = 1 // an empty array says little about the shape
+	}
+
+	n := minItems
+	if depth < maxSampleDepth {
+		n += g.rng.IntN(maxItems - minItems + 1)
+	}
+
+	unique := node.UniqueItems != nil && *node.UniqueItems
+	items := make([]interface{}, 0, n)
+	seen := map[string]bool{}
+	for i := 0; len(items) < n && i < n*10; i++ {
+		item := node.Items
+		if idx := len(items); idx < len(node.PrefixItems) {
+			item = node.PrefixItems[idx]
+		}
+		v := g.value(item, name, depth+1)
+		if unique {
+			key := fmt.Sprintf("%#v", v)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+		}
+		items = append(items, v)
+	}
+	return items
+}
+
+// bounds returns the inclusive range a number may take, defaulting to 0..100
+// and staying within 100 of a single given bound.
+func bounds(node *jsonschema.Schema, step float64) (float64, float64) {
+	lo, hi := math.Inf(-1), math.Inf(1)
+	if node.Minimum != nil {
+		lo, _ = node.Minimum.Float64()
+	}
+	if node.ExclusiveMinimum != nil {
+		v, _ := node.ExclusiveMinimum.Float64()
+		lo = max(lo, v+step)
+	}
+	if node.Maximum != nil {
+		hi, _ = node.Maximum.Float64()
+	}
+	if node.ExclusiveMaximum != nil {
+		v, _ := node.ExclusiveMaximum.Float64()
+		hi = min(hi, v-step)
+	}
+
+	switch {
+	case math.IsInf(lo, -1) && math.IsInf(hi, 1):
+		lo, hi = 0, 100
+	case math.IsInf(lo, -1):
+		lo = hi - 100
+	case math.IsInf(hi, 1):
+		hi = lo + 100
+	}
+	return lo, hi
+}
+
+func (g *sampler) integer(node *jsonschema.Schema) interface{} {
+	lo, hi := bounds(node, 1)
+	low, high := int64(math.Ceil(lo)), int64(math.Floor(hi))
+	if high < low {
+		return low
+	}
+
+	if node.MultipleOf != nil {
+		if m, _ := node.MultipleOf.Float64(); m >= 1 && m == math.Trunc(m) {
+			step := int64(m)
+			first := int64(math.Ceil(float64(low)/m)) * step
+			if first > high {
+				return first
+			}
+			return first + step*g.rng.Int64N((high-first)/step+1)
+		}
+	}
+	return low + g.rng.Int64N(high-low+1)
+}
+
+func (g *sampler) number(node *jsonschema.Schema) interface{} {
+	lo, hi := bounds(node, 0.01)
+	if node.MultipleOf != nil {
+		if m, _ := node.MultipleOf.Float64(); m > 0 {
+			first, last := math.Ceil(lo/m), math.Floor(hi/m)
+			if last < first {
+				return first * m
+			}
+			return (first + float64(g.rng.Int64N(int64(last-first)+1))) * m
+		}
+	}
+	if hi <= lo {
+		return lo
+	}
+	// two decimals keep the value readable and inside the bounds
+	v := math.Round((lo+g.rng.Float64()*(hi-lo))*100) / 100
+	return min(max(v, lo), hi)
+}
+
+func (g *sampler) string(node *jsonschema.Schema, name string) interface{} {
+	var s string
+	format := ""
+	if node.Format != nil {
+		format = *node.Format
+	}
+
+	switch format {
+	case "date-time":
+		s = fmt.Sprintf("2024-%02d-%02dT%02d:%02d:00Z", 1+g.rng.IntN(12), 1+g.rng.IntN(28), g.rng.IntN(24), g.rng.IntN(60))
+	case "date":
+		s = fmt.Sprintf("2024-%02d-%02d", 1+g.rng.IntN(12), 1+g.rng.IntN(28))
+	case "time":
+		s = fmt.Sprintf("%02d:%02d:00Z", g.rng.IntN(24), g.rng.IntN(60))
+	case "email":
+		s = g.word() + "@" + g.word() + ".example"
+	case "uri", "url":
+		s = "https://" + g.word() + ".example/" + g.word()
+	case "hostname":
+		s = g.word() + ".example"
+	case "uuid":
+		s = fmt.Sprintf("%08x-%04x-4%03x-8%03x-%012x", g.rng.Uint32(), g.rng.IntN(1<<16), g.rng.IntN(1<<12), g.rng.IntN(1<<12), g.rng.Int64N(1<<48))
+	case "ipv4":
+		s = fmt.Sprintf("10.%d.%d.%d", g.rng.IntN(256), g.rng.IntN(256), 1+g.rng.IntN(254))
+	default:
+		s = name + " " + g.words(1, 4)
+	}
+
+	minLength, maxLength := 0, -1
+	if node.MinLength != nil {
+		minLength = int(*node.MinLength)
+	}
+	if node.MaxLength != nil {
+		maxLength = int(*node.MaxLength)
+	}
+	for len([]rune(s)) < minLength {
+		s += " " + g.word()
+	}
+	if maxLength >= 0 && len([]rune(s)) > maxLength {
+		s = strings.TrimSpace(string([]rune(s)[:maxLength]))
+		for len([]rune(s)) < minLength { // trimming took a space off
+			s += "x"
+		}
+	}
+	return s
+}
+
+func (g *sampler) word() string {
+	return sampleWords[g.rng.IntN(len(sampleWords))]
+}
+
+func (g *sampler) words(minWords, maxWords int) string {
+	n := minWords + g.rng.IntN(maxWords-minWords+1)
+	words := make([]string, n)
+	for i := range words {
+		words[i] = g.word()
+	}
+	return strings.Join(words, " ")
+}
@@ -0,0 +1,69 @@
+package jsonschema
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const sampleSchema = `{
+	"type": "object",
+	"properties": {
+		"name": {"type": "string", "minLength": 3, "maxLength": 12},
+		"tier": {"type": "string", "enum": ["gold", "silver", "bronze"]},
+		"age": {"type": "integer", "minimum": 18, "maximum": 65},
+		"score": {"type": "number", "exclusiveMinimum": 0, "maximum": 1},
+		"bucket": {"type": "integer", "multipleOf": 5, "minimum": 1, "maximum": 50},
+		"active": {"type": "boolean"},
+		"email": {"type": "string", "format": "email"},
+		"born": {"type": "string", "format": "date"},
+		"tags": {"type": "array", "items": {"type": "string", "enum": ["a", "b", "c"]}, "minItems": 2, "maxItems": 3, "uniqueItems": true},
+		"address": {
+			"type": "object",
+			"properties": {"city": {"type": "string"}, "zip": {"type": ["string", "null"]}},
+			"required": ["city", "zip"],
+			"additionalProperties": false
+		},
+		"contact": {"anyOf": [{"type": "string", "format": "uri"}, {"type": "integer", "minimum": 1}]},
+		"parent": {"$ref": "#/$defs/node"}
+	},
+	"required": ["name", "tier", "age", "score", "bucket", "active", "email", "born", "tags", "address", "contact", "parent"],
+	"additionalProperties": false,
+	"$defs": {
+		"node": {
+			"type": "object",
+			"properties": {"label": {"type": "string"}, "child": {"$ref": "#/$defs/node"}},
+			"required": ["label"]
+		}
+	}
+}`
+
+func TestSample_IsValidForManySeeds(t *testing.T) {
+	s, err := LoadSchema(sampleSchema)
+	require.NoError(t, err)
+
+	tiers := map[interface{}]bool{}
+	for seed := range uint64(200) {
+		value := s.Sample(seed)
+		data, err := json.Marshal(value)
+		require.NoError(t, err)
+		require.NoError(t, s.ValidateJSONText(string(data)), "seed %d: %s", seed, data)
+		tiers[value.(map[string]interface{})["tier"]] = true
+	}
+	assert.Len(t, tiers, 3, "every enum value turns up")
+}
+
+func TestSample_IsDeterministic(t *testing.T) {
+	s, err := LoadSchema(sampleSchema)
+	require.NoError(t, err)
+
+	assert.Equal(t, s.Sample(42), s.Sample(42))
+	assert.NotEqual(t, s.Sample(42), s.Sample(43))
+}
+
+func TestSample_NoSchema(t *testing.T) {
+	var s *Schema
+	assert.Nil(t, s.Sample(1))
+}
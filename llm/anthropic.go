@@ -0,0 +1,287 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mirpo/datamatic/retry"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultAnthropicBaseURL = "https://api.anthropic.com"
+	anthropicVersion        = "2023-06-01"
+	// anthropicMaxTokens is sent when the step sets no maxTokens: the Messages
+	// API requires a limit on every request.
+	anthropicMaxTokens = 4096
+	// anthropicToolName is the tool a step with a schema is forced to call; its
+	// input is the structured response.
+	anthropicToolName = "json_output"
+)
+
+// AnthropicProvider talks to the Anthropic Messages API directly.
+type AnthropicProvider struct {
+	config ProviderConfig
+	client *http.Client
+	url    string
+}
+
+func NewAnthropicProvider(config ProviderConfig) *AnthropicProvider {
+	client := &http.Client{}
+	if config.HTTPTimeout > 0 {
+		client.Timeout = time.Duration(config.HTTPTimeout) * time.Second
+	}
+
+	base := strings.TrimSuffix(config.BaseURL, "/")
+	if base == "" {
+		base = DefaultAnthropicBaseURL
+	}
+	url := base + "/v1/messages"
+	if strings.HasSuffix(base, "/v1") {
+		url = base + "/messages"
+	}
+
+	return &AnthropicProvider{config: config, client: client, url: url}
+}
+
+type anthropicRequest struct {
+	Model       string             `json:"model"`
+	MaxTokens   int                `json:"max_tokens"`
+	System      string             `json:"system,omitempty"`
+	Messages    []anthropicMessage `json:"messages"`
+	Temperature *float64           `json:"temperature,omitempty"`
+	TopP        *float64           `json:"top_p,omitempty"`
+	Stop        []string           `json:"stop_sequences,omitempty"`
+	Tools       []anthropicTool    `json:"tools,omitempty"`
+	ToolChoice  *anthropicChoice   `json:"tool_choice,omitempty"`
+}
+
+type anthropicMessage struct {
+	Role    string           `json:"role"`
+	Content []anthropicBlock `json:"content"`
+}
+
+type anthropicBlock struct {
+	Type   string           `json:"type"`
+	Text   string           `json:"text,omitempty"`
+	Source *anthropicSource `json:"source,omitempty"`
+	// tool_use and thinking blocks, in responses
+	Name     string          `json:"name,omitempty"`
+	Input    json.RawMessage `json:"input,omitempty"`
+	Thinking string          `json:"thinking,omitempty"`
+}
+
+type anthropicSource struct {
+	Type      string `json:"type"`
+	MediaType string `json:"media_type"`
+	Data      string `json:"data"`
+}
+
+type anthropicTool struct {
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	InputSchema interface{} `json:"input_schema"`
+}
+
+type anthropicChoice struct {
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+type anthropicResponse struct {
+	Model      string           `json:"model"`
+	Content    []anthropicBlock `json:"content"`
+	StopReason string           `json:"stop_reason"`
+	Usage      struct {
+		InputTokens  int `json:"input_tokens"`
+		OutputTokens int `json:"output_tokens"`
+	} `json:"usage"`
+}
+
+type anthropicError struct {
+	Error struct {
+		Type    string `json:"type"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// buildRequest translates a GenerateRequest into a Messages API body. An image
+// goes first, as Anthropic recommends; a schema becomes a tool the model is
+// forced to call, since the API has no JSON response format.
+func (p *AnthropicProvider) buildRequest(request GenerateRequest) anthropicRequest {
+	req := anthropicRequest{
+		Model:       p.config.ModelName,
+		MaxTokens:   anthropicMaxTokens,
+		System:      request.SystemMessage,
+		Temperature: p.config.Temperature,
+		TopP:        p.config.TopP,
+		Stop:        p.config.Stop,
+	}
+	if p.config.MaxTokens != nil {
+		req.MaxTokens = *p.config.MaxTokens
+	}
+
+	var content []anthropicBlock
+	if request.Base64Image != "" {
+		content = append(content, anthropicBlock{
+			Type: "image",
+			Source: &anthropicSource{
+				Type:      "base64",
+				MediaType: imageMediaType(request.Base64Image),
+				Data:      request.Base64Image,
+			},
+		})
+	}
+	content = append(content, anthropicBlock{Type: "text", Text: request.UserMessage})
+
+	turn := func(message Message) anthropicMessage {
+		return anthropicMessage{Role: message.Role, Content: []anthropicBlock{{Type: "text", Text: message.Content}}}
+	}
+	for _, message := range request.Messages {
+		req.Messages = append(req.Messages, turn(message))
+	}
+	req.Messages = append(req.Messages, anthropicMessage{Role: "user", Content: content})
+	for _, followup := range request.Followups {
+		req.Messages = append(req.Messages, turn(followup))
+	}
+
+	if request.IsJSON {
+		req.Tools = []anthropicTool{{
+			Name:        anthropicToolName,
+			Description: "Return the response as JSON matching this schema.",
+			InputSchema: request.JSONSchema.GetSchema(),
+		}}
+		req.ToolChoice = &anthropicChoice{Type: "tool", Name: anthropicToolName}
+	}
+
+	return req
+}
+
+// imageMediaType sniffs the type the API requires for an image block; the
+// other providers get away with always claiming JPEG, this one checks.
+func imageMediaType(base64Image string) string {
+	head := base64Image[:min(len(base64Image), 64)]
+	head = head[:len(head)/4*4]
+	data, err := base64.StdEncoding.DecodeString(head)
+	if err != nil {
+		return "image/jpeg"
+	}
+	switch mediaType := http.DetectContentType(data); mediaType {
+	case "image/png", "image/gif", "image/webp", "image/jpeg":
+		return mediaType
+	}
+	return "image/jpeg"
+}
+
+// encode returns the request body Generate sends, extraBody included.
+func (p *AnthropicProvider) encode(request GenerateRequest) ([]byte, error) {
+	body, err := json.Marshal(p.buildRequest(request))
+	if err != nil {
+		return nil, err
+	}
+	return withExtraBody(body, p.config.ExtraBody)
+}
+
+// PreviewRequest returns the JSON body Generate would send for the request.
+func (p *AnthropicProvider) PreviewRequest(request GenerateRequest) ([]byte, error) {
+	return previewBody(p.encode(request))
+}
+
+func (p *AnthropicProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	body, err := p.encode(request)
+	if err != nil {
+		return nil, fmt.Errorf("llm: anthropic: failed to encode request: %w", err)
+	}
+
+	log.Debug().Msgf("LLM request: model=%s, to url: %s", p.config.ModelName, p.url)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("llm: anthropic: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpReq.Header.Set("x-api-key", p.config.AuthToken)
+	httpReq.Header.Set("anthropic-version", anthropicVersion)
+
+	httpResp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("llm: anthropic: messages request failed: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("llm: anthropic: failed to read response: %w", err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(data))
+		var apiErr anthropicError
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error.Message != "" {
+			message = apiErr.Error.Type + ": " + apiErr.Error.Message
+		}
+		return nil, fmt.Errorf("llm: anthropic: messages request failed: %w",
+			&retry.HTTPError{StatusCode: httpResp.StatusCode, Message: message, RetryAfter: retry.ParseRetryAfter(httpResp.Header, time.Now())})
+	}
+
+	var resp anthropicResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("llm: anthropic: invalid response: %w", err)
+	}
+
+	log.Debug().Msgf("Anthropic response: model=%s, blocks=%d, stop=%s, usage=%+v", resp.Model, len(resp.Content), resp.StopReason, resp.Usage)
+
+	text, err := responseText(resp, request.IsJSON)
+	if err != nil {
+		return nil, err
+	}
+
+	return &GenerateResponse{
+		Text:      text,
+		Reasoning: thinkingText(resp),
+		Usage: Usage{
+			PromptTokens:     resp.Usage.InputTokens,
+			CompletionTokens: resp.Usage.OutputTokens,
+		},
+	}, nil
+}
+
+// responseText is the forced tool call's input for a structured request, and
+// the concatenated text blocks otherwise.
+func responseText(resp anthropicResponse, isJSON bool) (string, error) {
+	if isJSON {
+		for _, block := range resp.Content {
+			if block.Type == "tool_use" && block.Name == anthropicToolName {
+				return string(block.Input), nil
+			}
+		}
+		return "", fmt.Errorf("llm: anthropic: response has no '%s' tool call (stop reason: %s)", anthropicToolName, resp.StopReason)
+	}
+
+	var text strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "text" {
+			text.WriteString(block.Text)
+		}
+	}
+	return text.String(), nil
+}
+
+// thinkingText is the concatenated thinking blocks of a response, present when
+// extended thinking is turned on (through extraBody).
+func thinkingText(resp anthropicResponse) string {
+	var thinking strings.Builder
+	for _, block := range resp.Content {
+		if block.Type == "thinking" {
+			thinking.WriteString(block.Thinking)
+		}
+	}
+	return thinking.String()
+}
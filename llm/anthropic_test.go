@@ -0,0 +1,130 @@
+package llm
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/jsonschema"
+	"github.com/mirpo/datamatic/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnthropic_SendsSystemPromptAndReadsText(t *testing.T) {
+	srv := llmtest.NewAnthropicServer(t, "Hello there")
+	srv.InputTokens, srv.OutputTokens = 12, 3
+	temperature := 0.0
+
+	provider := NewAnthropicProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "claude-x", AuthToken: "key", Temperature: &temperature})
+	resp, err := provider.Generate(context.Background(), GenerateRequest{SystemMessage: "Be brief.", UserMessage: "Hi"})
+	require.NoError(t, err)
+	assert.Equal(t, "Hello there", resp.Text)
+	assert.Equal(t, Usage{PromptTokens: 12, CompletionTokens: 3}, resp.Usage)
+
+	req := srv.Requests()[0]
+	assert.Equal(t, "claude-x", req["model"])
+	assert.Equal(t, "Be brief.", req["system"])
+	assert.EqualValues(t, anthropicMaxTokens, req["max_tokens"], "the API requires a limit")
+	assert.EqualValues(t, 0, req["temperature"], "a zero temperature is sent")
+	assert.Nil(t, req["tools"])
+
+	header := srv.Headers()[0]
+	assert.Equal(t, "key", header.Get("x-api-key"))
+	assert.Equal(t, anthropicVersion, header.Get("anthropic-version"))
+}
+
+func TestAnthropic_SendsSamplingSettingsAndExtraBody(t *testing.T) {
+	srv := llmtest.NewAnthropicServer(t, "ok")
+	topP := 0.9
+
+	provider := NewAnthropicProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "claude-x", AuthToken: "key",
+		TopP: &topP, Stop: []string{"END"}, ExtraBody: map[string]interface{}{"metadata": map[string]interface{}{"user_id": "u1"}}})
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "Hi"})
+	require.NoError(t, err)
+
+	req := srv.Requests()[0]
+	assert.Equal(t, 0.9, req["top_p"])
+	assert.Equal(t, []interface{}{"END"}, req["stop_sequences"])
+	assert.Equal(t, map[string]interface{}{"user_id": "u1"}, req["metadata"])
+}
+
+func TestAnthropic_StructuredOutputThroughAForcedTool(t *testing.T) {
+	srv := llmtest.NewAnthropicServer(t, `{"city":"Oslo"}`)
+	schema, err := jsonschema.LoadSchema(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`)
+	require.NoError(t, err)
+
+	provider := NewAnthropicProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+	resp, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "A city", IsJSON: true, JSONSchema: *schema})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"city":"Oslo"}`, resp.Text)
+
+	req := srv.Requests()[0]
+	tools := req["tools"].([]interface{})
+	require.Len(t, tools, 1)
+	tool := tools[0].(map[string]interface{})
+	assert.Equal(t, anthropicToolName, tool["name"])
+	assert.Equal(t, "object", tool["input_schema"].(map[string]interface{})["type"])
+	assert.Equal(t, map[string]interface{}{"type": "tool", "name": anthropicToolName}, req["tool_choice"])
+}
+
+func TestAnthropic_SendsImageBlocks(t *testing.T) {
+	srv := llmtest.NewAnthropicServer(t, "a cat")
+	png := base64.StdEncoding.EncodeToString([]byte("\x89PNG\r\n\x1a\n\x00\x00\x00\rIHDR"))
+
+	provider := NewAnthropicProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "What is this?", Base64Image: png})
+	require.NoError(t, err)
+
+	content := srv.Requests()[0]["messages"].([]interface{})[0].(map[string]interface{})["content"].([]interface{})
+	require.Len(t, content, 2)
+	image := content[0].(map[string]interface{})
+	assert.Equal(t, "image", image["type"])
+	assert.Equal(t, map[string]interface{}{"type": "base64", "media_type": "image/png", "data": png}, image["source"])
+	assert.Equal(t, "What is this?", content[1].(map[string]interface{})["text"])
+}
+
+func TestAnthropic_SendsConversationTurns(t *testing.T) {
+	srv := llmtest.NewAnthropicServer(t, "ok")
+
+	provider := NewAnthropicProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "Hi",
+		Messages:  []Message{{Role: RoleUser, Content: "Ping"}, {Role: RoleAssistant, Content: "Pong"}},
+		Followups: []Message{{Role: RoleAssistant, Content: "Hey"}, {Role: RoleUser, Content: "Again"}}})
+	require.NoError(t, err)
+
+	var turns []string
+	for _, m := range srv.Requests()[0]["messages"].([]interface{}) {
+		message := m.(map[string]interface{})
+		text := message["content"].([]interface{})[0].(map[string]interface{})["text"]
+		turns = append(turns, message["role"].(string)+": "+text.(string))
+	}
+	assert.Equal(t, []string{"user: Ping", "assistant: Pong", "user: Hi", "assistant: Hey", "user: Again"}, turns)
+}
+
+func TestAnthropic_OverloadedIsRetried(t *testing.T) {
+	srv := llmtest.NewAnthropicServer(t, "ok")
+	srv.FailFirst = 1
+
+	provider := NewAnthropicProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+
+	var httpErr *retry.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, 529, httpErr.StatusCode)
+	assert.Contains(t, httpErr.Message, "overloaded_error")
+	assert.True(t, retry.ShouldRetryHTTPError(err))
+
+	srv.FailFirst, srv.FailStatus = 2, 401
+	_, err = provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	assert.False(t, retry.ShouldRetryHTTPError(err), "a bad key is not retried")
+}
+
+func TestImageMediaType(t *testing.T) {
+	encode := func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) }
+	assert.Equal(t, "image/png", imageMediaType(encode("\x89PNG\r\n\x1a\nrest")))
+	assert.Equal(t, "image/gif", imageMediaType(encode("GIF89a....")))
+	assert.Equal(t, "image/jpeg", imageMediaType(encode("\xff\xd8\xff\xe0....")))
+	assert.Equal(t, "image/jpeg", imageMediaType("not base64!"), "unknown data falls back to JPEG")
+}
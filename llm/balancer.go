@@ -0,0 +1,248 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// endpointCooldown is how long an endpoint that failed to connect stays out
+	// of rotation before it is health-checked; it doubles with every failed
+	// check, up to endpointMaxCooldown.
+	endpointCooldown    = 5 * time.Second
+	endpointMaxCooldown = 2 * time.Minute
+	healthCheckTimeout  = 5 * time.Second
+)
+
+// Balancer spreads one model's requests over several endpoints serving it,
+// such as a few Ollama boxes. A request goes to the endpoint with the fewest
+// requests in flight that is below its concurrency limit, and waits while all
+// of them are busy. An endpoint that can't be connected to is taken out of
+// rotation, its request moves to another endpoint, and it comes back once a
+// health check reaches it again. Endpoints in rotation are not health-checked:
+// a failed connection is what takes one out.
+type Balancer struct {
+	endpoints []*endpoint
+	cooldown  time.Duration
+	check     func(ctx context.Context, url string) error
+
+	mu   sync.Mutex
+	wake chan struct{} // closed and replaced whenever capacity frees up
+}
+
+type endpoint struct {
+	url      string
+	limit    int
+	provider Provider
+
+	inFlight  int
+	down      bool
+	downUntil time.Time
+	cooldown  time.Duration
+	probing   bool
+	lastErr   error
+}
+
+// NewBalancer creates a provider per endpoint from the config, each a copy
+// with the endpoint's URL as its base URL.
+func NewBalancer(config ProviderConfig) (*Balancer, error) {
+	b := &Balancer{cooldown: endpointCooldown, check: healthCheck, wake: make(chan struct{})}
+
+	for _, e := range config.Endpoints {
+		endpointConfig := config
+		endpointConfig.BaseURL = e.URL
+		endpointConfig.Endpoints = nil
+		provider, err := NewProvider(endpointConfig)
+		if err != nil {
+			return nil, fmt.Errorf("llm: endpoint %s: %w", e.URL, err)
+		}
+		b.endpoints = append(b.endpoints, &endpoint{url: e.URL, limit: max(e.Concurrency, 1), provider: provider})
+	}
+	return b, nil
+}
+
+func (b *Balancer) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	for {
+		e, err := b.acquire(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := e.provider.Generate(ctx, request)
+		failed := err != nil && ctx.Err() == nil && isConnectionError(err)
+		b.release(e, failed, err)
+		if !failed {
+			return resp, err
+		}
+		// not the model's answer: the request never got there, so try another
+	}
+}
+
+// PreviewRequest returns the body the first endpoint would be sent; all of
+// them serve the same model.
+func (b *Balancer) PreviewRequest(request GenerateRequest) ([]byte, error) {
+	previewer, ok := b.endpoints[0].provider.(RequestPreviewer)
+	if !ok {
+		return nil, errors.New("llm: endpoint provider cannot preview requests")
+	}
+	return previewer.PreviewRequest(request)
+}
+
+// acquire reserves a slot on the least busy endpoint in rotation, waiting for
+// one to free up when all are at their limit. An endpoint whose cooldown has
+// passed is health-checked first. With every endpoint out of rotation it
+// fails instead of waiting: the request can't be sent anywhere.
+func (b *Balancer) acquire(ctx context.Context) (*endpoint, error) {
+	for {
+		b.mu.Lock()
+		e, probe, wait, err := b.pick(time.Now())
+		wake := b.wake
+		b.mu.Unlock()
+
+		if err != nil {
+			return nil, err
+		}
+		if e != nil && !probe {
+			return e, nil
+		}
+		if e != nil {
+			if b.probe(ctx, e) {
+				return e, nil
+			}
+			continue
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		case <-wake:
+		case <-timer.C:
+		}
+		timer.Stop()
+	}
+}
+
+// pick chooses an endpoint under b.mu: the one with the fewest requests in
+// flight among those in rotation with room, or one due for a health check
+// (probe). With none available it returns how long to wait at most.
+func (b *Balancer) pick(now time.Time) (chosen *endpoint, probe bool, wait time.Duration, err error) {
+	wait = time.Hour // until capacity frees up
+	allDown := true
+	var lastErr error
+	for _, e := range b.endpoints {
+		if e.down {
+			lastErr = e.lastErr
+			if e.probing {
+				allDown = false // may come back any moment
+				continue
+			}
+			if now.Before(e.downUntil) {
+				wait = min(wait, e.downUntil.Sub(now))
+				continue
+			}
+			e.probing = true
+			e.inFlight++
+			return e, true, 0, nil
+		}
+
+		allDown = false
+		if e.inFlight < e.limit && (chosen == nil || e.inFlight < chosen.inFlight) {
+			chosen = e
+		}
+	}
+
+	if chosen != nil {
+		chosen.inFlight++
+		return chosen, false, 0, nil
+	}
+	if allDown {
+		return nil, false, 0, fmt.Errorf("llm: all %d endpoints are out of rotation: %w", len(b.endpoints), lastErr)
+	}
+	return nil, false, wait, nil
+}
+
+// probe health-checks an endpoint due for it, holding a slot on it: it goes
+// back into rotation when it answers, or stays out for a longer cooldown.
+func (b *Balancer) probe(ctx context.Context, e *endpoint) bool {
+	err := b.check(ctx, e.url)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e.probing = false
+	if err == nil {
+		e.down = false
+		e.cooldown = 0
+		log.Info().Msgf("llm: endpoint %s is back in rotation", e.url)
+		return true
+	}
+
+	e.inFlight--
+	e.cooldown = min(e.cooldown*2, endpointMaxCooldown)
+	e.downUntil = time.Now().Add(e.cooldown)
+	e.lastErr = err
+	log.Warn().Err(err).Msgf("llm: endpoint %s failed its health check, next one in %s", e.url, e.cooldown)
+	b.broadcast()
+	return false
+}
+
+// release frees the slot a request held, taking the endpoint out of rotation
+// when the request could not connect.
+func (b *Balancer) release(e *endpoint, failed bool, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	e.inFlight--
+	if failed && !e.down {
+		e.down = true
+		e.cooldown = b.cooldown
+		e.downUntil = time.Now().Add(e.cooldown)
+		e.lastErr = err
+		log.Warn().Err(err).Msgf("llm: endpoint %s is out of rotation for %s", e.url, e.cooldown)
+	}
+	b.broadcast()
+}
+
+func (b *Balancer) broadcast() {
+	close(b.wake)
+	b.wake = make(chan struct{})
+}
+
+// isConnectionError reports whether a request failed before reaching the
+// server: the connection couldn't be made (refused, unreachable or timed out)
+// or the host didn't resolve. A connection that breaks later, such as a reset
+// or a read timeout, may have delivered the request already, and sending it
+// to another endpoint could have it processed twice.
+func isConnectionError(err error) bool {
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return true
+	}
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr)
+}
+
+// healthCheck reports whether an endpoint can be reached: any HTTP response
+// to its URL will do, even an error status.
+func healthCheck(ctx context.Context, url string) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,126 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// deadURL returns the URL of a server that is no longer listening.
+func deadURL(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(nil)
+	srv.Close()
+	return srv.URL
+}
+
+func newTestBalancer(t *testing.T, endpoints ...Endpoint) *Balancer {
+	t.Helper()
+	b, err := NewBalancer(ProviderConfig{ProviderType: ProviderOllama, ModelName: "m", Endpoints: endpoints})
+	require.NoError(t, err)
+	return b
+}
+
+func generateConcurrently(t *testing.T, b *Balancer, n int) {
+	t.Helper()
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := b.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBalancer_SpreadsRequestsWithinEndpointLimits(t *testing.T) {
+	first := llmtest.NewServer(t, "a")
+	first.Delay = 50 * time.Millisecond
+	second := llmtest.NewServer(t, "b")
+	second.Delay = 50 * time.Millisecond
+
+	b := newTestBalancer(t, Endpoint{URL: first.URL, Concurrency: 2}, Endpoint{URL: second.URL, Concurrency: 1})
+
+	generateConcurrently(t, b, 6)
+
+	assert.Equal(t, 6, first.CallCount()+second.CallCount())
+	assert.LessOrEqual(t, first.MaxConcurrent(), 2)
+	assert.Equal(t, 1, second.MaxConcurrent())
+	assert.Positive(t, second.CallCount(), "least-in-flight uses every endpoint")
+}
+
+func TestBalancer_MovesRequestsOffAnUnreachableEndpoint(t *testing.T) {
+	alive := llmtest.NewServer(t, "ok")
+	b := newTestBalancer(t, Endpoint{URL: deadURL(t)}, Endpoint{URL: alive.URL})
+
+	for range 3 {
+		resp, err := b.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+		require.NoError(t, err)
+		assert.Equal(t, "ok", resp.Text)
+	}
+	assert.Equal(t, 3, alive.CallCount())
+	assert.True(t, b.endpoints[0].down)
+}
+
+func TestBalancer_FailsWhenEveryEndpointIsOutOfRotation(t *testing.T) {
+	b := newTestBalancer(t, Endpoint{URL: deadURL(t)}, Endpoint{URL: deadURL(t)})
+
+	_, err := b.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+
+	assert.ErrorContains(t, err, "all 2 endpoints are out of rotation")
+}
+
+func TestBalancer_HealthCheckReturnsEndpointToRotation(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	b := newTestBalancer(t, Endpoint{URL: srv.URL})
+	b.cooldown = time.Millisecond
+
+	var checks atomic.Int32
+	healthy := atomic.Bool{}
+	b.check = func(ctx context.Context, url string) error {
+		checks.Add(1)
+		if !healthy.Load() {
+			return context.DeadlineExceeded
+		}
+		return nil
+	}
+
+	// as if an earlier request could not connect
+	e, err := b.acquire(context.Background())
+	require.NoError(t, err)
+	b.release(e, true, context.DeadlineExceeded)
+
+	time.Sleep(5 * time.Millisecond)
+	_, err = b.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	assert.ErrorContains(t, err, "out of rotation", "a failed health check keeps it out")
+
+	healthy.Store(true)
+	time.Sleep(10 * time.Millisecond) // past the doubled cooldown
+	resp, err := b.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp.Text)
+	assert.Equal(t, int32(2), checks.Load())
+}
+
+func TestIsConnectionError(t *testing.T) {
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}
+
+	assert.True(t, isConnectionError(fmt.Errorf("post: %w", refused)))
+	assert.True(t, isConnectionError(&net.DNSError{Err: "no such host", Name: "gpu-9", IsNotFound: true}))
+	assert.False(t, isConnectionError(fmt.Errorf("post: %w", reset)), "the request may have been delivered")
+	assert.False(t, isConnectionError(errors.New("status 500")))
+}
@@ -0,0 +1,232 @@
+package llm
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/mirpo/datamatic/retry"
+	"github.com/sashabaranov/go-openai"
+)
+
+// BatchProvider is implemented by providers with an asynchronous batch API:
+// requests are uploaded at once, processed within hours at a discount, and
+// their results downloaded when the job is done.
+type BatchProvider interface {
+	SubmitBatch(ctx context.Context, items []BatchItem) (string, error)
+	RetrieveBatch(ctx context.Context, id string) (BatchJob, error)
+	BatchResults(ctx context.Context, job BatchJob) ([]BatchResult, error)
+}
+
+// BatchItem is one request of a batch; its ID comes back with its result.
+type BatchItem struct {
+	ID      string
+	Request GenerateRequest
+}
+
+// BatchJob is a submitted batch as the provider reports it.
+type BatchJob struct {
+	ID           string
+	Status       string
+	Total        int
+	Completed    int
+	Failed       int
+	OutputFileID string
+	ErrorFileID  string
+}
+
+// Done reports whether the job has stopped: completed, or failed, expired or
+// cancelled, in which case only some requests (or none) have results.
+func (j BatchJob) Done() bool {
+	switch j.Status {
+	case "completed", "failed", "expired", "cancelled":
+		return true
+	}
+	return false
+}
+
+// BatchResult is the outcome of one item: a response, or the error the
+// provider gave for it.
+type BatchResult struct {
+	ID       string
+	Response *GenerateResponse
+	Err      error
+}
+
+// batchCompletionWindow is the only window the Batch API offers.
+const batchCompletionWindow = "24h"
+
+func (p *OpenAIProvider) SubmitBatch(ctx context.Context, items []BatchItem) (string, error) {
+	upload := openai.UploadBatchFileRequest{FileName: "datamatic-batch.jsonl"}
+	mode := p.outputMode()
+	for _, item := range items {
+		upload.Lines = append(upload.Lines, batchLine{
+			line: openai.BatchChatCompletionRequest{
+				CustomID: item.ID,
+				Body:     p.buildRequest(item.Request, mode),
+				Method:   http.MethodPost,
+				URL:      openai.BatchEndpointChatCompletions,
+			},
+			extraBody: p.config.ExtraBody,
+		})
+	}
+
+	file, err := p.client.UploadBatchFile(ctx, upload)
+	if err != nil {
+		return "", fmt.Errorf("llm: openai: failed to upload batch file: %w", err)
+	}
+	batch, err := p.client.CreateBatch(ctx, openai.CreateBatchRequest{
+		InputFileID:      file.ID,
+		Endpoint:         openai.BatchEndpointChatCompletions,
+		CompletionWindow: batchCompletionWindow,
+	})
+	if err != nil {
+		return "", fmt.Errorf("llm: openai: failed to create batch: %w", err)
+	}
+	return batch.ID, nil
+}
+
+// batchLine is a line of the batch input file, with extraBody merged into its
+// body as it is into a synchronous request.
+type batchLine struct {
+	line      openai.BatchChatCompletionRequest
+	extraBody map[string]interface{}
+}
+
+func (l batchLine) MarshalBatchLineItem() []byte {
+	data := l.line.MarshalBatchLineItem()
+	if len(l.extraBody) == 0 {
+		return data
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return data
+	}
+	body, err := withExtraBody(fields["body"], l.extraBody)
+	if err != nil {
+		return data
+	}
+	fields["body"] = body
+	merged, err := json.Marshal(fields)
+	if err != nil {
+		return data
+	}
+	return merged
+}
+
+func (p *OpenAIProvider) RetrieveBatch(ctx context.Context, id string) (BatchJob, error) {
+	batch, err := p.client.RetrieveBatch(ctx, id)
+	if err != nil {
+		return BatchJob{}, fmt.Errorf("llm: openai: failed to retrieve batch %s: %w", id, err)
+	}
+
+	job := BatchJob{
+		ID:        batch.ID,
+		Status:    batch.Status,
+		Total:     batch.RequestCounts.Total,
+		Completed: batch.RequestCounts.Completed,
+		Failed:    batch.RequestCounts.Failed,
+	}
+	if batch.OutputFileID != nil {
+		job.OutputFileID = *batch.OutputFileID
+	}
+	if batch.ErrorFileID != nil {
+		job.ErrorFileID = *batch.ErrorFileID
+	}
+	return job, nil
+}
+
+// batchOutputLine is a line of a batch's output or error file.
+type batchOutputLine struct {
+	CustomID string `json:"custom_id"`
+	Response *struct {
+		StatusCode int             `json:"status_code"`
+		Body       json.RawMessage `json:"body"`
+	} `json:"response"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+func (p *OpenAIProvider) BatchResults(ctx context.Context, job BatchJob) ([]BatchResult, error) {
+	var results []BatchResult
+	for _, fileID := range []string{job.OutputFileID, job.ErrorFileID} {
+		if fileID == "" {
+			continue
+		}
+		content, err := p.client.GetFileContent(ctx, fileID)
+		if err != nil {
+			return nil, fmt.Errorf("llm: openai: failed to download batch file %s: %w", fileID, err)
+		}
+		fileResults, err := parseBatchOutput(content)
+		content.Close()
+		if err != nil {
+			return nil, fmt.Errorf("llm: openai: batch file %s: %w", fileID, err)
+		}
+		results = append(results, fileResults...)
+	}
+
+	// a batch has no first request to detect the mode with: it is configured
+	if p.outputMode() != StructuredOutputJSONSchema {
+		for _, result := range results {
+			if result.Response != nil {
+				result.Response.SchemaUnenforced = true
+			}
+		}
+	}
+	return results, nil
+}
+
+func parseBatchOutput(content openai.RawResponse) ([]BatchResult, error) {
+	var results []BatchResult
+	scanner := bufio.NewScanner(content)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+
+		var out batchOutputLine
+		if err := json.Unmarshal(line, &out); err != nil {
+			return nil, fmt.Errorf("invalid line: %w", err)
+		}
+		results = append(results, batchResult(out))
+	}
+	return results, scanner.Err()
+}
+
+func batchResult(out batchOutputLine) BatchResult {
+	result := BatchResult{ID: out.CustomID}
+	switch {
+	case out.Error != nil:
+		result.Err = fmt.Errorf("llm: openai: batch request failed: %s: %s", out.Error.Code, out.Error.Message)
+	case out.Response == nil:
+		result.Err = fmt.Errorf("llm: openai: batch request has no response")
+	case out.Response.StatusCode != http.StatusOK:
+		result.Err = fmt.Errorf("llm: openai: batch request failed: %w",
+			&retry.HTTPError{StatusCode: out.Response.StatusCode, Message: string(out.Response.Body)})
+	default:
+		var resp openai.ChatCompletionResponse
+		if err := json.Unmarshal(out.Response.Body, &resp); err != nil {
+			result.Err = fmt.Errorf("llm: openai: invalid batch response: %w", err)
+		} else if len(resp.Choices) == 0 {
+			result.Err = fmt.Errorf("llm: openai: received no choices in batch response")
+		} else {
+			result.Response = &GenerateResponse{
+				Text:      resp.Choices[0].Message.Content,
+				Reasoning: resp.Choices[0].Message.ReasoningContent,
+				Usage: Usage{
+					PromptTokens:     resp.Usage.PromptTokens,
+					CompletionTokens: resp.Usage.CompletionTokens,
+				},
+			}
+		}
+	}
+	return result
+}
@@ -0,0 +1,74 @@
+package llm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAIBatch_SubmitPollAndDownload(t *testing.T) {
+	srv := llmtest.NewBatchServer(t, "first", "second")
+	srv.PendingPolls = 1
+	srv.PromptTokens, srv.CompletionTokens = 10, 5
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "gpt-4o-mini",
+		ExtraBody: map[string]interface{}{"service_tier": "flex"}})
+
+	id, err := provider.SubmitBatch(context.Background(), []BatchItem{
+		{ID: "row-0", Request: GenerateRequest{UserMessage: "a"}},
+		{ID: "row-1", Request: GenerateRequest{UserMessage: "b", SystemMessage: "be brief"}},
+	})
+	require.NoError(t, err)
+
+	job, err := provider.RetrieveBatch(context.Background(), id)
+	require.NoError(t, err)
+	assert.False(t, job.Done())
+
+	job, err = provider.RetrieveBatch(context.Background(), id)
+	require.NoError(t, err)
+	require.True(t, job.Done())
+	assert.Equal(t, 2, job.Total)
+
+	results, err := provider.BatchResults(context.Background(), job)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+	assert.Equal(t, "row-0", results[0].ID)
+	assert.Equal(t, "first", results[0].Response.Text)
+	assert.Equal(t, Usage{PromptTokens: 10, CompletionTokens: 5}, results[0].Response.Usage)
+	assert.Equal(t, "second", results[1].Response.Text)
+
+	lines := srv.Batches()[0]
+	assert.Equal(t, "gpt-4o-mini", lines[0]["model"])
+	assert.Len(t, lines[1]["messages"], 2, "the line body is the synchronous request")
+	assert.Equal(t, "flex", lines[0]["service_tier"], "extraBody included")
+}
+
+func TestOpenAIBatch_FailedLineIsAnHTTPError(t *testing.T) {
+	srv := llmtest.NewBatchServer(t, "ok")
+	srv.FailFirst = 1
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+
+	id, err := provider.SubmitBatch(context.Background(), []BatchItem{
+		{ID: "row-0", Request: GenerateRequest{UserMessage: "a"}},
+		{ID: "row-1", Request: GenerateRequest{UserMessage: "b"}},
+	})
+	require.NoError(t, err)
+	job, err := provider.RetrieveBatch(context.Background(), id)
+	require.NoError(t, err)
+
+	results, err := provider.BatchResults(context.Background(), job)
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	byID := map[string]BatchResult{}
+	for _, r := range results {
+		byID[r.ID] = r
+	}
+	var httpErr *retry.HTTPError
+	require.ErrorAs(t, byID["row-0"].Err, &httpErr)
+	assert.Equal(t, 500, httpErr.StatusCode)
+	assert.Equal(t, "ok", byID["row-1"].Response.Text)
+}
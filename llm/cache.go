@@ -0,0 +1,275 @@
+package llm
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// cacheFormat is part of every key; bump it when an entry's meaning changes so
+// old entries simply stop matching.
+const cacheFormat = "v1"
+
+// CacheStats counts how a step's requests were answered.
+type CacheStats struct {
+	Step   string
+	Hits   int
+	Misses int
+}
+
+// ResponseCache stores successful responses on disk, one file per request, so
+// that rerunning a workflow with unchanged prompts costs nothing. Providers are
+// wrapped per step (see Wrap).
+//
+// A key covers everything that shapes the response: the provider settings
+// (type, base URL, model, sampling parameters; never the API key or timeout),
+// the messages, the schema, the attached image, the row the request is for,
+// and how many times the row already made the same request in this run. The
+// row keeps `count: 100` rows of one identical prompt distinct instead of
+// collapsing them into one cached answer, and gives each row its own answer
+// back on a rerun, whatever order rows finish in. The occurrence gives a
+// retry after an invalid response a fresh key rather than the same bad entry;
+// a row's requests are made one after another, so it is stable too.
+type ResponseCache struct {
+	dir string
+
+	mu    sync.Mutex
+	steps map[string]*CacheStats
+	order []string
+}
+
+func NewResponseCache(dir string) *ResponseCache {
+	return &ResponseCache{dir: dir, steps: map[string]*CacheStats{}}
+}
+
+func (c *ResponseCache) Dir() string {
+	return c.dir
+}
+
+// Wrap returns a provider that answers from the cache where it can and stores
+// what the wrapped provider returns. config is the step's provider config,
+// from which the settings part of every key is taken.
+func (c *ResponseCache) Wrap(provider Provider, step string, config ProviderConfig) Provider {
+	c.mu.Lock()
+	if _, ok := c.steps[step]; !ok {
+		c.steps[step] = &CacheStats{Step: step}
+		c.order = append(c.order, step)
+	}
+	c.mu.Unlock()
+
+	return &cachedProvider{cache: c, next: provider, step: step, config: config, seen: map[string]int{}}
+}
+
+// Stats returns per-step hit and miss counts in the order steps were wrapped.
+func (c *ResponseCache) Stats() []CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := make([]CacheStats, 0, len(c.order))
+	for _, name := range c.order {
+		stats = append(stats, *c.steps[name])
+	}
+	return stats
+}
+
+// Prune removes entries that were last used before now-olderThan and returns
+// how many were removed. A missing cache folder is an empty cache.
+func (c *ResponseCache) Prune(olderThan time.Duration) (int, error) {
+	cutoff := time.Now().Add(-olderThan)
+	removed := 0
+
+	err := filepath.WalkDir(c.dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) && path == c.dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() || !strings.HasSuffix(path, ".json") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		if info.ModTime().Before(cutoff) {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			removed++
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to prune cache '%s': %w", c.dir, err)
+	}
+	return removed, nil
+}
+
+func (c *ResponseCache) record(step string, hit bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if hit {
+		c.steps[step].Hits++
+	} else {
+		c.steps[step].Misses++
+	}
+}
+
+// cacheEntry is the stored form of a response.
+type cacheEntry struct {
+	Model     string `json:"model"`
+	Text      string `json:"text"`
+	Reasoning string `json:"reasoning,omitempty"`
+	// SchemaUnenforced, see GenerateResponse.
+	SchemaUnenforced bool `json:"schemaUnenforced,omitempty"`
+}
+
+func (c *ResponseCache) path(key string) string {
+	return filepath.Join(c.dir, key[:2], key+".json")
+}
+
+// load returns the entry for key, or nil on a miss. An entry that can't be
+// read or decoded is a miss too: the request is simply made again. A hit
+// refreshes the entry's modification time, which is what prune goes by.
+func (c *ResponseCache) load(key string) *cacheEntry {
+	path := c.path(key)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	var entry cacheEntry
+	if json.Unmarshal(data, &entry) != nil {
+		return nil
+	}
+
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return &entry
+}
+
+// store writes an entry through a temporary file, so concurrent readers and
+// an interrupted run never see half of one.
+func (c *ResponseCache) store(key string, entry cacheEntry) error {
+	path := c.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to create cache folder: %w", err)
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode cache entry: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".entry-*")
+	if err != nil {
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("failed to write cache entry: %w", err)
+	}
+	return nil
+}
+
+type cachedProvider struct {
+	cache  *ResponseCache
+	next   Provider
+	step   string
+	config ProviderConfig
+
+	mu   sync.Mutex
+	seen map[string]int // request hash, row included -> times requested so far
+}
+
+// Generate answers from the cache, or asks the wrapped provider and stores a
+// successful answer. Cached answers report no usage: they cost nothing, so they
+// count neither towards the run's usage nor its budget. Failing to store an
+// entry only loses the entry, never the response.
+func (p *cachedProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	key, err := p.key(request)
+	if err != nil {
+		return nil, err
+	}
+
+	if entry := p.cache.load(key); entry != nil {
+		p.cache.record(p.step, true)
+		return &GenerateResponse{Text: entry.Text, Reasoning: entry.Reasoning, SchemaUnenforced: entry.SchemaUnenforced}, nil
+	}
+	p.cache.record(p.step, false)
+
+	resp, err := p.next.Generate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+	if err := p.cache.store(key, cacheEntry{Model: p.config.ModelName, Text: resp.Text, Reasoning: resp.Reasoning, SchemaUnenforced: resp.SchemaUnenforced}); err != nil {
+		log.Warn().Err(err).Msgf("step '%s': response not cached", p.step)
+	}
+	return resp, nil
+}
+
+// key hashes the request and its row together with the step's provider
+// settings and the request's occurrence number within the row.
+func (p *cachedProvider) key(request GenerateRequest) (string, error) {
+	image := ""
+	if request.Base64Image != "" {
+		sum := sha256.Sum256([]byte(request.Base64Image))
+		image = hex.EncodeToString(sum[:])
+	}
+	schema := ""
+	if request.IsJSON {
+		schema = request.JSONSchema.ToJSONString()
+	}
+
+	data, err := json.Marshal(struct {
+		Format   string
+		Settings map[string]interface{}
+		System   string
+		User     string
+		IsJSON   bool
+		Schema   string
+		Image    string
+		// omitted when empty: a request without history is keyed by its
+		// system and user message alone
+		Messages  []Message `json:",omitempty"`
+		Followups []Message `json:",omitempty"`
+		Row       int
+	}{cacheFormat, canonicalSettings(p.config), request.SystemMessage, request.UserMessage, request.IsJSON, schema, image,
+		request.Messages, request.Followups, request.Row})
+	if err != nil {
+		return "", fmt.Errorf("failed to build cache key: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	requestHash := hex.EncodeToString(sum[:])
+
+	p.mu.Lock()
+	occurrence := p.seen[requestHash]
+	p.seen[requestHash]++
+	p.mu.Unlock()
+
+	sum = sha256.Sum256(fmt.Appendf(nil, "%s/%d", requestHash, occurrence))
+	return hex.EncodeToString(sum[:]), nil
+}
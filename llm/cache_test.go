@@ -0,0 +1,138 @@
+package llm
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func cachedTestProvider(cache *ResponseCache, url string, temperature float64) Provider {
+	config := ProviderConfig{ProviderType: ProviderOllama, BaseURL: url, ModelName: "m", Temperature: &temperature}
+	return cache.Wrap(NewOpenAIProvider(config), "gen", config)
+}
+
+func TestResponseCache_ServesRepeatedRunsFromDisk(t *testing.T) {
+	srv := llmtest.NewServer(t, "fresh")
+	srv.PromptTokens, srv.CompletionTokens = 10, 5
+	dir := t.TempDir()
+
+	first := cachedTestProvider(NewResponseCache(dir), srv.URL, 0.7)
+	resp, err := first.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+	assert.Equal(t, "fresh", resp.Text)
+	assert.Equal(t, 15, resp.Usage.Total())
+
+	// a new run (new cache, same folder) makes the same request
+	cache := NewResponseCache(dir)
+	second := cachedTestProvider(cache, srv.URL, 0.7)
+	resp, err = second.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+	assert.Equal(t, "fresh", resp.Text)
+	assert.Zero(t, resp.Usage.Total(), "a cached response costs nothing")
+	assert.Equal(t, 1, srv.CallCount())
+	assert.Equal(t, []CacheStats{{Step: "gen", Hits: 1}}, cache.Stats())
+}
+
+func TestResponseCache_RowsGetTheirOwnAnswersInAnyOrder(t *testing.T) {
+	srv := llmtest.NewServer(t, "first", "second")
+	cache := NewResponseCache(t.TempDir())
+	ctx := context.Background()
+
+	provider := cachedTestProvider(cache, srv.URL, 0.7)
+	for row := range 2 {
+		_, err := provider.Generate(ctx, GenerateRequest{UserMessage: "title", Row: row})
+		require.NoError(t, err)
+	}
+
+	// rows of a concurrent rerun finish in another order
+	rerun := cachedTestProvider(cache, srv.URL, 0.7)
+	resp, err := rerun.Generate(ctx, GenerateRequest{UserMessage: "title", Row: 1})
+	require.NoError(t, err)
+	assert.Equal(t, "second", resp.Text)
+	resp, err = rerun.Generate(ctx, GenerateRequest{UserMessage: "title", Row: 0})
+	require.NoError(t, err)
+	assert.Equal(t, "first", resp.Text)
+	assert.Equal(t, 2, srv.CallCount())
+}
+
+func TestResponseCache_KeysOnSettingsAndOccurrence(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	cache := NewResponseCache(t.TempDir())
+	ctx := context.Background()
+
+	provider := cachedTestProvider(cache, srv.URL, 0.7)
+	for row := range 2 {
+		_, err := provider.Generate(ctx, GenerateRequest{UserMessage: "title", Row: row})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 2, srv.CallCount(), "identical rows of one run are distinct entries")
+
+	rerun := cachedTestProvider(cache, srv.URL, 0.7)
+	for _, row := range []int{1, 0, 0} {
+		_, err := rerun.Generate(ctx, GenerateRequest{UserMessage: "title", Row: row})
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 3, srv.CallCount(), "the rerun reuses both entries in any row order, and a retry of a row asks again")
+
+	hotter := cachedTestProvider(cache, srv.URL, 1.2)
+	_, err := hotter.Generate(ctx, GenerateRequest{UserMessage: "title"})
+	require.NoError(t, err)
+	assert.Equal(t, 4, srv.CallCount(), "another temperature is another request")
+
+	_, err = hotter.Generate(ctx, GenerateRequest{UserMessage: "title", SystemMessage: "be brief"})
+	require.NoError(t, err)
+	assert.Equal(t, 5, srv.CallCount(), "another system message is another request")
+
+	_, err = hotter.Generate(ctx, GenerateRequest{UserMessage: "title", SystemMessage: "be brief",
+		Followups: []Message{{Role: RoleAssistant, Content: "{}"}, {Role: RoleUser, Content: "fix it"}}})
+	require.NoError(t, err)
+	assert.Equal(t, 6, srv.CallCount(), "a follow-up turn is another request")
+}
+
+func TestResponseCache_DoesNotStoreFailures(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	srv.FailFirst = 1
+	cache := NewResponseCache(t.TempDir())
+
+	_, err := cachedTestProvider(cache, srv.URL, 0).Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.Error(t, err)
+
+	resp, err := cachedTestProvider(cache, srv.URL, 0).Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+	assert.Equal(t, "ok", resp.Text)
+	assert.Equal(t, 2, srv.CallCount())
+}
+
+func TestResponseCache_PruneRemovesUnusedEntries(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	dir := t.TempDir()
+	cache := NewResponseCache(dir)
+
+	provider := cachedTestProvider(cache, srv.URL, 0)
+	for _, prompt := range []string{"old", "new"} {
+		_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: prompt})
+		require.NoError(t, err)
+	}
+
+	entries, err := filepath.Glob(filepath.Join(dir, "*", "*.json"))
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	old := time.Now().Add(-48 * time.Hour)
+	require.NoError(t, os.Chtimes(entries[0], old, old))
+
+	removed, err := cache.Prune(24 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	assert.NoFileExists(t, entries[0])
+	assert.FileExists(t, entries[1])
+
+	removed, err = NewResponseCache(filepath.Join(dir, "missing")).Prune(time.Hour)
+	require.NoError(t, err, "a cache that was never written is empty")
+	assert.Zero(t, removed)
+}
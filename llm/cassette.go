@@ -0,0 +1,365 @@
+package llm
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ErrNotRecorded is returned in replay mode for a request the cassette has no
+// response for. Like a budget stop it fails the step, never just the row.
+var ErrNotRecorded = errors.New("request not recorded")
+
+// CassetteRequest is a request as a cassette stores it: the step's provider
+// settings and everything the request carries, with the image reduced to its
+// hash.
+type CassetteRequest struct {
+	Settings map[string]interface{} `json:"settings"`
+	System   string                 `json:"system,omitempty"`
+	User     string                 `json:"user"`
+	Schema   string                 `json:"schema,omitempty"`
+	Image    string                 `json:"image,omitempty"`
+	// Messages and Followups are the turns before and after the user
+	// message, see GenerateRequest.
+	Messages  []Message `json:"messages,omitempty"`
+	Followups []Message `json:"followups,omitempty"`
+}
+
+// CassetteEntry is one line of a cassette file.
+type CassetteEntry struct {
+	Step     string          `json:"step"`
+	Request  CassetteRequest `json:"request"`
+	Response struct {
+		Text             string `json:"text"`
+		Reasoning        string `json:"reasoning,omitempty"`
+		Usage            Usage  `json:"usage"`
+		SchemaUnenforced bool   `json:"schemaUnenforced,omitempty"`
+	} `json:"response"`
+}
+
+func newCassetteRequest(config ProviderConfig, request GenerateRequest) CassetteRequest {
+	r := CassetteRequest{
+		Settings:  canonicalSettings(config),
+		System:    request.SystemMessage,
+		User:      request.UserMessage,
+		Messages:  request.Messages,
+		Followups: request.Followups,
+	}
+	if request.IsJSON {
+		r.Schema = request.JSONSchema.ToJSONString()
+	}
+	if request.Base64Image != "" {
+		sum := sha256.Sum256([]byte(request.Base64Image))
+		r.Image = hex.EncodeToString(sum[:])
+	}
+	return r
+}
+
+// text renders the request one field per line. It is both the matching key
+// and what a mismatch diff is made of.
+func (r CassetteRequest) text() string {
+	settings, _ := json.Marshal(r.Settings) // map keys are sorted
+	lines := []string{"settings: " + string(settings)}
+	if r.System != "" {
+		lines = append(lines, "system: "+r.System)
+	}
+	for _, message := range r.Messages {
+		lines = append(lines, message.Role+": "+message.Content)
+	}
+	lines = append(lines, "user: "+r.User)
+	if r.Schema != "" {
+		lines = append(lines, "schema: "+r.Schema)
+	}
+	if r.Image != "" {
+		lines = append(lines, "image: "+r.Image)
+	}
+	for _, followup := range r.Followups {
+		lines = append(lines, followup.Role+": "+followup.Content)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// canonicalSettings is the part of a provider config that shapes a response:
+// no API key or timeout, no endpoints (replicas of one model answer alike),
+// header values only as hashes since they may carry credentials, and no unset
+// fields, since an unset field adds nothing to the request. Numbers are kept
+// even when zero: optional ones are pointers, and a temperature of 0 is not the
+// same request as no temperature.
+func canonicalSettings(config ProviderConfig) map[string]interface{} {
+	config.AuthToken = ""
+	config.APIKeyEnv = ""
+	config.HTTPTimeout = 0
+	config.Endpoints = nil
+	if len(config.Headers) > 0 {
+		headers := make(map[string]string, len(config.Headers))
+		for name, value := range config.Headers {
+			sum := sha256.Sum256([]byte(value))
+			headers[name] = "sha256:" + hex.EncodeToString(sum[:8])
+		}
+		config.Headers = headers
+	}
+
+	data, _ := json.Marshal(config)
+	var settings map[string]interface{}
+	_ = json.Unmarshal(data, &settings)
+
+	for name, value := range settings {
+		switch v := value.(type) {
+		case nil:
+			delete(settings, name)
+		case string:
+			if v == "" {
+				delete(settings, name)
+			}
+		case bool:
+			if !v {
+				delete(settings, name)
+			}
+		case []interface{}:
+			if len(v) == 0 {
+				delete(settings, name)
+			}
+		case map[string]interface{}:
+			if len(v) == 0 {
+				delete(settings, name)
+			}
+		}
+	}
+	return settings
+}
+
+// Recorder writes every response the wrapped providers return to a cassette
+// file, for later replay (see Cassette). Providers are wrapped per step.
+type Recorder struct {
+	mu      sync.Mutex
+	file    *os.File
+	entries int
+}
+
+// NewRecorder creates (or truncates) the cassette file at path.
+func NewRecorder(path string) (*Recorder, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cassette: %w", err)
+	}
+	return &Recorder{file: file}, nil
+}
+
+func (r *Recorder) Wrap(provider Provider, step string, config ProviderConfig) Provider {
+	return &recordingProvider{recorder: r, next: provider, step: step, config: config}
+}
+
+// Entries returns how many responses were recorded so far.
+func (r *Recorder) Entries() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.entries
+}
+
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
+
+func (r *Recorder) write(entry CassetteEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode cassette entry: %w", err)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, err := r.file.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write cassette: %w", err)
+	}
+	r.entries++
+	return nil
+}
+
+type recordingProvider struct {
+	recorder *Recorder
+	next     Provider
+	step     string
+	config   ProviderConfig
+}
+
+// Generate records successful responses only: a replay never needs the
+// failures, because the retry that followed them is recorded too. A cassette
+// that can't be written fails the request, since a recording with holes would
+// only fail later, in replay.
+func (p *recordingProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	resp, err := p.next.Generate(ctx, request)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := CassetteEntry{Step: p.step, Request: newCassetteRequest(p.config, request)}
+	entry.Response.Text = resp.Text
+	entry.Response.Reasoning = resp.Reasoning
+	entry.Response.Usage = resp.Usage
+	entry.Response.SchemaUnenforced = resp.SchemaUnenforced
+	if err := p.recorder.write(entry); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// Cassette serves recorded responses back in place of a real provider. Each
+// recorded response is served once, in recording order among identical
+// requests, so a step asking the same thing twice gets both answers.
+type Cassette struct {
+	mu      sync.Mutex
+	entries []CassetteEntry
+	queues  map[string][]int // request text -> unserved entry indexes
+	counts  map[string]int   // request text -> times recorded
+}
+
+// LoadCassette reads a cassette file written by a Recorder.
+func LoadCassette(path string) (*Cassette, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open cassette: %w", err)
+	}
+	defer file.Close()
+
+	c := &Cassette{queues: map[string][]int{}, counts: map[string]int{}}
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var entry CassetteEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("cassette line %d: %w", n, err)
+		}
+		key := entry.Request.text()
+		c.queues[key] = append(c.queues[key], len(c.entries))
+		c.counts[key]++
+		c.entries = append(c.entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read cassette: %w", err)
+	}
+	return c, nil
+}
+
+// Len returns how many responses the cassette holds.
+func (c *Cassette) Len() int {
+	return len(c.entries)
+}
+
+// Provider returns the replaying provider for one step. It needs no API key
+// and makes no network calls.
+func (c *Cassette) Provider(step string, config ProviderConfig) Provider {
+	return &replayProvider{cassette: c, step: step, config: config}
+}
+
+func (c *Cassette) next(key string) (*CassetteEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	queue := c.queues[key]
+	if len(queue) == 0 {
+		return nil, false
+	}
+	c.queues[key] = queue[1:]
+	return &c.entries[queue[0]], true
+}
+
+// mismatch explains a request that has no response left: either it was
+// recorded fewer times than it is now made, or it differs from everything
+// recorded, in which case the closest recorded request (preferring the same
+// step) is shown as a diff.
+func (c *Cassette) mismatch(step, key string) error {
+	if n := c.counts[key]; n > 0 {
+		return fmt.Errorf("%w: step '%s' made a request more often than the %d time(s) it was recorded:\n%s",
+			ErrNotRecorded, step, n, key)
+	}
+	if len(c.entries) == 0 {
+		return fmt.Errorf("%w: step '%s' made a request and the cassette is empty", ErrNotRecorded, step)
+	}
+
+	wanted := strings.Split(key, "\n")
+	best, bestScore := -1, 0
+	for i, entry := range c.entries {
+		score := len(diffLines(strings.Split(entry.Request.text(), "\n"), wanted))
+		if entry.Step != step {
+			score++ // on a tie, the same step's request is the better guess
+		}
+		if best < 0 || score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+
+	closest := c.entries[best]
+	diff := diffLines(strings.Split(closest.Request.text(), "\n"), wanted)
+	return fmt.Errorf("%w: step '%s' made a request the cassette doesn't have; diff against the closest recorded request (step '%s', - recorded, + requested):\n%s",
+		ErrNotRecorded, step, closest.Step, strings.Join(diff, "\n"))
+}
+
+// diffLines is a minimal line diff of a against b. Only changed lines are
+// returned, prefixed "- " (only in a) or "+ " (only in b).
+func diffLines(a, b []string) []string {
+	// lcs[i][j] is the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	var diff []string
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			diff = append(diff, "- "+a[i])
+			i++
+		default:
+			diff = append(diff, "+ "+b[j])
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		diff = append(diff, "- "+a[i])
+	}
+	for ; j < len(b); j++ {
+		diff = append(diff, "+ "+b[j])
+	}
+	return diff
+}
+
+type replayProvider struct {
+	cassette *Cassette
+	step     string
+	config   ProviderConfig
+}
+
+func (p *replayProvider) Generate(_ context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	key := newCassetteRequest(p.config, request).text()
+	entry, ok := p.cassette.next(key)
+	if !ok {
+		return nil, p.cassette.mismatch(p.step, key)
+	}
+	return &GenerateResponse{Text: entry.Response.Text, Reasoning: entry.Response.Reasoning, Usage: entry.Response.Usage,
+		SchemaUnenforced: entry.Response.SchemaUnenforced}, nil
+}
@@ -0,0 +1,78 @@
+package llm
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCassette_ReplaysWhatWasRecorded(t *testing.T) {
+	srv := llmtest.NewServer(t, "first", "second", "other")
+	srv.PromptTokens, srv.CompletionTokens = 7, 3
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	config := ProviderConfig{ProviderType: ProviderOpenAI, BaseURL: srv.URL, ModelName: "m", AuthToken: "secret"}
+
+	recorder, err := NewRecorder(path)
+	require.NoError(t, err)
+	provider := recorder.Wrap(NewOpenAIProvider(config), "gen", config)
+	for _, prompt := range []string{"same", "same", "different"} {
+		_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: prompt})
+		require.NoError(t, err)
+	}
+	require.NoError(t, recorder.Close())
+	assert.Equal(t, 3, recorder.Entries())
+
+	cassette, err := LoadCassette(path)
+	require.NoError(t, err)
+	config.AuthToken = "" // replay needs no key
+	replay := cassette.Provider("gen", config)
+
+	resp, err := replay.Generate(context.Background(), GenerateRequest{UserMessage: "different"})
+	require.NoError(t, err)
+	assert.Equal(t, "other", resp.Text)
+	assert.Equal(t, 10, resp.Usage.Total())
+	for _, want := range []string{"first", "second"} {
+		resp, err := replay.Generate(context.Background(), GenerateRequest{UserMessage: "same"})
+		require.NoError(t, err)
+		assert.Equal(t, want, resp.Text, "identical requests replay in recording order")
+	}
+	assert.Equal(t, 3, srv.CallCount(), "replay calls no model")
+
+	_, err = replay.Generate(context.Background(), GenerateRequest{UserMessage: "same"})
+	require.ErrorIs(t, err, ErrNotRecorded)
+	assert.Contains(t, err.Error(), "more often than the 2 time(s) it was recorded")
+}
+
+func TestCassette_UnrecordedRequestShowsDiff(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	path := filepath.Join(t.TempDir(), "cassette.jsonl")
+	config := ProviderConfig{ProviderType: ProviderOllama, BaseURL: srv.URL, ModelName: "m"}
+
+	recorder, err := NewRecorder(path)
+	require.NoError(t, err)
+	provider := recorder.Wrap(NewOpenAIProvider(config), "gen", config)
+	_, err = provider.Generate(context.Background(), GenerateRequest{SystemMessage: "be brief", UserMessage: "Describe Go.\nOne sentence."})
+	require.NoError(t, err)
+	_, err = provider.Generate(context.Background(), GenerateRequest{UserMessage: "unrelated"})
+	require.NoError(t, err)
+	require.NoError(t, recorder.Close())
+
+	cassette, err := LoadCassette(path)
+	require.NoError(t, err)
+	_, err = cassette.Provider("gen", config).Generate(context.Background(),
+		GenerateRequest{SystemMessage: "be brief", UserMessage: "Describe Rust.\nOne sentence."})
+
+	require.ErrorIs(t, err, ErrNotRecorded)
+	assert.Contains(t, err.Error(), "- user: Describe Go.\n+ user: Describe Rust.")
+	assert.NotContains(t, err.Error(), "One sentence", "unchanged lines are left out")
+	assert.NotContains(t, err.Error(), "unrelated", "the closest request is the one diffed")
+}
+
+func TestDiffLines(t *testing.T) {
+	assert.Empty(t, diffLines([]string{"a", "b"}, []string{"a", "b"}))
+	assert.Equal(t, []string{"- b", "+ x", "+ d"}, diffLines([]string{"a", "b", "c"}, []string{"a", "x", "c", "d"}))
+}
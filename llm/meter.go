@@ -0,0 +1,183 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ErrBudgetExceeded is returned instead of sending a request that could take
+// the run past its budget. It is never retried and never skipped.
+var ErrBudgetExceeded = errors.New("budget exceeded")
+
+// Budget caps a whole run; zero fields are unlimited.
+type Budget struct {
+	MaxTokens int     `yaml:"maxTokens"`
+	MaxCost   float64 `yaml:"maxCost"`
+}
+
+// StepUsage is the usage a step accumulated over the run.
+type StepUsage struct {
+	Step     string
+	Requests int
+	Usage    Usage
+	Cost     float64
+	Priced   bool // false when the step's model has no entry in the price table
+}
+
+// Meter tracks token usage and cost across a run, per step, and enforces the
+// budget. Providers are wrapped per step (see Wrap); every request reserves
+// its estimated cost first, so concurrent rows can't jointly overshoot, and
+// settles to the reported usage once it returns.
+type Meter struct {
+	budget Budget
+	prices map[string]Price
+
+	mu       sync.Mutex
+	steps    map[string]*StepUsage
+	order    []string
+	spent    Usage
+	cost     float64
+	reserved Usage
+	resCost  float64
+}
+
+func NewMeter(budget Budget, prices map[string]Price) *Meter {
+	return &Meter{budget: budget, prices: prices, steps: map[string]*StepUsage{}}
+}
+
+// Wrap returns a provider that meters every request a step makes. maxTokens is
+// the step's completion limit, if any, and part of each reservation.
+func (m *Meter) Wrap(provider Provider, step string, providerType ProviderType, model string, maxTokens *int) Provider {
+	price := m.register(step, providerType, model)
+	return &meteredProvider{meter: m, next: provider, step: step, price: price, maxTokens: maxTokens}
+}
+
+// batchDiscount is what a batch request costs relative to the price table:
+// the Batch API bills at half price.
+const batchDiscount = 0.5
+
+// ReserveBatch books a whole batch against the budget before it is
+// submitted, since its requests are all sent at once. The returned settle
+// records what the batch really used once its results are in, priced at the
+// batch discount.
+func (m *Meter) ReserveBatch(step string, providerType ProviderType, model string, maxTokens *int, requests []GenerateRequest) (settle func(used Usage, requests int), err error) {
+	price := m.register(step, providerType, model)
+
+	var estimate Usage
+	for _, request := range requests {
+		estimate.Add(requestEstimate(request, maxTokens))
+	}
+	estimateCost := price.Cost(estimate) * batchDiscount
+
+	if err := m.reserve(estimate, estimateCost); err != nil {
+		return nil, err
+	}
+	return func(used Usage, requests int) {
+		m.settle(step, estimate, estimateCost, used, price.Cost(used)*batchDiscount, requests)
+	}, nil
+}
+
+// register adds the step to the summary and returns its model's price.
+func (m *Meter) register(step string, providerType ProviderType, model string) Price {
+	price, priced := m.prices[PriceKey(providerType, model)]
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.steps[step]; !ok {
+		m.steps[step] = &StepUsage{Step: step, Priced: priced}
+		m.order = append(m.order, step)
+	}
+	return price
+}
+
+// requestEstimate is a request's prompt tokens plus the completion limit.
+func requestEstimate(request GenerateRequest, maxTokens *int) Usage {
+	estimate := Usage{PromptTokens: EstimateTokens(request)}
+	if maxTokens != nil {
+		estimate.CompletionTokens = *maxTokens
+	}
+	return estimate
+}
+
+// Summary returns per-step usage in the order steps first made a request, and
+// the run total.
+func (m *Meter) Summary() ([]StepUsage, StepUsage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	total := StepUsage{Step: "total", Usage: m.spent, Cost: m.cost, Priced: true}
+	steps := make([]StepUsage, 0, len(m.order))
+	for _, name := range m.order {
+		s := *m.steps[name]
+		total.Requests += s.Requests
+		total.Priced = total.Priced && (s.Priced || s.Requests == 0)
+		steps = append(steps, s)
+	}
+	return steps, total
+}
+
+// reserve books an estimate against the budget, failing if it doesn't fit.
+func (m *Meter) reserve(estimate Usage, cost float64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.budget.MaxTokens > 0 {
+		if used := m.spent.Total() + m.reserved.Total() + estimate.Total(); used > m.budget.MaxTokens {
+			return fmt.Errorf("%w: next request needs ~%d tokens, %d of %d already used or in flight",
+				ErrBudgetExceeded, estimate.Total(), m.spent.Total()+m.reserved.Total(), m.budget.MaxTokens)
+		}
+	}
+	if m.budget.MaxCost > 0 {
+		if used := m.cost + m.resCost + cost; used > m.budget.MaxCost {
+			return fmt.Errorf("%w: next request may cost ~$%.4f, $%.4f of $%.2f already spent or in flight",
+				ErrBudgetExceeded, cost, m.cost+m.resCost, m.budget.MaxCost)
+		}
+	}
+
+	m.reserved.Add(estimate)
+	m.resCost += cost
+	return nil
+}
+
+// settle releases a reservation and records what its requests really used.
+func (m *Meter) settle(step string, estimate Usage, estimateCost float64, used Usage, cost float64, requests int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reserved.Add(Usage{PromptTokens: -estimate.PromptTokens, CompletionTokens: -estimate.CompletionTokens})
+	m.resCost -= estimateCost
+
+	m.spent.Add(used)
+	m.cost += cost
+	s := m.steps[step]
+	s.Requests += requests
+	s.Usage.Add(used)
+	s.Cost += cost
+}
+
+type meteredProvider struct {
+	meter     *Meter
+	next      Provider
+	step      string
+	price     Price
+	maxTokens *int
+}
+
+func (p *meteredProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	estimate := requestEstimate(request, p.maxTokens)
+	estimateCost := p.price.Cost(estimate)
+
+	if err := p.meter.reserve(estimate, estimateCost); err != nil {
+		return nil, err
+	}
+
+	resp, err := p.next.Generate(ctx, request)
+	var used Usage
+	if resp != nil {
+		used = resp.Usage
+	}
+	p.meter.settle(p.step, estimate, estimateCost, used, p.price.Cost(used), 1)
+	return resp, err
+}
@@ -0,0 +1,66 @@
+package llm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMeter_AccumulatesUsageAndCost(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	srv.PromptTokens, srv.CompletionTokens = 100, 20
+
+	meter := NewMeter(Budget{}, map[string]Price{"openai:m": {Input: 1, Output: 10}})
+	provider := meter.Wrap(NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"}), "gen", ProviderOpenAI, "m", nil)
+
+	for range 2 {
+		resp, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+		require.NoError(t, err)
+		assert.Equal(t, Usage{PromptTokens: 100, CompletionTokens: 20}, resp.Usage)
+	}
+
+	steps, total := meter.Summary()
+	require.Len(t, steps, 1)
+	assert.Equal(t, 2, steps[0].Requests)
+	assert.Equal(t, 240, total.Usage.Total())
+	assert.True(t, total.Priced)
+	assert.InDelta(t, (200*1+40*10)/1e6, total.Cost, 1e-12)
+}
+
+func TestMeter_StopsBeforeExceedingBudget(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	srv.PromptTokens, srv.CompletionTokens = 60, 20
+
+	meter := NewMeter(Budget{MaxTokens: 100}, nil)
+	provider := meter.Wrap(NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"}), "gen", ProviderOllama, "m", nil)
+
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err, "80 of 100 tokens")
+
+	// ~25 more estimated prompt tokens would pass 100
+	_, err = provider.Generate(context.Background(), GenerateRequest{UserMessage: string(make([]byte, 100))})
+	require.ErrorIs(t, err, ErrBudgetExceeded)
+	assert.Equal(t, 1, srv.CallCount(), "the request over budget is never sent")
+}
+
+func TestMeter_BatchIsReservedAtOnceAndPricedAtTheDiscount(t *testing.T) {
+	meter := NewMeter(Budget{MaxCost: 1}, map[string]Price{"openai:m": {Input: 1, Output: 10}})
+	maxTokens := 100
+	requests := []GenerateRequest{{UserMessage: "hi"}, {UserMessage: "there"}}
+
+	settle, err := meter.ReserveBatch("gen", ProviderOpenAI, "m", &maxTokens, requests)
+	require.NoError(t, err)
+	settle(Usage{PromptTokens: 200, CompletionTokens: 40}, 2)
+
+	steps, total := meter.Summary()
+	require.Len(t, steps, 1)
+	assert.Equal(t, 2, steps[0].Requests)
+	assert.InDelta(t, (200*1+40*10)/1e6/2, total.Cost, 1e-12)
+
+	tight := NewMeter(Budget{MaxTokens: 150}, nil)
+	_, err = tight.ReserveBatch("gen", ProviderOpenAI, "m", &maxTokens, requests)
+	assert.ErrorIs(t, err, ErrBudgetExceeded, "two completions of up to 100 tokens don't fit")
+}
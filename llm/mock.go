@@ -0,0 +1,67 @@
+package llm
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"sync"
+)
+
+// MockProvider answers locally, without a model server: with a schema it
+// returns a schema-valid JSON value, otherwise it echoes the prompt. Answers
+// are deterministic: the value is seeded from the model name, the request and
+// its row, so `count: 10` rows of one prompt still differ and each row gets
+// the same value on every run, however many rows run at once. A row asking
+// the same again (a retry) is numbered, so it gets another value. `mock:a`
+// and `mock:b` give different data for the same step.
+type MockProvider struct {
+	config ProviderConfig
+
+	mu   sync.Mutex
+	seen map[uint64]uint64 // row's request seed -> times requested so far
+}
+
+func NewMockProvider(config ProviderConfig) *MockProvider {
+	return &MockProvider{config: config, seen: map[uint64]uint64{}}
+}
+
+func (p *MockProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	text := request.UserMessage
+	if request.IsJSON && request.JSONSchema.HasSchemaDefinition() {
+		data, err := json.Marshal(request.JSONSchema.Sample(p.seed(request)))
+		if err != nil {
+			return nil, fmt.Errorf("mock: failed to encode sample: %w", err)
+		}
+		text = string(data)
+	}
+
+	// rough counts, so usage and budgets can be exercised without a model
+	usage := Usage{PromptTokens: EstimateTokens(request), CompletionTokens: (len(text) + 3) / 4}
+	return &GenerateResponse{Text: text, Usage: usage}, nil
+}
+
+func (p *MockProvider) seed(request GenerateRequest) uint64 {
+	h := fnv.New64a()
+	parts := []string{p.config.ModelName, request.SystemMessage, request.UserMessage, request.JSONSchema.ToJSONString()}
+	for _, message := range slices.Concat(request.Messages, request.Followups) {
+		parts = append(parts, message.Role, message.Content)
+	}
+	for _, part := range parts {
+		h.Write([]byte(part))
+		h.Write([]byte{0})
+	}
+	fmt.Fprintf(h, "%d", request.Row)
+	base := h.Sum64()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	occurrence := p.seen[base]
+	p.seen[base]++
+	return base + occurrence*0x9e3779b97f4a7c15
+}
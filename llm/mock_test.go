@@ -0,0 +1,48 @@
+package llm
+
+import (
+	"context"
+	"testing"
+
+	"github.com/mirpo/datamatic/jsonschema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockProvider_EchoesThePromptWithoutSchema(t *testing.T) {
+	provider, err := NewProvider(ProviderConfig{ProviderType: ProviderMock, ModelName: "any"})
+	require.NoError(t, err, "no base URL or API key needed")
+
+	resp, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "Name a river."})
+	require.NoError(t, err)
+	assert.Equal(t, "Name a river.", resp.Text)
+	assert.Positive(t, resp.Usage.PromptTokens)
+}
+
+func TestMockProvider_ReturnsSchemaValidDeterministicJSON(t *testing.T) {
+	schema, err := jsonschema.LoadSchema(`{
+		"type": "object",
+		"properties": {"city": {"type": "string"}, "population": {"type": "integer", "minimum": 1}},
+		"required": ["city", "population"]
+	}`)
+	require.NoError(t, err)
+	generate := func(provider Provider, row int) string {
+		request := GenerateRequest{UserMessage: "A city.", IsJSON: true, JSONSchema: *schema, Row: row}
+		resp, err := provider.Generate(context.Background(), request)
+		require.NoError(t, err)
+		require.NoError(t, schema.ValidateJSONText(resp.Text))
+		return resp.Text
+	}
+
+	first := NewMockProvider(ProviderConfig{ModelName: "a"})
+	row0, row1 := generate(first, 0), generate(first, 1)
+	assert.NotEqual(t, row0, row1, "repeated rows of one prompt differ")
+	assert.NotEqual(t, row0, generate(first, 0), "a retry of a row gets another value")
+
+	again := NewMockProvider(ProviderConfig{ModelName: "a"})
+	assert.Equal(t, row1, generate(again, 1), "a new run gives each row the same data, in any order")
+	assert.Equal(t, row0, generate(again, 0))
+
+	other := NewMockProvider(ProviderConfig{ModelName: "b"})
+	assert.NotEqual(t, row0, generate(other, 0), "the model name acts as a seed")
+}
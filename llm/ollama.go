@@ -0,0 +1,243 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mirpo/datamatic/retry"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	DefaultOllamaNativeBaseURL = "http://localhost:11434"
+	// ollamaDefaultNumCtx is the context window Ollama uses when a request
+	// sets no num_ctx (older releases used 2048). It is far below what most
+	// models support, and a longer prompt is cut without an error.
+	ollamaDefaultNumCtx = 4096
+)
+
+// OllamaNativeProvider talks to Ollama's own /api/chat endpoint, which, unlike
+// the OpenAI-compatible one, takes model options (num_ctx, seed, ...),
+// keep_alive and think, and a JSON schema as `format`.
+type OllamaNativeProvider struct {
+	config ProviderConfig
+	client *http.Client
+	url    string
+
+	warnOnce sync.Once
+}
+
+func NewOllamaNativeProvider(config ProviderConfig) *OllamaNativeProvider {
+	client := &http.Client{}
+	if config.HTTPTimeout > 0 {
+		client.Timeout = time.Duration(config.HTTPTimeout) * time.Second
+	}
+
+	base := strings.TrimSuffix(strings.TrimSuffix(config.BaseURL, "/"), "/api")
+	if base == "" {
+		base = DefaultOllamaNativeBaseURL
+	}
+
+	return &OllamaNativeProvider{config: config, client: client, url: base + "/api/chat"}
+}
+
+type ollamaRequest struct {
+	Model     string                 `json:"model"`
+	Messages  []ollamaMessage        `json:"messages"`
+	Stream    bool                   `json:"stream"`
+	Format    interface{}            `json:"format,omitempty"`
+	Options   map[string]interface{} `json:"options,omitempty"`
+	KeepAlive string                 `json:"keep_alive,omitempty"`
+	Think     *bool                  `json:"think,omitempty"`
+}
+
+type ollamaMessage struct {
+	Role     string   `json:"role"`
+	Content  string   `json:"content"`
+	Thinking string   `json:"thinking,omitempty"`
+	Images   []string `json:"images,omitempty"`
+}
+
+type ollamaResponse struct {
+	Model           string        `json:"model"`
+	Message         ollamaMessage `json:"message"`
+	DoneReason      string        `json:"done_reason"`
+	PromptEvalCount int           `json:"prompt_eval_count"`
+	EvalCount       int           `json:"eval_count"`
+}
+
+// buildRequest translates a GenerateRequest into an /api/chat body. The step's
+// options are sent as given; temperature, maxTokens and the other sampling
+// settings fill in their options unless the options already set them.
+func (p *OllamaNativeProvider) buildRequest(request GenerateRequest) ollamaRequest {
+	req := ollamaRequest{
+		Model:     p.config.ModelName,
+		KeepAlive: p.config.KeepAlive,
+		Think:     p.config.Think,
+	}
+
+	options := map[string]interface{}{}
+	for name, value := range p.config.Options {
+		options[name] = value
+	}
+	if _, ok := options["temperature"]; !ok && p.config.Temperature != nil {
+		options["temperature"] = *p.config.Temperature
+	}
+	if _, ok := options["num_predict"]; !ok && p.config.MaxTokens != nil {
+		options["num_predict"] = *p.config.MaxTokens
+	}
+	sampling := map[string]interface{}{}
+	if p.config.TopP != nil {
+		sampling["top_p"] = *p.config.TopP
+	}
+	if p.config.Seed != nil {
+		sampling["seed"] = *p.config.Seed
+	}
+	if len(p.config.Stop) > 0 {
+		sampling["stop"] = p.config.Stop
+	}
+	if p.config.PresencePenalty != nil {
+		sampling["presence_penalty"] = *p.config.PresencePenalty
+	}
+	if p.config.FrequencyPenalty != nil {
+		sampling["frequency_penalty"] = *p.config.FrequencyPenalty
+	}
+	for name, value := range sampling {
+		if _, ok := options[name]; !ok {
+			options[name] = value
+		}
+	}
+	if len(options) > 0 {
+		req.Options = options
+	}
+
+	if request.SystemMessage != "" {
+		req.Messages = append(req.Messages, ollamaMessage{Role: "system", Content: request.SystemMessage})
+	}
+	for _, message := range request.Messages {
+		req.Messages = append(req.Messages, ollamaMessage{Role: message.Role, Content: message.Content})
+	}
+	user := ollamaMessage{Role: "user", Content: request.UserMessage}
+	if request.Base64Image != "" {
+		user.Images = []string{request.Base64Image}
+	}
+	req.Messages = append(req.Messages, user)
+	for _, followup := range request.Followups {
+		req.Messages = append(req.Messages, ollamaMessage{Role: followup.Role, Content: followup.Content})
+	}
+
+	if request.IsJSON {
+		req.Format = request.JSONSchema.GetSchema()
+	}
+
+	return req
+}
+
+// PreviewRequest returns the JSON body Generate would send for the request.
+func (p *OllamaNativeProvider) PreviewRequest(request GenerateRequest) ([]byte, error) {
+	return previewBody(p.encode(p.buildRequest(request)))
+}
+
+// encode returns the request body Generate sends, extraBody included.
+func (p *OllamaNativeProvider) encode(req ollamaRequest) ([]byte, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+	return withExtraBody(body, p.config.ExtraBody)
+}
+
+func (p *OllamaNativeProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	req := p.buildRequest(request)
+	body, err := p.encode(req)
+	if err != nil {
+		return nil, fmt.Errorf("llm: ollama-native: failed to encode request: %w", err)
+	}
+
+	log.Debug().Msgf("LLM request: model=%s, messages=%d, to url: %s", req.Model, len(req.Messages), p.url)
+
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("llm: ollama-native: %w", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	httpResp, err := p.client.Do(httpReq)
+	if err != nil {
+		return nil, fmt.Errorf("llm: ollama-native: chat request failed: %w", err)
+	}
+	defer httpResp.Body.Close()
+
+	data, err := io.ReadAll(httpResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("llm: ollama-native: failed to read response: %w", err)
+	}
+
+	if httpResp.StatusCode != http.StatusOK {
+		message := strings.TrimSpace(string(data))
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(data, &apiErr) == nil && apiErr.Error != "" {
+			message = apiErr.Error
+		}
+		return nil, fmt.Errorf("llm: ollama-native: chat request failed: %w",
+			&retry.HTTPError{StatusCode: httpResp.StatusCode, Message: message, RetryAfter: retry.ParseRetryAfter(httpResp.Header, time.Now())})
+	}
+
+	var resp ollamaResponse
+	if err := json.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("llm: ollama-native: invalid response: %w", err)
+	}
+
+	log.Debug().Msgf("Ollama response: model=%s, done=%s, prompt_eval_count=%d, eval_count=%d",
+		resp.Model, resp.DoneReason, resp.PromptEvalCount, resp.EvalCount)
+
+	p.checkContext(request, resp)
+
+	return &GenerateResponse{
+		Text:      resp.Message.Content,
+		Reasoning: resp.Message.Thinking,
+		Usage: Usage{
+			PromptTokens:     resp.PromptEvalCount,
+			CompletionTokens: resp.EvalCount,
+		},
+	}, nil
+}
+
+// numCtx is the context window requests are made with.
+func (p *OllamaNativeProvider) numCtx() int {
+	switch v := p.config.Options["num_ctx"].(type) {
+	case int:
+		return v
+	case float64:
+		return int(v)
+	}
+	return ollamaDefaultNumCtx
+}
+
+// checkContext warns when a request may have been cut to fit the context
+// window, which Ollama does silently: the model then answers a prompt whose
+// beginning it never saw. The evaluated prompt filling the window, or the
+// prompt being longer than the window by a rough estimate, are both signs.
+// The warning is given once per step; every affected row is logged at debug.
+func (p *OllamaNativeProvider) checkContext(request GenerateRequest, resp ollamaResponse) {
+	numCtx := p.numCtx()
+	estimate := EstimateTokens(request)
+	if resp.PromptEvalCount+resp.EvalCount < numCtx && estimate <= numCtx {
+		return
+	}
+
+	log.Debug().Msgf("ollama-native: prompt of ~%d tokens (%d evaluated) against num_ctx %d", estimate, resp.PromptEvalCount, numCtx)
+	p.warnOnce.Do(func() {
+		log.Warn().Msgf("ollama-native: model '%s' filled its context window of %d tokens, so prompts may have been truncated; "+
+			"raise it with `options: {num_ctx: ...}`", p.config.ModelName, numCtx)
+	})
+}
@@ -0,0 +1,108 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/jsonschema"
+	"github.com/mirpo/datamatic/retry"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOllamaNative_SendsSchemaAsFormatAndOptions(t *testing.T) {
+	srv := llmtest.NewOllamaServer(t, `{"city":"Oslo"}`)
+	srv.PromptEvalCount, srv.EvalCount = 20, 5
+	schema, err := jsonschema.LoadSchema(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`)
+	require.NoError(t, err)
+	temperature, maxTokens, think := 0.2, 64, false
+
+	provider := NewOllamaNativeProvider(ProviderConfig{
+		BaseURL: srv.URL, ModelName: "qwen3", Temperature: &temperature, MaxTokens: &maxTokens,
+		Options:   map[string]interface{}{"num_ctx": 16384, "seed": 7},
+		KeepAlive: "10m", Think: &think,
+	})
+	resp, err := provider.Generate(context.Background(), GenerateRequest{
+		SystemMessage: "Be brief.", UserMessage: "A city", Base64Image: "aW1n", IsJSON: true, JSONSchema: *schema,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, `{"city":"Oslo"}`, resp.Text)
+	assert.Equal(t, Usage{PromptTokens: 20, CompletionTokens: 5}, resp.Usage)
+
+	req := srv.Requests()[0]
+	assert.Equal(t, false, req["stream"])
+	assert.Equal(t, "object", req["format"].(map[string]interface{})["type"])
+	assert.Equal(t, map[string]interface{}{"num_ctx": 16384.0, "seed": 7.0, "temperature": 0.2, "num_predict": 64.0}, req["options"])
+	assert.Equal(t, "10m", req["keep_alive"])
+	assert.Equal(t, false, req["think"])
+
+	messages := req["messages"].([]interface{})
+	require.Len(t, messages, 2)
+	assert.Equal(t, map[string]interface{}{"role": "system", "content": "Be brief."}, messages[0])
+	assert.Equal(t, []interface{}{"aW1n"}, messages[1].(map[string]interface{})["images"])
+}
+
+func TestOllamaNative_OptionsWinOverStepSettings(t *testing.T) {
+	temperature := 0.9
+	provider := NewOllamaNativeProvider(ProviderConfig{ModelName: "m", Temperature: &temperature,
+		Options: map[string]interface{}{"temperature": 0.1}})
+
+	req := provider.buildRequest(GenerateRequest{UserMessage: "hi"})
+	assert.Equal(t, 0.1, req.Options["temperature"])
+	assert.Nil(t, req.Format, "no schema, no format")
+	assert.Equal(t, "http://localhost:11434/api/chat", provider.url)
+}
+
+func TestOllamaNative_SamplingSettingsBecomeOptions(t *testing.T) {
+	topP, seed, presence := 0.8, 3, 0.0
+	provider := NewOllamaNativeProvider(ProviderConfig{ModelName: "m", TopP: &topP, Seed: &seed, Stop: []string{"END"},
+		PresencePenalty: &presence, Options: map[string]interface{}{"seed": 7}})
+
+	req := provider.buildRequest(GenerateRequest{UserMessage: "hi"})
+	assert.Equal(t, map[string]interface{}{"top_p": 0.8, "seed": 7, "stop": []string{"END"}, "presence_penalty": 0.0}, req.Options)
+}
+
+func TestOllamaNative_WarnsOnceWhenTheContextIsFull(t *testing.T) {
+	srv := llmtest.NewOllamaServer(t, "ok")
+	srv.PromptEvalCount, srv.EvalCount = 2040, 8
+
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs).Level(zerolog.WarnLevel)
+	t.Cleanup(func() { log.Logger = previous })
+
+	provider := NewOllamaNativeProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m",
+		Options: map[string]interface{}{"num_ctx": 2048}})
+	for range 2 {
+		_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "long"})
+		require.NoError(t, err)
+	}
+
+	assert.Equal(t, 1, bytes.Count(logs.Bytes(), []byte("may have been truncated")))
+	assert.Contains(t, logs.String(), "context window of 2048 tokens")
+
+	logs.Reset()
+	roomy := NewOllamaNativeProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m",
+		Options: map[string]interface{}{"num_ctx": 32768}})
+	_, err := roomy.Generate(context.Background(), GenerateRequest{UserMessage: "long"})
+	require.NoError(t, err)
+	assert.Empty(t, logs.String())
+}
+
+func TestOllamaNative_ErrorsAreClassified(t *testing.T) {
+	srv := llmtest.NewOllamaServer(t, "ok")
+	srv.FailFirst = 1
+
+	_, err := NewOllamaNativeProvider(ProviderConfig{BaseURL: srv.URL + "/api", ModelName: "m"}).
+		Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+
+	var httpErr *retry.HTTPError
+	require.ErrorAs(t, err, &httpErr)
+	assert.Equal(t, 500, httpErr.StatusCode)
+	assert.Equal(t, "mock failure", httpErr.Message)
+	assert.True(t, retry.ShouldRetryHTTPError(err))
+}
@@ -1,12 +1,19 @@
 package llm
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"math"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
+	"github.com/mirpo/datamatic/retry"
 	"github.com/rs/zerolog/log"
 	"github.com/sashabaranov/go-openai"
 )
@@ -16,6 +23,13 @@ const DefaultOpenAIBaseURL = "https://api.openai.com/v1"
 type OpenAIProvider struct {
 	config ProviderConfig
 	client *openai.Client
+
+	// structuredOutput is how schema requests ask for JSON. Unless configured
+	// it starts at jsonSchema and steps down whenever the server rejects one
+	// with a 400, until a request goes through and settles it.
+	mu               sync.Mutex
+	structuredOutput string
+	settled          bool
 }
 
 func NewOpenAIProvider(config ProviderConfig) *OpenAIProvider {
@@ -25,16 +39,87 @@ func NewOpenAIProvider(config ProviderConfig) *OpenAIProvider {
 		clientConfig.BaseURL = config.BaseURL
 	}
 
+	clientConfig.OrgID = config.Organization
+
+	headers := map[string]string{}
+	for name, value := range config.Headers {
+		headers[name] = value
+	}
+	if config.Project != "" {
+		headers["OpenAI-Project"] = config.Project
+	}
+
+	transport := &headerTransport{headers: headers, noAuth: config.AuthToken == "", extraBody: config.ExtraBody}
+	client := &http.Client{Transport: transport}
 	if config.HTTPTimeout > 0 {
-		clientConfig.HTTPClient = &http.Client{
-			Timeout: time.Duration(config.HTTPTimeout) * time.Second,
-		}
+		client.Timeout = time.Duration(config.HTTPTimeout) * time.Second
+	}
+	clientConfig.HTTPClient = client
+
+	structuredOutput := config.StructuredOutput
+	if structuredOutput == "" {
+		structuredOutput = StructuredOutputJSONSchema
 	}
 
 	return &OpenAIProvider{
-		config: config,
-		client: openai.NewClientWithConfig(clientConfig),
+		config:           config,
+		client:           openai.NewClientWithConfig(clientConfig),
+		structuredOutput: structuredOutput,
+		settled:          config.StructuredOutput != "",
+	}
+}
+
+// headerTransport adds the configured headers to every request. go-openai
+// always sends "Authorization: Bearer <token>"; with no token it is dropped
+// rather than sent empty, which some servers reject. It merges extraBody into
+// chat-completion bodies, whose request type has no room for unknown fields.
+// It also catches the retry hint of an error response, which go-openai's
+// errors don't carry.
+type headerTransport struct {
+	headers   map[string]string
+	noAuth    bool
+	extraBody map[string]interface{}
+}
+
+type retryHintKey struct{}
+
+func (t *headerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if t.noAuth {
+		req.Header.Del("Authorization")
+	}
+	for name, value := range t.headers {
+		req.Header.Set(name, value)
+	}
+	if len(t.extraBody) > 0 && req.Method == http.MethodPost && strings.HasSuffix(req.URL.Path, "/chat/completions") {
+		if err := t.mergeExtraBody(req); err != nil {
+			return nil, err
+		}
+	}
+
+	resp, err := http.DefaultTransport.RoundTrip(req)
+	if err == nil && resp.StatusCode >= 400 {
+		if hint, ok := req.Context().Value(retryHintKey{}).(*time.Duration); ok {
+			*hint = retry.ParseRetryAfter(resp.Header, time.Now())
+		}
 	}
+	return resp, err
+}
+
+func (t *headerTransport) mergeExtraBody(req *http.Request) error {
+	body, err := io.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		return err
+	}
+	body, err = withExtraBody(body, t.extraBody)
+	if err != nil {
+		return err
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.GetBody = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(body)), nil }
+	req.ContentLength = int64(len(body))
+	return nil
 }
 
 type ResponseJSONSchema struct {
@@ -48,7 +133,81 @@ type ResponseFormat struct {
 	JSONSchema ResponseJSONSchema `json:"json_schema,omitempty"`
 }
 
-func (p *OpenAIProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+// outputMode returns the structured output mode schema requests use now.
+func (p *OpenAIProvider) outputMode() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.structuredOutput
+}
+
+// settle keeps the mode a schema request just went through with.
+func (p *OpenAIProvider) settle(mode string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.structuredOutput == mode {
+		p.settled = true
+	}
+}
+
+// stepDown moves on from a mode the server rejected and reports whether the
+// request is worth sending again. Only a 400 naming the response format,
+// before the mode settled, counts: any other 400 is about the request (its
+// length, image or extra fields), and once a request went through, so is
+// every 400 after it.
+func (p *OpenAIProvider) stepDown(mode string, err error) bool {
+	if !retry.IsBadRequest(err) || !rejectsResponseFormat(err) {
+		return false
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.settled {
+		return false
+	}
+	if p.structuredOutput != mode {
+		return true // a concurrent request stepped down already
+	}
+
+	next := StructuredOutputPrompt
+	switch mode {
+	case StructuredOutputJSONSchema:
+		next = StructuredOutputJSONObject
+	case StructuredOutputPrompt:
+		return false
+	}
+	log.Warn().Err(err).Msgf("llm: openai: model %s rejected %s structured output, trying %s", p.config.ModelName, mode, next)
+	p.structuredOutput = next
+	return true
+}
+
+// responseFormatTerms are what a server's error names when it is the
+// response_format it can't take.
+var responseFormatTerms = []string{"response_format", "json_schema", "json_object"}
+
+// rejectsResponseFormat reports whether an error blames the request's
+// response_format, in its message or as the offending parameter.
+func rejectsResponseFormat(err error) bool {
+	message := strings.ToLower(err.Error())
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) && apiErr.Param != nil {
+		message += " " + strings.ToLower(*apiErr.Param)
+	}
+	for _, term := range responseFormatTerms {
+		if strings.Contains(message, term) {
+			return true
+		}
+	}
+	return false
+}
+
+// schemaInstruction describes the schema to a model the server can't hold
+// to it.
+func schemaInstruction(request GenerateRequest) string {
+	return "Respond with a single JSON value matching this JSON schema, and nothing else:\n" + request.JSONSchema.ToJSONString()
+}
+
+// buildRequest translates a GenerateRequest into the chat-completions request
+// body this provider sends, asking for schema output the given way.
+func (p *OpenAIProvider) buildRequest(request GenerateRequest, mode string) openai.ChatCompletionRequest {
 	req := openai.ChatCompletionRequest{
 		Model:  p.config.ModelName,
 		Stream: false,
@@ -65,16 +224,41 @@ func (p *OpenAIProvider) Generate(ctx context.Context, request GenerateRequest)
 	if p.config.MaxTokens != nil {
 		req.MaxTokens = *p.config.MaxTokens
 	}
+	if p.config.TopP != nil {
+		req.TopP = float32(*p.config.TopP)
+		if req.TopP == 0 {
+			// same omitempty workaround as temperature
+			req.TopP = math.SmallestNonzeroFloat32
+		}
+	}
+	req.Seed = p.config.Seed
+	req.Stop = p.config.Stop
+	// the penalties default to 0, so omitempty dropping a 0 changes nothing
+	if p.config.PresencePenalty != nil {
+		req.PresencePenalty = float32(*p.config.PresencePenalty)
+	}
+	if p.config.FrequencyPenalty != nil {
+		req.FrequencyPenalty = float32(*p.config.FrequencyPenalty)
+	}
+	req.ReasoningEffort = p.config.ReasoningEffort
 
 	messages := []openai.ChatCompletionMessage{}
 
-	if request.SystemMessage != "" {
+	system := request.SystemMessage
+	if request.IsJSON && mode != StructuredOutputJSONSchema {
+		system = strings.TrimSpace(system + "\n\n" + schemaInstruction(request))
+	}
+	if system != "" {
 		messages = append(messages, openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleSystem,
-			Content: request.SystemMessage,
+			Content: system,
 		})
 	}
 
+	for _, message := range request.Messages {
+		messages = append(messages, openai.ChatCompletionMessage{Role: message.Role, Content: message.Content})
+	}
+
 	if len(request.Base64Image) == 0 {
 		messages = append(messages, openai.ChatCompletionMessage{
 			Role:    openai.ChatMessageRoleUser,
@@ -99,9 +283,15 @@ func (p *OpenAIProvider) Generate(ctx context.Context, request GenerateRequest)
 		})
 	}
 
+	for _, followup := range request.Followups {
+		messages = append(messages, openai.ChatCompletionMessage{Role: followup.Role, Content: followup.Content})
+	}
+
 	req.Messages = messages
 
-	if request.IsJSON {
+	switch {
+	case !request.IsJSON:
+	case mode == StructuredOutputJSONSchema:
 		req.ResponseFormat = &openai.ChatCompletionResponseFormat{
 			Type: openai.ChatCompletionResponseFormatTypeJSONSchema,
 			JSONSchema: &openai.ChatCompletionResponseFormatJSONSchema{
@@ -110,12 +300,55 @@ func (p *OpenAIProvider) Generate(ctx context.Context, request GenerateRequest)
 				Schema: request.JSONSchema.GetSchema(),
 			},
 		}
+	case mode == StructuredOutputJSONObject:
+		req.ResponseFormat = &openai.ChatCompletionResponseFormat{Type: openai.ChatCompletionResponseFormatTypeJSONObject}
+	}
+
+	return req
+}
+
+// PreviewRequest returns the JSON body Generate would send for the request.
+func (p *OpenAIProvider) PreviewRequest(request GenerateRequest) ([]byte, error) {
+	body, err := json.Marshal(p.buildRequest(request, p.outputMode()))
+	if err != nil {
+		return nil, err
+	}
+	return previewBody(withExtraBody(body, p.config.ExtraBody))
+}
+
+func (p *OpenAIProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := waitForAnotherRequest(ctx); err != nil {
+				return nil, err
+			}
+		}
+		mode := p.outputMode()
+		resp, err := p.generate(ctx, request, mode)
+		if !request.IsJSON {
+			return resp, err
+		}
+		if err == nil {
+			p.settle(mode)
+			return resp, nil
+		}
+		if !p.stepDown(mode, err) {
+			return nil, err
+		}
 	}
+}
+
+func (p *OpenAIProvider) generate(ctx context.Context, request GenerateRequest, mode string) (*GenerateResponse, error) {
+	req := p.buildRequest(request, mode)
 
 	log.Debug().Msgf("LLM request: model=%s, messages=%d, to baseUrl: %s", req.Model, len(req.Messages), p.config.BaseURL)
 
-	resp, err := p.client.CreateChatCompletion(ctx, req)
+	var retryAfter time.Duration
+	resp, err := p.client.CreateChatCompletion(context.WithValue(ctx, retryHintKey{}, &retryAfter), req)
 	if err != nil {
+		if retryAfter > 0 {
+			err = &retry.Hint{Err: err, RetryAfter: retryAfter}
+		}
 		return nil, fmt.Errorf("llm: openai: completion request failed: %w", err)
 	}
 
@@ -130,6 +363,12 @@ func (p *OpenAIProvider) Generate(ctx context.Context, request GenerateRequest)
 	}
 
 	return &GenerateResponse{
-		Text: resp.Choices[0].Message.Content,
+		Text:      resp.Choices[0].Message.Content,
+		Reasoning: resp.Choices[0].Message.ReasoningContent,
+		Usage: Usage{
+			PromptTokens:     resp.Usage.PromptTokens,
+			CompletionTokens: resp.Usage.CompletionTokens,
+		},
+		SchemaUnenforced: request.IsJSON && mode != StructuredOutputJSONSchema,
 	}, nil
 }
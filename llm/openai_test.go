@@ -2,10 +2,14 @@ package llm
 
 import (
 	"context"
+	"encoding/json"
+	"net/http"
 	"testing"
 	"time"
 
 	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/jsonschema"
+	"github.com/mirpo/datamatic/retry"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -37,6 +41,18 @@ func TestGenerate_ZeroTimeoutMeansNoTimeout(t *testing.T) {
 	assert.Equal(t, "ok", resp.Text)
 }
 
+func TestGenerate_ReturnsReasoningContent(t *testing.T) {
+	srv := llmtest.NewServer(t, "42")
+	srv.Reasoning = "six times seven"
+
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+
+	resp, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+	assert.Equal(t, "42", resp.Text)
+	assert.Equal(t, "six times seven", resp.Reasoning)
+}
+
 func TestGenerate_TemperatureZeroIsSent(t *testing.T) {
 	srv := llmtest.NewServer(t, "ok")
 
@@ -63,3 +79,192 @@ func TestGenerate_NilTemperatureIsNotSent(t *testing.T) {
 	_, present := srv.Requests()[0]["temperature"]
 	assert.False(t, present)
 }
+
+func TestPreviewRequest_MatchesSentBody(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+	request := GenerateRequest{UserMessage: "hi", SystemMessage: "be brief"}
+
+	body, err := provider.PreviewRequest(request)
+	require.NoError(t, err)
+	_, err = provider.Generate(context.Background(), request)
+	require.NoError(t, err)
+
+	var previewed map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &previewed))
+	assert.Equal(t, srv.Requests()[0], previewed, "the preview is exactly what Generate sends")
+}
+
+func TestGenerate_SendsSamplingSettings(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	topP, seed, presence, frequency := 0.0, 42, 0.5, -0.5
+
+	provider := NewOpenAIProvider(ProviderConfig{
+		BaseURL: srv.URL, ModelName: "m",
+		TopP: &topP, Seed: &seed, Stop: []string{"END"},
+		PresencePenalty: &presence, FrequencyPenalty: &frequency, ReasoningEffort: "low",
+	})
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+
+	req := srv.Requests()[0]
+	got, present := req["top_p"]
+	require.True(t, present, "top_p: 0 must be serialized, like temperature: 0")
+	assert.InDelta(t, 0.0, got.(float64), 1e-6)
+	assert.EqualValues(t, 42, req["seed"])
+	assert.Equal(t, []interface{}{"END"}, req["stop"])
+	assert.InDelta(t, 0.5, req["presence_penalty"].(float64), 1e-6)
+	assert.InDelta(t, -0.5, req["frequency_penalty"].(float64), 1e-6)
+	assert.Equal(t, "low", req["reasoning_effort"])
+}
+
+func TestGenerate_StepsDownStructuredOutputOnBadRequest(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"city":"Oslo"}`)
+	srv.RejectFormats = []string{"json_schema"}
+	schema, err := jsonschema.LoadSchema(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`)
+	require.NoError(t, err)
+	request := GenerateRequest{UserMessage: "A city", IsJSON: true, JSONSchema: *schema}
+
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+	for range 2 {
+		resp, err := provider.Generate(context.Background(), request)
+		require.NoError(t, err)
+		assert.True(t, resp.SchemaUnenforced)
+	}
+
+	requests := srv.Requests()
+	require.Len(t, requests, 3, "only the first request finds out")
+	assert.Equal(t, "json_schema", requests[0]["response_format"].(map[string]interface{})["type"])
+	assert.Equal(t, "json_object", requests[1]["response_format"].(map[string]interface{})["type"])
+	assert.Equal(t, "json_object", requests[2]["response_format"].(map[string]interface{})["type"])
+
+	system := requests[1]["messages"].([]interface{})[0].(map[string]interface{})
+	assert.Equal(t, "system", system["role"])
+	assert.Contains(t, system["content"], `"city"`, "the schema goes into the system prompt")
+}
+
+func TestGenerate_KeepsStructuredOutputOnOtherBadRequests(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"city":"Oslo"}`)
+	srv.FailFirst = 1
+	srv.FailStatus = http.StatusBadRequest
+	srv.FailMessage = "This model's maximum context length is 8192 tokens."
+	schema, err := jsonschema.LoadSchema(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`)
+	require.NoError(t, err)
+	request := GenerateRequest{UserMessage: "A city", IsJSON: true, JSONSchema: *schema}
+
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+	_, err = provider.Generate(context.Background(), request)
+	require.Error(t, err, "a request the server can't take fails as it is")
+	resp, err := provider.Generate(context.Background(), request)
+	require.NoError(t, err)
+	assert.False(t, resp.SchemaUnenforced)
+
+	assert.Equal(t, StructuredOutputJSONSchema, provider.outputMode())
+	requests := srv.Requests()
+	require.Len(t, requests, 2)
+	for _, req := range requests {
+		assert.Equal(t, "json_schema", req["response_format"].(map[string]interface{})["type"])
+	}
+}
+
+func TestGenerate_FallsBackToThePromptWithoutJSONModes(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"city":"Oslo"}`)
+	srv.RejectFormats = []string{"json_schema", "json_object"}
+	schema, err := jsonschema.LoadSchema(`{"type":"object","properties":{"city":{"type":"string"}}}`)
+	require.NoError(t, err)
+
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+	_, err = provider.Generate(context.Background(), GenerateRequest{UserMessage: "A city", IsJSON: true, JSONSchema: *schema})
+	require.NoError(t, err)
+
+	requests := srv.Requests()
+	require.Len(t, requests, 3)
+	assert.Nil(t, requests[2]["response_format"])
+}
+
+func TestGenerate_ConfiguredStructuredOutputIsNotDetected(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"city":"Oslo"}`)
+	srv.RejectFormats = []string{"json_object"}
+	schema, err := jsonschema.LoadSchema(`{"type":"object","properties":{"city":{"type":"string"}}}`)
+	require.NoError(t, err)
+
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m", StructuredOutput: StructuredOutputJSONObject})
+	_, err = provider.Generate(context.Background(), GenerateRequest{UserMessage: "A city", IsJSON: true, JSONSchema: *schema})
+
+	require.Error(t, err)
+	assert.Equal(t, 1, srv.CallCount())
+}
+
+func TestGenerate_MergesExtraBody(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m", ExtraBody: map[string]interface{}{
+		"service_tier":         "flex",
+		"model":                "override",
+		"chat_template_kwargs": map[string]interface{}{"enable_thinking": false},
+	}})
+	request := GenerateRequest{UserMessage: "hi"}
+
+	_, err := provider.Generate(context.Background(), request)
+	require.NoError(t, err)
+
+	req := srv.Requests()[0]
+	assert.Equal(t, "flex", req["service_tier"])
+	assert.Equal(t, "override", req["model"], "extraBody replaces a field of the same name")
+	assert.Equal(t, map[string]interface{}{"enable_thinking": false}, req["chat_template_kwargs"])
+	assert.NotEmpty(t, req["messages"])
+
+	body, err := provider.PreviewRequest(request)
+	require.NoError(t, err)
+	var previewed map[string]interface{}
+	require.NoError(t, json.Unmarshal(body, &previewed))
+	assert.Equal(t, req, previewed)
+}
+
+func TestGenerate_SendsConfiguredHeaders(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+
+	provider := NewOpenAIProvider(ProviderConfig{
+		BaseURL:      srv.URL,
+		ModelName:    "m",
+		AuthToken:    "secret",
+		Headers:      map[string]string{"X-Tenant": "acme"},
+		Organization: "org-1",
+		Project:      "proj-1",
+	})
+
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+
+	headers := srv.Headers()[0]
+	assert.Equal(t, "Bearer secret", headers.Get("Authorization"))
+	assert.Equal(t, "acme", headers.Get("X-Tenant"))
+	assert.Equal(t, "org-1", headers.Get("OpenAI-Organization"))
+	assert.Equal(t, "proj-1", headers.Get("OpenAI-Project"))
+}
+
+func TestGenerate_NoKeyMeansNoAuthorizationHeader(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+
+	_, present := srv.Headers()[0]["Authorization"]
+	assert.False(t, present)
+}
+
+func TestGenerate_RateLimitCarriesRetryAfter(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	srv.FailFirst = 1
+	srv.FailStatus = http.StatusTooManyRequests
+	srv.FailHeader = http.Header{"Retry-After": {"7"}}
+
+	provider := NewOpenAIProvider(ProviderConfig{BaseURL: srv.URL, ModelName: "m"})
+
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+
+	require.Error(t, err)
+	assert.True(t, retry.IsRateLimited(err))
+	assert.Equal(t, 7*time.Second, retry.RetryAfter(err))
+}
@@ -1,37 +1,58 @@
 package llm
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/rs/zerolog/log"
 )
 
 func NewProvider(config ProviderConfig) (Provider, error) {
-	log.Debug().Msgf("llm: providerConfig %+v", config)
+	log.Debug().Msgf("llm: providerConfig %+v", redacted(config))
+
+	headers, err := expandHeaders(config.Headers)
+	if err != nil {
+		return nil, err
+	}
+	config.Headers = headers
+
+	if len(config.Endpoints) > 0 {
+		return NewBalancer(config)
+	}
 
 	switch config.ProviderType {
 	case ProviderOllama:
 		if config.BaseURL == "" {
 			config.BaseURL = "http://localhost:11434/v1"
 		}
-		return NewOpenAIProvider(config), nil
+		return newLocalProvider(config)
 	case ProviderLmStudio:
 		if config.BaseURL == "" {
 			config.BaseURL = "http://127.0.0.1:1234/v1"
 		}
-		return NewOpenAIProvider(config), nil
+		return newLocalProvider(config)
+	case ProviderOpenAICompatible:
+		if config.BaseURL == "" {
+			return nil, fmt.Errorf("llm: %s needs a baseUrl or endpoints", ProviderOpenAICompatible)
+		}
+		// without apiKeyEnv the server is assumed to need no key, and no
+		// Authorization header is sent
+		config.AuthToken = ""
+		return newLocalProvider(config)
 	case ProviderOpenAI:
-		token := os.Getenv("OPENAI_API_KEY")
-		if token == "" {
-			return nil, fmt.Errorf("llm: OPENAI_API_KEY environment variable is not set")
+		token, err := apiKey(config, "OPENAI_API_KEY")
+		if err != nil {
+			return nil, err
 		}
 		config.AuthToken = token
 		return NewOpenAIProvider(config), nil
 	case ProviderOpenRouter:
-		token := os.Getenv("OPENROUTER_API_KEY")
-		if token == "" {
-			return nil, fmt.Errorf("llm: OPENROUTER_API_KEY environment variable is not set")
+		token, err := apiKey(config, "OPENROUTER_API_KEY")
+		if err != nil {
+			return nil, err
 		}
 		config.AuthToken = token
 		if config.BaseURL == "" {
@@ -39,18 +60,131 @@ func NewProvider(config ProviderConfig) (Provider, error) {
 		}
 		return NewOpenAIProvider(config), nil
 	case ProviderGemini:
-		token := os.Getenv("GEMINI_API_KEY")
-		if token == "" {
-			return nil, fmt.Errorf("llm: GEMINI_API_KEY environment variable is not set")
+		token, err := apiKey(config, "GEMINI_API_KEY")
+		if err != nil {
+			return nil, err
 		}
 		config.AuthToken = token
 		if config.BaseURL == "" {
 			config.BaseURL = "https://generativelanguage.googleapis.com/v1beta/openai/"
 		}
 		return NewOpenAIProvider(config), nil
+	case ProviderAnthropic:
+		token, err := apiKey(config, "ANTHROPIC_API_KEY")
+		if err != nil {
+			return nil, err
+		}
+		config.AuthToken = token
+		return NewAnthropicProvider(config), nil
+	case ProviderOllamaNative:
+		return NewOllamaNativeProvider(config), nil
+	case ProviderMock:
+		return NewMockProvider(config), nil
 	case ProviderUnknown:
 		return nil, fmt.Errorf("llm: provider type 'unknown' is not supported")
 	default:
 		return nil, fmt.Errorf("llm: unsupported provider: %s", config.ProviderType)
 	}
 }
+
+// newLocalProvider is an OpenAI client for a server that needs no API key
+// unless apiKeyEnv names one, such as a local server behind a proxy.
+func newLocalProvider(config ProviderConfig) (Provider, error) {
+	if config.APIKeyEnv != "" {
+		token, err := apiKey(config, "")
+		if err != nil {
+			return nil, err
+		}
+		config.AuthToken = token
+	}
+	return NewOpenAIProvider(config), nil
+}
+
+// apiKey reads the provider's API key from the environment: from the variable
+// apiKeyEnv names, or else the provider's usual one.
+func apiKey(config ProviderConfig, defaultEnv string) (string, error) {
+	name := defaultEnv
+	if config.APIKeyEnv != "" {
+		name = config.APIKeyEnv
+	}
+	token := os.Getenv(name)
+	if token == "" {
+		return "", fmt.Errorf("llm: %s environment variable is not set", name)
+	}
+	return token, nil
+}
+
+// expandHeaders resolves $VAR and ${VAR} in header values. The config loader
+// already expands variables it knows; one still in place here is unset, which
+// would otherwise be sent literally.
+func expandHeaders(headers map[string]string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return headers, nil
+	}
+
+	expanded := make(map[string]string, len(headers))
+	for name, value := range headers {
+		var missing []string
+		expanded[name] = os.Expand(value, func(v string) string {
+			val, ok := os.LookupEnv(v)
+			if !ok {
+				missing = append(missing, v)
+			}
+			return val
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("llm: header '%s' uses unset environment variable(s): %s", name, strings.Join(missing, ", "))
+		}
+	}
+	return expanded, nil
+}
+
+// withExtraBody adds the extraBody fields to an encoded request body, replacing
+// fields of the same name. The body's own fields stay as encoded, so large
+// integers such as a seed keep their exact value.
+func withExtraBody(body []byte, extra map[string]interface{}) ([]byte, error) {
+	if len(extra) == 0 {
+		return body, nil
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	for name, value := range extra {
+		raw, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("llm: extraBody field '%s': %w", name, err)
+		}
+		fields[name] = raw
+	}
+	return json.Marshal(fields)
+}
+
+// previewBody is the indented request body a provider's PreviewRequest shows.
+func previewBody(body []byte, err error) ([]byte, error) {
+	if err != nil {
+		return nil, err
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, body, "", "  "); err != nil {
+		return nil, err
+	}
+	return indented.Bytes(), nil
+}
+
+// redacted is a config safe to log: the key and header values may be
+// credentials.
+func redacted(config ProviderConfig) ProviderConfig {
+	if config.AuthToken != "" {
+		config.AuthToken = "***"
+	}
+	if len(config.Headers) > 0 {
+		headers := make(map[string]string, len(config.Headers))
+		for name := range config.Headers {
+			headers[name] = "***"
+		}
+		config.Headers = headers
+	}
+	return config
+}
@@ -40,6 +40,64 @@ func TestNewProvider(t *testing.T) {
 		assert.NotNil(t, provider)
 	})
 
+	t.Run("returns Anthropic provider", func(t *testing.T) {
+		t.Setenv("ANTHROPIC_API_KEY", "test-key")
+		provider, err := NewProvider(ProviderConfig{ProviderType: ProviderAnthropic})
+		assert.NoError(t, err)
+		assert.IsType(t, &AnthropicProvider{}, provider)
+	})
+
+	t.Run("Anthropic requires an API key", func(t *testing.T) {
+		t.Setenv("ANTHROPIC_API_KEY", "")
+		_, err := NewProvider(ProviderConfig{ProviderType: ProviderAnthropic})
+		assert.ErrorContains(t, err, "ANTHROPIC_API_KEY")
+	})
+
+	t.Run("returns Ollama-native provider", func(t *testing.T) {
+		provider, err := NewProvider(ProviderConfig{ProviderType: ProviderOllamaNative})
+		assert.NoError(t, err)
+		assert.IsType(t, &OllamaNativeProvider{}, provider)
+	})
+
+	t.Run("returns OpenAI-compatible provider", func(t *testing.T) {
+		provider, err := NewProvider(ProviderConfig{ProviderType: ProviderOpenAICompatible, BaseURL: "http://localhost:8000/v1"})
+		assert.NoError(t, err)
+		assert.IsType(t, &OpenAIProvider{}, provider)
+	})
+
+	t.Run("OpenAI-compatible requires a baseUrl", func(t *testing.T) {
+		_, err := NewProvider(ProviderConfig{ProviderType: ProviderOpenAICompatible})
+		assert.ErrorContains(t, err, "needs a baseUrl")
+	})
+
+	t.Run("apiKeyEnv replaces the default key variable", func(t *testing.T) {
+		t.Setenv("OPENAI_API_KEY", "")
+		t.Setenv("TEAM_OPENAI_KEY", "team-key")
+		provider, err := NewProvider(ProviderConfig{ProviderType: ProviderOpenAI, APIKeyEnv: "TEAM_OPENAI_KEY"})
+		assert.NoError(t, err)
+		assert.Equal(t, "team-key", provider.(*OpenAIProvider).config.AuthToken)
+	})
+
+	t.Run("apiKeyEnv must be set", func(t *testing.T) {
+		t.Setenv("GATEWAY_KEY", "")
+		_, err := NewProvider(ProviderConfig{ProviderType: ProviderOpenAICompatible, BaseURL: "http://localhost:8000/v1", APIKeyEnv: "GATEWAY_KEY"})
+		assert.ErrorContains(t, err, "GATEWAY_KEY environment variable is not set")
+	})
+
+	t.Run("expands header values", func(t *testing.T) {
+		t.Setenv("TENANT", "acme")
+		provider, err := NewProvider(ProviderConfig{ProviderType: ProviderOpenAICompatible, BaseURL: "http://localhost:8000/v1",
+			Headers: map[string]string{"X-Tenant": "${TENANT}-eu"}})
+		assert.NoError(t, err)
+		assert.Equal(t, "acme-eu", provider.(*OpenAIProvider).config.Headers["X-Tenant"])
+	})
+
+	t.Run("rejects a header with an unset variable", func(t *testing.T) {
+		_, err := NewProvider(ProviderConfig{ProviderType: ProviderOpenAICompatible, BaseURL: "http://localhost:8000/v1",
+			Headers: map[string]string{"X-Tenant": "$DATAMATIC_UNSET_TENANT"}})
+		assert.ErrorContains(t, err, "DATAMATIC_UNSET_TENANT")
+	})
+
 	t.Run("returns error for unknown provider", func(t *testing.T) {
 		provider, err := NewProvider(ProviderConfig{ProviderType: ProviderUnknown})
 		assert.Nil(t, provider)
@@ -0,0 +1,234 @@
+package llm
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RateLimit is a provider's quota in requests and tokens per minute; zero
+// fields are unlimited.
+type RateLimit struct {
+	RequestsPerMinute int `yaml:"requestsPerMinute"`
+	TokensPerMinute   int `yaml:"tokensPerMinute"`
+}
+
+func (l RateLimit) IsZero() bool {
+	return l.RequestsPerMinute == 0 && l.TokensPerMinute == 0
+}
+
+// RateLimiters paces requests to stay within providers' quotas instead of
+// running into 429s. Limiters are shared by every step sending with the same
+// provider and key: a provider-level limit covers all its models, a
+// model-level one only that model.
+type RateLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+func NewRateLimiters() *RateLimiters {
+	return &RateLimiters{limiters: map[string]*rateLimiter{}}
+}
+
+// Wrap returns a provider that waits for the provider-level and model-level
+// limits (either may be zero) before each request.
+func (r *RateLimiters) Wrap(provider Provider, config ProviderConfig, providerLimit, modelLimit RateLimit) Provider {
+	// the key variable, not the key: it's the same key for every step
+	account := fmt.Sprintf("%s|%s|%s", config.ProviderType, config.BaseURL, config.APIKeyEnv)
+
+	var limiters []*rateLimiter
+	if !providerLimit.IsZero() {
+		limiters = append(limiters, r.limiter(account, providerLimit))
+	}
+	if !modelLimit.IsZero() {
+		limiters = append(limiters, r.limiter(account+"|"+config.ModelName, modelLimit))
+	}
+	if len(limiters) == 0 {
+		return provider
+	}
+	return &rateLimitedProvider{provider: provider, limiters: limiters}
+}
+
+func (r *RateLimiters) limiter(key string, limit RateLimit) *rateLimiter {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if l, ok := r.limiters[key]; ok {
+		if l.limit != limit {
+			log.Warn().Msgf("rate limit: steps sharing '%s' set different limits, using the first: %+v", key, l.limit)
+		}
+		return l
+	}
+	l := newRateLimiter(limit)
+	r.limiters[key] = l
+	return l
+}
+
+type rateLimitedProvider struct {
+	provider Provider
+	limiters []*rateLimiter
+}
+
+func (p *rateLimitedProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	estimate := EstimateTokens(request)
+	for i, l := range p.limiters {
+		if err := l.wait(ctx, estimate); err != nil {
+			for _, taken := range p.limiters[:i] {
+				taken.refund(estimate)
+			}
+			return nil, err
+		}
+	}
+
+	ctx = context.WithValue(ctx, anotherRequestKey{}, func(ctx context.Context) error {
+		for _, l := range p.limiters {
+			if err := l.another(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	resp, err := p.provider.Generate(ctx, request)
+	if err == nil && resp.Usage.Total() > 0 {
+		for _, l := range p.limiters {
+			l.settle(estimate, resp.Usage.Total())
+		}
+	}
+	return resp, err
+}
+
+// anotherRequestKey carries, in the context of a rate-limited call, how to
+// draw one more request from the limits the call was let through by.
+type anotherRequestKey struct{}
+
+// waitForAnotherRequest is called by a provider before each HTTP request
+// after the first that one Generate call sends, such as OpenAIProvider's
+// retries with a lower structuredOutput mode, so that every request counts
+// towards requestsPerMinute. Their tokens are not taken again: the call's
+// usage is settled once, from the request that was answered.
+func waitForAnotherRequest(ctx context.Context) error {
+	if wait, ok := ctx.Value(anotherRequestKey{}).(func(context.Context) error); ok {
+		return wait(ctx)
+	}
+	return nil
+}
+
+// rateLimiter holds a token bucket for requests and one for tokens, each
+// refilling continuously to a minute's worth.
+type rateLimiter struct {
+	limit    RateLimit
+	requests *bucket
+	tokens   *bucket
+}
+
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	l := &rateLimiter{limit: limit}
+	if limit.RequestsPerMinute > 0 {
+		l.requests = newBucket(float64(limit.RequestsPerMinute))
+	}
+	if limit.TokensPerMinute > 0 {
+		l.tokens = newBucket(float64(limit.TokensPerMinute))
+	}
+	return l
+}
+
+// wait takes a request and the estimated prompt tokens, sleeping until both
+// buckets cover them.
+func (l *rateLimiter) wait(ctx context.Context, tokens int) error {
+	if l.requests != nil {
+		if err := l.requests.take(ctx, 1); err != nil {
+			return err
+		}
+	}
+	if l.tokens != nil {
+		if err := l.tokens.take(ctx, float64(tokens)); err != nil {
+			if l.requests != nil {
+				l.requests.put(1)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// another takes one more request for a call that sends several.
+func (l *rateLimiter) another(ctx context.Context) error {
+	if l.requests != nil {
+		return l.requests.take(ctx, 1)
+	}
+	return nil
+}
+
+func (l *rateLimiter) refund(tokens int) {
+	if l.requests != nil {
+		l.requests.put(1)
+	}
+	if l.tokens != nil {
+		l.tokens.put(float64(tokens))
+	}
+}
+
+// settle charges the tokens a request really took (completion included) in
+// place of its estimate.
+func (l *rateLimiter) settle(estimate, actual int) {
+	if l.tokens != nil {
+		l.tokens.put(float64(estimate - actual))
+	}
+}
+
+// bucket is a token bucket holding up to a minute's quota. A take may drive it
+// below zero: the caller then sleeps until the refill covers the debt, which
+// queues concurrent callers in arrival order without polling, and lets a
+// request larger than the whole quota through once the bucket was full.
+type bucket struct {
+	mu        sync.Mutex
+	capacity  float64
+	available float64
+	perSecond float64
+	updated   time.Time
+}
+
+func newBucket(perMinute float64) *bucket {
+	return &bucket{capacity: perMinute, available: perMinute, perSecond: perMinute / 60, updated: time.Now()}
+}
+
+func (b *bucket) take(ctx context.Context, n float64) error {
+	b.mu.Lock()
+	b.refill()
+	b.available -= n
+	var wait time.Duration
+	if b.available < 0 {
+		wait = time.Duration(-b.available / b.perSecond * float64(time.Second))
+	}
+	b.mu.Unlock()
+
+	if wait == 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		b.put(n)
+		return ctx.Err()
+	}
+}
+
+// put returns n to the bucket (a negative n takes more).
+func (b *bucket) put(n float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.refill()
+	b.available = min(b.available+n, b.capacity)
+}
+
+func (b *bucket) refill() {
+	now := time.Now()
+	b.available = min(b.available+now.Sub(b.updated).Seconds()*b.perSecond, b.capacity)
+	b.updated = now
+}
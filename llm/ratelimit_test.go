@@ -0,0 +1,96 @@
+package llm
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/jsonschema"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket_WaitsForTheRefillOnceEmpty(t *testing.T) {
+	b := newBucket(6000) // 100 per second
+
+	require.NoError(t, b.take(context.Background(), 6000))
+
+	start := time.Now()
+	require.NoError(t, b.take(context.Background(), 10))
+	assert.InDelta(t, 100*time.Millisecond, time.Since(start), float64(60*time.Millisecond))
+}
+
+func TestBucket_CancelledWaitGivesItsShareBack(t *testing.T) {
+	b := newBucket(60)
+	require.NoError(t, b.take(context.Background(), 60))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, b.take(ctx, 30), context.DeadlineExceeded)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	assert.InDelta(t, 0, b.available, 0.1)
+}
+
+func TestRateLimiters_ShareLimitsPerProviderAndKey(t *testing.T) {
+	r := NewRateLimiters()
+	limit := RateLimit{RequestsPerMinute: 60}
+	mock := NewMockProvider(ProviderConfig{})
+
+	openai := ProviderConfig{ProviderType: ProviderOpenAI, ModelName: "gpt-4o-mini"}
+	otherModel := ProviderConfig{ProviderType: ProviderOpenAI, ModelName: "gpt-4o"}
+	otherKey := ProviderConfig{ProviderType: ProviderOpenAI, ModelName: "gpt-4o", APIKeyEnv: "TEAM_KEY"}
+
+	first := r.Wrap(mock, openai, limit, RateLimit{}).(*rateLimitedProvider)
+	second := r.Wrap(mock, otherModel, limit, RateLimit{}).(*rateLimitedProvider)
+	third := r.Wrap(mock, otherKey, limit, RateLimit{}).(*rateLimitedProvider)
+	modelOnly := r.Wrap(mock, openai, RateLimit{}, limit).(*rateLimitedProvider)
+
+	assert.Same(t, first.limiters[0], second.limiters[0], "a provider-level limit covers every model")
+	assert.NotSame(t, first.limiters[0], third.limiters[0], "another key has its own quota")
+	assert.NotSame(t, first.limiters[0], modelOnly.limiters[0])
+	assert.Same(t, mock, r.Wrap(mock, openai, RateLimit{}, RateLimit{}), "no limits, no wrapper")
+}
+
+func TestRateLimitedProvider_ChargesReportedTokens(t *testing.T) {
+	r := NewRateLimiters()
+	provider := r.Wrap(&fixedProvider{usage: Usage{PromptTokens: 400, CompletionTokens: 200}},
+		ProviderConfig{ProviderType: ProviderOpenAI}, RateLimit{TokensPerMinute: 1000}, RateLimit{})
+
+	_, err := provider.Generate(context.Background(), GenerateRequest{UserMessage: "hi"})
+	require.NoError(t, err)
+
+	tokens := provider.(*rateLimitedProvider).limiters[0].tokens
+	tokens.mu.Lock()
+	defer tokens.mu.Unlock()
+	assert.InDelta(t, 400, tokens.available, 1, "the estimate is replaced by the 600 tokens used")
+}
+
+func TestRateLimitedProvider_CountsEveryRequestOfAStepDown(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"city":"Oslo"}`)
+	srv.RejectFormats = []string{"json_schema"}
+	schema, err := jsonschema.LoadSchema(`{"type":"object","properties":{"city":{"type":"string"}},"required":["city"]}`)
+	require.NoError(t, err)
+
+	config := ProviderConfig{ProviderType: ProviderOpenAI, BaseURL: srv.URL, ModelName: "m"}
+	provider := NewRateLimiters().Wrap(NewOpenAIProvider(config), config, RateLimit{RequestsPerMinute: 60}, RateLimit{})
+
+	_, err = provider.Generate(context.Background(), GenerateRequest{UserMessage: "A city", IsJSON: true, JSONSchema: *schema})
+	require.NoError(t, err)
+	require.Len(t, srv.Requests(), 2, "the json_schema request, then the json_object one")
+
+	requests := provider.(*rateLimitedProvider).limiters[0].requests
+	requests.mu.Lock()
+	defer requests.mu.Unlock()
+	assert.InDelta(t, 58, requests.available, 0.1, "both requests are taken")
+}
+
+type fixedProvider struct {
+	usage Usage
+}
+
+func (p *fixedProvider) Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error) {
+	return &GenerateResponse{Text: "ok", Usage: p.usage}, nil
+}
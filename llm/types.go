@@ -14,7 +14,15 @@ const (
 	ProviderOpenAI     ProviderType = "openai"
 	ProviderOpenRouter ProviderType = "openrouter"
 	ProviderGemini     ProviderType = "gemini"
-	ProviderUnknown    ProviderType = "unknown"
+	ProviderMock       ProviderType = "mock"
+	ProviderAnthropic  ProviderType = "anthropic"
+	// ProviderOllamaNative talks to Ollama's own /api/chat instead of its
+	// OpenAI-compatible /v1, for the options only that API has.
+	ProviderOllamaNative ProviderType = "ollama-native"
+	// ProviderOpenAICompatible is any server speaking the OpenAI chat API
+	// (vLLM, llama.cpp, Together, Groq, gateways); it needs a baseUrl.
+	ProviderOpenAICompatible ProviderType = "openai-compatible"
+	ProviderUnknown          ProviderType = "unknown"
 )
 
 type ProviderConfig struct {
@@ -25,20 +33,103 @@ type ProviderConfig struct {
 	Temperature  *float64
 	MaxTokens    *int
 	HTTPTimeout  int
+	// Sampling settings beyond temperature and maxTokens; unset ones are left
+	// to the provider's default. ExtraBody is merged into the request body
+	// as-is, for fields a provider has that datamatic doesn't know.
+	TopP             *float64
+	Seed             *int
+	Stop             []string
+	PresencePenalty  *float64
+	FrequencyPenalty *float64
+	ReasoningEffort  string
+	ExtraBody        map[string]interface{}
+	// StructuredOutput is how OpenAI client providers ask for output matching
+	// a schema, one of the StructuredOutput modes; empty detects it.
+	StructuredOutput string
+	// APIKeyEnv names the environment variable holding the API key, instead
+	// of the provider's usual one. Headers are sent with every request, and
+	// Organization and Project as OpenAI's organization and project headers
+	// (OpenAI client providers only).
+	APIKeyEnv    string
+	Headers      map[string]string
+	Organization string
+	Project      string
+	// Endpoints, when set, are several servers of the same model that
+	// requests are balanced over, in place of BaseURL.
+	Endpoints []Endpoint
+	// Ollama-native only, see config.ModelConfig.
+	Options   map[string]interface{}
+	KeepAlive string
+	Think     *bool
 }
 
+// The ways an OpenAI-compatible server is asked for output matching a
+// schema. Only jsonSchema has the server enforce it; the others describe it
+// in the system prompt and leave the checking to the client.
+const (
+	StructuredOutputJSONSchema = "jsonSchema" // response_format json_schema, strict
+	StructuredOutputJSONObject = "jsonObject" // response_format json_object
+	StructuredOutputPrompt     = "prompt"     // no response_format
+)
+
 type Provider interface {
 	Generate(ctx context.Context, request GenerateRequest) (*GenerateResponse, error)
 }
 
+// RequestPreviewer is implemented by providers that can show the exact request
+// body they would send, without sending it (used by `datamatic plan`).
+type RequestPreviewer interface {
+	PreviewRequest(request GenerateRequest) ([]byte, error)
+}
+
 type GenerateRequest struct {
 	UserMessage   string
 	SystemMessage string
-	IsJSON        bool
-	JSONSchema    jsonschema.Schema
-	Base64Image   string
+	// Messages are the turns before UserMessage, such as few-shot examples
+	// or a dialogue so far; UserMessage, with the image, is the one answered.
+	Messages    []Message
+	IsJSON      bool
+	JSONSchema  jsonschema.Schema
+	Base64Image string
+	// Followups continue the conversation after UserMessage: the model's
+	// earlier answers and the replies to them, such as a request to repair
+	// an invalid answer.
+	Followups []Message
+	// Row is the step row the request is for. It is never sent: it tells
+	// identical requests of different rows apart where answers are made or
+	// kept locally, so each row gets the same answer on every run whatever
+	// order rows finish in.
+	Row int
+}
+
+// Message roles of a conversation. System messages only come first, and
+// are sent as the request's SystemMessage.
+const (
+	RoleSystem    = "system"
+	RoleUser      = "user"
+	RoleAssistant = "assistant"
+)
+
+// Message is one turn of a conversation.
+type Message struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
 }
 
 type GenerateResponse struct {
-	Text string
+	Text  string
+	Usage Usage // tokens the provider reported for this request (zero if it reports none)
+	// Reasoning is the thinking a reasoning model returned apart from the
+	// text (reasoning_content, Ollama's thinking, Anthropic's thinking blocks).
+	Reasoning string
+	// SchemaUnenforced is set when the schema was only described to the
+	// model, not enforced by the server, so the answer must be checked.
+	SchemaUnenforced bool
+}
+
+// Endpoint is one server of a balanced model, with the number of requests it
+// takes at once.
+type Endpoint struct {
+	URL         string
+	Concurrency int
 }
@@ -0,0 +1,60 @@
+package llm
+
+import (
+	"fmt"
+	"slices"
+)
+
+// Usage is the token count a provider reports for one or more requests.
+type Usage struct {
+	PromptTokens     int `json:"promptTokens"`
+	CompletionTokens int `json:"completionTokens"`
+}
+
+func (u Usage) Total() int {
+	return u.PromptTokens + u.CompletionTokens
+}
+
+func (u *Usage) Add(other Usage) {
+	u.PromptTokens += other.PromptTokens
+	u.CompletionTokens += other.CompletionTokens
+}
+
+// Price is what a model charges, in dollars per million tokens.
+type Price struct {
+	Input  float64 `yaml:"input"`
+	Output float64 `yaml:"output"`
+}
+
+func (p Price) Cost(u Usage) float64 {
+	return (float64(u.PromptTokens)*p.Input + float64(u.CompletionTokens)*p.Output) / 1e6
+}
+
+// PriceKey is how the price table is keyed: "provider:model", the same
+// spelling as a step's `model:`.
+func PriceKey(provider ProviderType, model string) string {
+	return fmt.Sprintf("%s:%s", provider, model)
+}
+
+// EstimateTokens is a rough, provider-independent estimate of a request's
+// prompt tokens (about four characters per token), used to reserve budget
+// before a request is sent. It is deliberately simple: the real count comes
+// back with the response.
+func EstimateTokens(request GenerateRequest) int {
+	chars := len(request.SystemMessage) + len(request.UserMessage)
+	for _, message := range slices.Concat(request.Messages, request.Followups) {
+		chars += len(message.Content)
+	}
+	if request.IsJSON {
+		chars += len(request.JSONSchema.ToJSONString())
+	}
+	tokens := (chars + 3) / 4
+	if request.Base64Image != "" {
+		tokens += imageTokenEstimate
+	}
+	return tokens
+}
+
+// imageTokenEstimate is what an attached image is assumed to cost, roughly one
+// high-detail 512px tile plus the base charge on OpenAI-style vision models.
+const imageTokenEstimate = 255
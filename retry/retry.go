@@ -3,7 +3,10 @@ package retry
 import (
 	"context"
 	"errors"
+	"fmt"
 	"net"
+	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/avast/retry-go/v5"
@@ -31,6 +34,112 @@ func NewDefaultConfig() Config {
 
 type ErrorClassifier func(error) bool
 
+// HTTPError is a non-2xx answer from a provider that talks HTTP directly
+// rather than through the go-openai client. ShouldRetryHTTPError classifies it
+// by status code like an openai.RequestError.
+type HTTPError struct {
+	StatusCode int
+	Message    string
+	// RetryAfter is how long the server asked to wait before retrying, from
+	// its response headers (see ParseRetryAfter); 0 when it gave no hint.
+	RetryAfter time.Duration
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("status %d: %s", e.StatusCode, e.Message)
+}
+
+// Hint attaches a server's retry delay to an error from a client that doesn't
+// expose response headers in its errors (go-openai).
+type Hint struct {
+	Err        error
+	RetryAfter time.Duration
+}
+
+func (h *Hint) Error() string { return h.Err.Error() }
+func (h *Hint) Unwrap() error { return h.Err }
+
+// maxRetryAfter caps a server's hint: a quota resetting in an hour is better
+// reported as a failure than waited out.
+const maxRetryAfter = 5 * time.Minute
+
+// RetryAfter returns the delay the server asked for with err, or 0.
+func RetryAfter(err error) time.Duration {
+	var hint *Hint
+	if errors.As(err, &hint) {
+		return hint.RetryAfter
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.RetryAfter
+	}
+	return 0
+}
+
+// IsRateLimited reports whether err is a 429 Too Many Requests.
+func IsRateLimited(err error) bool {
+	return statusCode(err) == http.StatusTooManyRequests
+}
+
+// IsBadRequest reports whether err is a 400 Bad Request.
+func IsBadRequest(err error) bool {
+	return statusCode(err) == http.StatusBadRequest
+}
+
+func statusCode(err error) int {
+	var requestErr *openai.RequestError
+	if errors.As(err, &requestErr) {
+		return requestErr.HTTPStatusCode
+	}
+	var apiErr *openai.APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.HTTPStatusCode
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		return httpErr.StatusCode
+	}
+	return 0
+}
+
+// ParseRetryAfter reads how long to wait from a 429 or 503 response's headers:
+// Retry-After (seconds or an HTTP date) or retry-after-ms, else the latest of
+// the x-ratelimit-reset-* headers (OpenAI and friends send "1s", "6m0s" or
+// "20ms") whose quota is used up. It returns 0 when there is no usable hint.
+func ParseRetryAfter(header http.Header, now time.Time) time.Duration {
+	if value := header.Get("Retry-After-Ms"); value != "" {
+		if ms, err := strconv.ParseFloat(value, 64); err == nil && ms > 0 {
+			return time.Duration(ms * float64(time.Millisecond))
+		}
+	}
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+			return max(time.Duration(seconds*float64(time.Second)), 0)
+		}
+		if at, err := http.ParseTime(value); err == nil {
+			return max(at.Sub(now), 0)
+		}
+	}
+
+	var latest time.Duration
+	for _, quota := range []string{"requests", "tokens"} {
+		reset := header.Get("X-Ratelimit-Reset-" + quota)
+		if reset == "" {
+			continue
+		}
+		if remaining := header.Get("X-Ratelimit-Remaining-" + quota); remaining != "" && remaining != "0" {
+			continue
+		}
+		if d, err := time.ParseDuration(reset); err == nil {
+			latest = max(latest, d)
+		}
+	}
+	return latest
+}
+
+// Do runs fn until it succeeds, fails permanently or runs out of attempts.
+// Between attempts it waits as long as the failed one's server asked, when it
+// said (see RetryAfter), and otherwise backs off exponentially up to MaxDelay.
 func Do(ctx context.Context, cfg Config, fn func() error, shouldRetry ErrorClassifier) error {
 	if !cfg.Enabled {
 		return fn()
@@ -54,8 +163,17 @@ func Do(ctx context.Context, cfg Config, fn func() error, shouldRetry ErrorClass
 	return retry.New(
 		retry.Attempts(uint(cfg.MaxAttempts)),
 		retry.Delay(cfg.InitialDelay),
-		retry.MaxDelay(cfg.MaxDelay),
-		retry.DelayType(retry.BackOffDelay),
+		retry.DelayType(func(n uint, err error, config retry.DelayContext) time.Duration {
+			if after := RetryAfter(err); after > 0 {
+				log.Info().Msgf("Server asked to retry after %s", after)
+				return min(after, maxRetryAfter)
+			}
+			delay := retry.BackOffDelay(n, err, config)
+			if cfg.MaxDelay > 0 {
+				delay = min(delay, cfg.MaxDelay)
+			}
+			return delay
+		}),
 		retry.Context(ctx),
 		retry.OnRetry(func(n uint, err error) {
 			log.Info().Msgf("Retry attempt %d/%d after error: %v", n+1, cfg.MaxAttempts, err)
@@ -75,7 +193,7 @@ func ShouldRetryHTTPError(err error) bool {
 		case 401, 403:
 			log.Error().Msgf("Permanent API error (status %d): %s", apiErr.HTTPStatusCode, apiErr.Error())
 			return false
-		case 429, 500, 502, 503, 504:
+		case 429, 500, 502, 503, 504, 529:
 			log.Error().Msgf("Retryable API error (status %d): %s", apiErr.HTTPStatusCode, apiErr.Error())
 			return true
 		case 400, 404, 422:
@@ -84,6 +202,30 @@ func ShouldRetryHTTPError(err error) bool {
 		}
 	}
 
+	var openaiErr *openai.APIError
+	if errors.As(err, &openaiErr) {
+		switch openaiErr.HTTPStatusCode {
+		case 401, 403, 400, 404, 413, 422:
+			log.Error().Msgf("Permanent API error (status %d): %s", openaiErr.HTTPStatusCode, openaiErr.Message)
+			return false
+		case 408, 429, 500, 502, 503, 504, 529:
+			log.Error().Msgf("Retryable API error (status %d): %s", openaiErr.HTTPStatusCode, openaiErr.Message)
+			return true
+		}
+	}
+
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case 401, 403, 400, 404, 413, 422:
+			log.Error().Msgf("Permanent API error (status %d): %s", httpErr.StatusCode, httpErr.Message)
+			return false
+		case 408, 429, 500, 502, 503, 504, 529:
+			log.Error().Msgf("Retryable API error (status %d): %s", httpErr.StatusCode, httpErr.Message)
+			return true
+		}
+	}
+
 	var netErr net.Error
 	if errors.As(err, &netErr) && netErr.Timeout() {
 		return true
@@ -2,6 +2,7 @@ package retry
 
 import (
 	"context"
+	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"testing"
@@ -228,6 +229,7 @@ func TestShouldRetryHTTPError_RetryableErrors(t *testing.T) {
 		{502, true}, // Bad Gateway
 		{503, true}, // Service Unavailable
 		{504, true}, // Gateway Timeout
+		{529, true}, // Overloaded
 	}
 
 	for _, tt := range tests {
@@ -239,6 +241,27 @@ func TestShouldRetryHTTPError_RetryableErrors(t *testing.T) {
 	}
 }
 
+func TestShouldRetryHTTPError_HTTPError(t *testing.T) {
+	tests := []struct {
+		statusCode int
+		expected   bool
+	}{
+		{400, false},
+		{401, false},
+		{404, false},
+		{429, true},
+		{500, true},
+		{529, true}, // Anthropic: overloaded
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprint(tt.statusCode), func(t *testing.T) {
+			err := fmt.Errorf("llm: request failed: %w", &HTTPError{StatusCode: tt.statusCode, Message: "x"})
+			assert.Equal(t, tt.expected, ShouldRetryHTTPError(err))
+		})
+	}
+}
+
 func TestShouldRetryHTTPError_NilError(t *testing.T) {
 	result := ShouldRetryHTTPError(nil)
 	assert.False(t, result)
@@ -269,3 +292,54 @@ func TestNewDefaultConfig(t *testing.T) {
 	assert.Equal(t, 10*time.Second, cfg.MaxDelay)
 	assert.Equal(t, 2.0, cfg.BackoffMultiplier)
 }
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 15, 4, 5, 0, time.UTC)
+	tests := []struct {
+		name     string
+		header   http.Header
+		expected time.Duration
+	}{
+		{"no hint", http.Header{}, 0},
+		{"seconds", http.Header{"Retry-After": {"20"}}, 20 * time.Second},
+		{"http date", http.Header{"Retry-After": {now.Add(90 * time.Second).Format(http.TimeFormat)}}, 90 * time.Second},
+		{"date in the past", http.Header{"Retry-After": {now.Add(-time.Minute).Format(http.TimeFormat)}}, 0},
+		{"milliseconds first", http.Header{"Retry-After-Ms": {"250"}, "Retry-After": {"1"}}, 250 * time.Millisecond},
+		{"exhausted quota reset", http.Header{
+			"X-Ratelimit-Remaining-Requests": {"12"}, "X-Ratelimit-Reset-Requests": {"1s"},
+			"X-Ratelimit-Remaining-Tokens": {"0"}, "X-Ratelimit-Reset-Tokens": {"6m0s"},
+		}, 6 * time.Minute},
+		{"latest reset without remaining counts", http.Header{
+			"X-Ratelimit-Reset-Requests": {"20ms"}, "X-Ratelimit-Reset-Tokens": {"1.5s"},
+		}, 1500 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, ParseRetryAfter(tt.header, now))
+		})
+	}
+}
+
+func TestRetry_HonorsRetryAfterBeyondMaxDelay(t *testing.T) {
+	cfg := Config{Enabled: true, MaxAttempts: 2, InitialDelay: time.Millisecond, MaxDelay: 5 * time.Millisecond, BackoffMultiplier: 2.0}
+
+	var callTimes []time.Time
+	err := Do(context.Background(), cfg, func() error {
+		callTimes = append(callTimes, time.Now())
+		if len(callTimes) == 1 {
+			return &HTTPError{StatusCode: 429, Message: "slow down", RetryAfter: 150 * time.Millisecond}
+		}
+		return nil
+	}, ShouldRetryHTTPError)
+
+	require.NoError(t, err)
+	require.Len(t, callTimes, 2)
+	assert.GreaterOrEqual(t, callTimes[1].Sub(callTimes[0]), 150*time.Millisecond)
+}
+
+func TestShouldRetryHTTPError_APIError(t *testing.T) {
+	assert.True(t, ShouldRetryHTTPError(&openai.APIError{HTTPStatusCode: 429}))
+	assert.True(t, ShouldRetryHTTPError(&openai.APIError{HTTPStatusCode: 500}))
+	assert.False(t, ShouldRetryHTTPError(&openai.APIError{HTTPStatusCode: 401}))
+}
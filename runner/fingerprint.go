@@ -0,0 +1,270 @@
+package runner
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/fs"
+	"github.com/rs/zerolog/log"
+)
+
+// fingerprint is a step's effective definition, hashed per component so that a
+// rebuild can say what changed. It is stored next to the step's output and
+// compared on the next --incremental run.
+type fingerprint map[string]string
+
+func fingerprintPath(stepConfig config.Step) string {
+	return stepConfig.OutputFilename + ".fingerprint"
+}
+
+// cacheable reports whether a step's output is a pure function of what
+// computeFingerprint hashes; when it is not, the reason is returned. Shell
+// commands may read anything, write steps export outside the pipeline and are
+// cheap, and image paths are rendered per row, so their files are not tracked.
+func cacheable(stepConfig config.Step) (bool, string) {
+	switch {
+	case stepConfig.Type == config.ShellStepType:
+		return false, "shell steps always run"
+	case stepConfig.Type == config.WriteStepType:
+		return false, "write steps always run"
+	case stepConfig.Image != "":
+		return false, "attached images are not tracked"
+	}
+	return true, ""
+}
+
+// computeFingerprint hashes everything a step's output depends on: its own
+// settings, the files a read step loads, and the current output of every step
+// it reads from. Upstream outputs are hashed by content, so a rebuilt upstream
+// step that produced identical rows does not invalidate its dependents.
+func (r *Runner) computeFingerprint(stepConfig config.Step) (fingerprint, error) {
+	fp := fingerprint{}
+
+	components := map[string]interface{}{
+		"type":     stepConfig.Type,
+		"prompt":   []string{stepConfig.SystemPrompt, stepConfig.PromptTemplate()},
+		"model":    []interface{}{stepConfig.Model, modelSettings(stepConfig.ModelConfig)},
+		"schema":   stepConfig.JSONSchemaRaw,
+		"jq":       []interface{}{stepConfig.JQ, stepConfig.Collect, stepConfig.Limit, stepConfig.SourceFormat},
+		"rows":     []interface{}{stepConfig.Count, stepConfig.ForEach, stepConfig.From, stepConfig.OnError, stepConfig.MaxErrors},
+		"read":     []string{stepConfig.Read, stepConfig.Format},
+		"settings": []bool{r.cfg.ValidateResponse},
+	}
+	// optional parts are hashed only when a step uses them, so configs that
+	// run alike hash alike: `models: [m]` is the same step as `model: m`
+	if fallbacks := stepConfig.Fallbacks(); len(fallbacks) > 0 {
+		models := make([]interface{}, 0, len(fallbacks))
+		for _, fallback := range fallbacks {
+			models = append(models, []interface{}{fallback.Model, modelSettings(*fallback.ModelConfig)})
+		}
+		components["fallbacks"] = models
+	}
+	if stepConfig.KeepReasoning {
+		components["keepReasoning"] = true
+	}
+	if stepConfig.Repair {
+		components["repair"] = true
+	}
+	if stepConfig.JSONRepair {
+		components["jsonRepair"] = true
+	}
+	if stepConfig.User != nil {
+		user := stepConfig.User
+		components["conversation"] = []interface{}{
+			user.Model, modelSettings(user.ModelConfig), user.SystemPrompt, user.Prompt, stepConfig.MaxTurns, stepConfig.StopWhen,
+		}
+	}
+	for name, value := range components {
+		hash, err := hashJSON(value)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash %s: %w", name, err)
+		}
+		fp[name] = hash
+	}
+
+	if stepConfig.Type == config.ReadStepType {
+		files, err := fs.GlobFiles(stepConfig.Read)
+		if err != nil {
+			return nil, err
+		}
+		for _, path := range files {
+			hash, err := hashFile(path)
+			if err != nil {
+				return nil, err
+			}
+			fp["input:"+path] = hash
+		}
+	}
+
+	for _, name := range stepConfig.DependsOn {
+		upstream := r.cfg.GetStepByName(name)
+		if upstream == nil {
+			return nil, fmt.Errorf("unknown dependency '%s'", name)
+		}
+		hash, err := hashFile(upstream.OutputFilename)
+		if err != nil {
+			return nil, err
+		}
+		fp["upstream:"+name] = hash
+	}
+
+	return fp, nil
+}
+
+// modelSettings is the part of a model's settings that shapes its answers,
+// by YAML name. Where requests go to among replicas (endpoints), how fast
+// (rateLimit), with which credentials and headers, and how long the model
+// stays loaded don't change what it answers. Unset settings are left out, so
+// a step's hash only depends on the settings it uses.
+func modelSettings(modelConfig config.ModelConfig) map[string]interface{} {
+	settings := map[string]interface{}{}
+	set := func(name string, value interface{}, isSet bool) {
+		if isSet {
+			settings[name] = value
+		}
+	}
+	set("baseUrl", modelConfig.BaseURL, modelConfig.BaseURL != "")
+	set("temperature", modelConfig.Temperature, modelConfig.Temperature != nil)
+	set("maxTokens", modelConfig.MaxTokens, modelConfig.MaxTokens != nil)
+	set("topP", modelConfig.TopP, modelConfig.TopP != nil)
+	set("seed", modelConfig.Seed, modelConfig.Seed != nil)
+	set("stop", modelConfig.Stop, len(modelConfig.Stop) > 0)
+	set("presencePenalty", modelConfig.PresencePenalty, modelConfig.PresencePenalty != nil)
+	set("frequencyPenalty", modelConfig.FrequencyPenalty, modelConfig.FrequencyPenalty != nil)
+	set("reasoningEffort", modelConfig.ReasoningEffort, modelConfig.ReasoningEffort != "")
+	set("extraBody", modelConfig.ExtraBody, len(modelConfig.ExtraBody) > 0)
+	set("structuredOutput", modelConfig.StructuredOutput, modelConfig.StructuredOutput != "")
+	set("options", modelConfig.Options, len(modelConfig.Options) > 0)
+	set("think", modelConfig.Think, modelConfig.Think != nil)
+	return settings
+}
+
+// changedComponents lists, in sorted order, the components whose hash differs
+// between the stored and the current fingerprint (including ones only present
+// on one side).
+func changedComponents(stored, current fingerprint) []string {
+	var changed []string
+	for name, hash := range current {
+		if stored[name] != hash {
+			changed = append(changed, name)
+		}
+	}
+	for name := range stored {
+		if _, ok := current[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+// reuseOutput decides whether a step can be skipped under --incremental. It
+// returns the fingerprint to store once the step has run (nil when it is not
+// cacheable) and whether the existing output is still valid; every decision is
+// logged with its reason.
+func (r *Runner) reuseOutput(stepConfig config.Step) (fingerprint, bool, error) {
+	if ok, reason := cacheable(stepConfig); !ok {
+		logRebuild(stepConfig, reason)
+		return nil, false, nil
+	}
+
+	current, err := r.computeFingerprint(stepConfig)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to fingerprint step: %w", err)
+	}
+
+	stored, err := loadFingerprint(fingerprintPath(stepConfig))
+	if err != nil {
+		return nil, false, err
+	}
+	if stored == nil {
+		logRebuild(stepConfig, "no fingerprint from a previous run")
+		return current, false, nil
+	}
+
+	if changed := changedComponents(stored, current); len(changed) > 0 {
+		logRebuild(stepConfig, "changed: "+strings.Join(changed, ", "))
+		return current, false, nil
+	}
+
+	if _, err := os.Stat(stepConfig.OutputFilename); err != nil {
+		logRebuild(stepConfig, "output file is missing")
+		return current, false, nil
+	}
+
+	log.Info().Msgf("Reusing step '%s': definition and inputs unchanged", stepConfig.Name)
+	return current, true, nil
+}
+
+func logRebuild(stepConfig config.Step, reason string) {
+	log.Info().Msgf("Rebuilding step '%s': %s", stepConfig.Name, reason)
+}
+
+// loadFingerprint reads a stored fingerprint; a missing or unreadable one is
+// nil, which simply means the step is rebuilt.
+func loadFingerprint(path string) (fingerprint, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fingerprint: %w", err)
+	}
+
+	var fp fingerprint
+	if json.Unmarshal(data, &fp) != nil {
+		return nil, nil
+	}
+	return fp, nil
+}
+
+func saveFingerprint(path string, fp fingerprint) error {
+	data, err := json.MarshalIndent(fp, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode fingerprint: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0o644); err != nil {
+		return fmt.Errorf("failed to write fingerprint: %w", err)
+	}
+	return nil
+}
+
+// removeFingerprint drops a step's stored fingerprint before it runs, so an
+// interrupted run never leaves a half-written output that looks reusable.
+func removeFingerprint(path string) error {
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove stale fingerprint: %w", err)
+	}
+	return nil
+}
+
+func hashJSON(value interface{}) (string, error) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", fmt.Errorf("failed to open '%s': %w", path, err)
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", fmt.Errorf("failed to hash '%s': %w", path, err)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,31 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/llm"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChangedComponents(t *testing.T) {
+	stored := fingerprint{"prompt": "a", "model": "b", "upstream:docs": "c"}
+	current := fingerprint{"prompt": "a", "model": "x", "input:new.md": "d"}
+
+	assert.Equal(t, []string{"input:new.md", "model", "upstream:docs"}, changedComponents(stored, current))
+	assert.Empty(t, changedComponents(current, current))
+}
+
+func TestModelSettings(t *testing.T) {
+	temperature := 0.0
+	modelConfig := config.ModelConfig{ModelProvider: llm.ProviderOllama, ModelName: "m", Temperature: &temperature}
+	assert.Equal(t, map[string]interface{}{"temperature": &temperature}, modelSettings(modelConfig))
+
+	modelConfig.Endpoints = []config.Endpoint{{URL: "http://gpu-1:8000/v1"}}
+	modelConfig.RateLimit = &llm.RateLimit{RequestsPerMinute: 60}
+	modelConfig.KeepAlive = "10m"
+	modelConfig.Headers = map[string]string{"X-Team": "data"}
+	modelConfig.APIKeyEnv = "TEAM_KEY"
+	assert.Equal(t, map[string]interface{}{"temperature": &temperature}, modelSettings(modelConfig),
+		"settings that don't change the answers don't change the hash")
+}
@@ -0,0 +1,44 @@
+package runner
+
+import (
+	"github.com/mirpo/datamatic/config"
+)
+
+// buildGraph returns, for every step index, the indexes of the steps it must
+// wait for. Declared dependencies (step.DependsOn, set during preprocessing)
+// give the edges; shell steps are barriers, since their command may read or
+// write any file: a shell step waits for every earlier step, and every later
+// step waits for it.
+func buildGraph(steps []config.Step) [][]int {
+	index := make(map[string]int, len(steps))
+	for i, s := range steps {
+		index[s.Name] = i
+	}
+
+	deps := make([][]int, len(steps))
+	lastBarrier := -1
+	for i, s := range steps {
+		if s.Type == config.ShellStepType {
+			for j := range i {
+				deps[i] = append(deps[i], j)
+			}
+			lastBarrier = i
+			continue
+		}
+
+		seen := map[int]bool{}
+		if lastBarrier >= 0 {
+			seen[lastBarrier] = true
+			deps[i] = append(deps[i], lastBarrier)
+		}
+		for _, name := range s.DependsOn {
+			j, ok := index[name]
+			if !ok || j >= i || seen[j] {
+				continue
+			}
+			seen[j] = true
+			deps[i] = append(deps[i], j)
+		}
+	}
+	return deps
+}
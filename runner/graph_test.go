@@ -0,0 +1,36 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBuildGraph(t *testing.T) {
+	t.Run("declared dependencies become edges", func(t *testing.T) {
+		deps := buildGraph([]config.Step{
+			{Name: "docs", Type: config.ReadStepType},
+			{Name: "summary", Type: config.PromptStepType, DependsOn: []string{"docs"}},
+			{Name: "tags", Type: config.PromptStepType, DependsOn: []string{"docs"}},
+			{Name: "joined", Type: config.PromptStepType, DependsOn: []string{"summary", "tags"}},
+		})
+
+		assert.Empty(t, deps[0])
+		assert.Equal(t, []int{0}, deps[1])
+		assert.Equal(t, []int{0}, deps[2], "siblings of one source do not wait on each other")
+		assert.ElementsMatch(t, []int{1, 2}, deps[3])
+	})
+
+	t.Run("shell steps are barriers", func(t *testing.T) {
+		deps := buildGraph([]config.Step{
+			{Name: "a", Type: config.ReadStepType},
+			{Name: "b", Type: config.ReadStepType},
+			{Name: "sh", Type: config.ShellStepType},
+			{Name: "c", Type: config.ReadStepType},
+		})
+
+		assert.Equal(t, []int{0, 1}, deps[2], "a shell step waits for every earlier step")
+		assert.Equal(t, []int{2}, deps[3], "later steps wait for the shell step")
+	})
+}
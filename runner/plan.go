@@ -0,0 +1,143 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/step"
+)
+
+// Plan is a dry run: read and transform steps execute for real (they are free
+// and give later steps real rows), while prompt steps only render the requests
+// of their first `rows` rows and print them with their resolved iteration
+// counts. Conversation, shell and write steps are listed, not run. Problems (bad template
+// wiring, unreachable fields) are reported per row, and counted in the
+// returned error so a plan can gate CI.
+func (r *Runner) Plan(ctx context.Context, out io.Writer, rows int) error {
+	if err := r.PrepareOutputDirectory(); err != nil {
+		return err
+	}
+
+	problems := 0
+	for _, stepConfig := range r.cfg.Steps {
+		if err := ctx.Err(); err != nil {
+			return fmt.Errorf("plan cancelled: %w", err)
+		}
+
+		fmt.Fprintf(out, "step '%s' (%s)\n", stepConfig.Name, stepConfig.Type)
+
+		switch stepConfig.Type {
+		case config.ReadStepType, config.TransformStepType:
+			if missing := r.missingInputs(stepConfig); len(missing) > 0 {
+				fmt.Fprintf(out, "  not run: no output yet from %s\n", strings.Join(missing, ", "))
+				continue
+			}
+			if err := r.runStep(ctx, stepConfig); err != nil {
+				fmt.Fprintf(out, "  error: %v\n", err)
+				problems++
+				continue
+			}
+			fmt.Fprintf(out, "  ran: %s\n", stepConfig.OutputFilename)
+
+		case config.PromptStepType:
+			problems += r.planPrompt(out, stepConfig, rows)
+
+		case config.ConversationStepType:
+			r.printIterations(out, &stepConfig)
+			fmt.Fprintf(out, "  not run: up to %d turns between user model %s and %s\n",
+				stepConfig.MaxTurns, stepConfig.User.Model, stepConfig.Model)
+
+		case config.ShellStepType:
+			fmt.Fprintf(out, "  not run: %s\n", stepConfig.Run)
+
+		case config.WriteStepType:
+			fmt.Fprintf(out, "  not run: would write %s\n", stepConfig.OutputFilename)
+		}
+	}
+
+	if problems > 0 {
+		return fmt.Errorf("plan found %d problem(s)", problems)
+	}
+	return nil
+}
+
+// planPrompt prints a prompt step's iteration count and its first rendered
+// requests, returning how many rows failed to render.
+func (r *Runner) planPrompt(out io.Writer, stepConfig config.Step, rows int) int {
+	if r.printIterations(out, &stepConfig) {
+		rows = min(rows, stepConfig.ResolvedCount)
+	}
+
+	previews, placeholders, err := step.PreviewRequests(r.cfg, stepConfig, rows)
+	if err != nil {
+		fmt.Fprintf(out, "  error: %v\n", err)
+		return 1
+	}
+	if len(placeholders) > 0 {
+		fmt.Fprintf(out, "  placeholder values for: %s\n", strings.Join(placeholders, ", "))
+	}
+
+	problems := 0
+	for i, preview := range previews {
+		fmt.Fprintf(out, "  row %d:\n", i)
+		if preview.Err != nil {
+			fmt.Fprintf(out, "    error: %v\n", preview.Err)
+			problems++
+			continue
+		}
+
+		if preview.Request.SystemMessage != "" {
+			fmt.Fprintf(out, "    system:\n%s\n", indent(preview.Request.SystemMessage, "      "))
+		}
+		for _, message := range preview.Request.Messages {
+			fmt.Fprintf(out, "    %s:\n%s\n", message.Role, indent(message.Content, "      "))
+		}
+		fmt.Fprintf(out, "    prompt:\n%s\n", indent(preview.Request.UserMessage, "      "))
+
+		if preview.BodyErr != nil {
+			fmt.Fprintf(out, "    request body: unavailable (%v)\n", preview.BodyErr)
+			continue
+		}
+		fmt.Fprintf(out, "    request body:\n%s\n", indent(string(preview.Body), "      "))
+	}
+	return problems
+}
+
+// printIterations prints how many rows a step will produce, and reports
+// whether that is known yet.
+func (r *Runner) printIterations(out io.Writer, stepConfig *config.Step) bool {
+	if stepConfig.ForEach != "" && slices.Contains(r.missingInputs(*stepConfig), stepConfig.ForEach) {
+		fmt.Fprintf(out, "  iterations: ? (no output yet from %s)\n", stepConfig.ForEach)
+		return false
+	}
+	if err := r.resolveIterations(stepConfig); err != nil {
+		fmt.Fprintf(out, "  iterations: ? (%v)\n", err)
+		return false
+	}
+	fmt.Fprintf(out, "  iterations: %d\n", stepConfig.ResolvedCount)
+	return true
+}
+
+// missingInputs lists the steps a step reads from that have no output yet.
+func (r *Runner) missingInputs(stepConfig config.Step) []string {
+	var missing []string
+	for _, name := range stepConfig.DependsOn {
+		upstream := r.cfg.GetStepByName(name)
+		if upstream == nil {
+			continue
+		}
+		if _, err := os.Stat(upstream.OutputFilename); err != nil {
+			missing = append(missing, name)
+		}
+	}
+	return missing
+}
+
+func indent(text, prefix string) string {
+	return prefix + strings.ReplaceAll(text, "\n", "\n"+prefix)
+}
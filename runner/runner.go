@@ -3,9 +3,12 @@ package runner
 import (
 	"context"
 	"fmt"
+	"slices"
 
 	"github.com/mirpo/datamatic/config"
 	"github.com/mirpo/datamatic/fs"
+	"github.com/mirpo/datamatic/jsonl"
+	"github.com/mirpo/datamatic/llm"
 	"github.com/mirpo/datamatic/step"
 	"github.com/rs/zerolog/log"
 )
@@ -31,9 +34,10 @@ func (r *Runner) PrepareOutputDirectory() error {
 	return nil
 }
 
-// resolveIterations sets how many rows a prompt step produces: forEach source
-// row count, image-glob match count, explicit count, or the generator default.
-// This is the single place the iteration-source decision lives.
+// resolveIterations sets how many rows a prompt or conversation step produces:
+// forEach source row count, image-glob match count, explicit count, or the
+// generator default. This is the single place the iteration-source decision
+// lives.
 func (r *Runner) resolveIterations(step *config.Step) error {
 	switch {
 	case step.ForEach != "":
@@ -60,38 +64,228 @@ func (r *Runner) resolveIterations(step *config.Step) error {
 	return nil
 }
 
+// Run executes the workflow as a dependency graph: a step starts as soon as
+// every step it reads from has completed, with up to MaxParallelSteps steps in
+// flight. Ready steps start in config order, so with the default limit of 1 the
+// run is the same sequence as the config file. The first failure cancels the
+// steps still running and is returned once they have stopped. Steps outside the
+// --only/--from/--until selection never run; their existing outputs stand in.
 func (r *Runner) Run(ctx context.Context) error {
 	if err := r.PrepareOutputDirectory(); err != nil {
 		return err
 	}
 
-	for _, stepConfig := range r.cfg.Steps {
-		if err := ctx.Err(); err != nil {
-			return fmt.Errorf("run cancelled: %w", err)
+	if r.cfg.Meter == nil {
+		r.cfg.Meter = llm.NewMeter(r.cfg.Budget, r.cfg.Prices)
+	}
+	defer r.logUsage() // also after a failure: a budget stop is when it matters most
+
+	if r.cfg.RateLimiters == nil {
+		r.cfg.RateLimiters = llm.NewRateLimiters()
+	}
+
+	if r.cfg.Cache && r.cfg.ResponseCache == nil {
+		r.cfg.ResponseCache = llm.NewResponseCache(r.cfg.CacheDir)
+	}
+	defer r.logCacheStats()
+
+	if r.cfg.Replay != "" && r.cfg.Cassette == nil {
+		cassette, err := llm.LoadCassette(r.cfg.Replay)
+		if err != nil {
+			return err
 		}
+		log.Info().Msgf("Replaying %d recorded response(s) from %s", cassette.Len(), r.cfg.Replay)
+		r.cfg.Cassette = cassette
+	}
+	if r.cfg.Record != "" && r.cfg.Recorder == nil {
+		recorder, err := llm.NewRecorder(r.cfg.Record)
+		if err != nil {
+			return err
+		}
+		defer func() {
+			if err := recorder.Close(); err != nil {
+				log.Error().Err(err).Msgf("failed to close cassette %s", r.cfg.Record)
+				return
+			}
+			log.Info().Msgf("Recorded %d response(s) to %s", recorder.Entries(), r.cfg.Record)
+		}()
+		r.cfg.Recorder = recorder
+	}
+
+	steps := r.cfg.Steps
+	deps := buildGraph(steps)
 
-		log.Info().Msgf("Starting step: '%s' (type: '%s')", stepConfig.Name, stepConfig.Type)
+	selected, err := selectSteps(r.cfg)
+	if err != nil {
+		return err
+	}
+	if err := checkSkippedInputs(r.cfg, selected); err != nil {
+		return err
+	}
 
-		if stepConfig.Type == config.PromptStepType {
-			if err := r.resolveIterations(&stepConfig); err != nil {
-				return fmt.Errorf("failed to resolve iterations for step '%s': %w", stepConfig.Name, err)
+	waiting := make([]int, len(steps)) // unfinished dependencies per step
+	dependents := make([][]int, len(steps))
+	for i, ds := range deps {
+		for _, d := range ds {
+			if !selected[d] {
+				continue // not selected: satisfied by its existing output
 			}
+			waiting[i]++
+			dependents[d] = append(dependents[d], i)
 		}
+	}
 
-		runner, err := step.NewStepRunner(stepConfig)
-		if err != nil {
-			log.Error().Err(err).Msg("failed to create step runner")
-			return err
+	var ready []int
+	for i := range steps {
+		if !selected[i] {
+			log.Info().Msgf("Skipping step '%s': not selected", steps[i].Name)
+			continue
+		}
+		if waiting[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+
+	limit := r.cfg.MaxParallelSteps
+	if limit < 1 {
+		limit = 1
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		index int
+		err   error
+	}
+	done := make(chan result)
+	running := 0
+	var runErr error
+
+	for {
+		for runErr == nil && running < limit && len(ready) > 0 {
+			if err := ctx.Err(); err != nil {
+				runErr = fmt.Errorf("run cancelled: %w", err)
+				break
+			}
+
+			next := ready[0]
+			ready = ready[1:]
+			running++
+			go func() {
+				done <- result{index: next, err: r.runStep(ctx, steps[next])}
+			}()
 		}
 
-		err = runner.Run(ctx, r.cfg, stepConfig, r.cfg.OutputFolder)
+		if running == 0 {
+			break
+		}
+
+		res := <-done
+		running--
+		if res.err != nil {
+			if runErr == nil {
+				runErr = res.err
+				cancel() // stop the steps still in flight
+			}
+			continue
+		}
+
+		for _, d := range dependents[res.index] {
+			waiting[d]--
+			if waiting[d] == 0 && selected[d] {
+				ready = insertSorted(ready, d)
+			}
+		}
+	}
+
+	return runErr
+}
+
+// runStep executes a single step; stepConfig is a copy, so resolving its
+// iterations never races with other steps reading the shared config.
+func (r *Runner) runStep(ctx context.Context, stepConfig config.Step) error {
+	log.Info().Msgf("Starting step: '%s' (type: '%s')", stepConfig.Name, stepConfig.Type)
+
+	if stepConfig.Type == config.PromptStepType || stepConfig.Type == config.ConversationStepType {
+		if err := r.resolveIterations(&stepConfig); err != nil {
+			return fmt.Errorf("failed to resolve iterations for step '%s': %w", stepConfig.Name, err)
+		}
+
+		if r.cfg.Resume {
+			complete, err := outputComplete(stepConfig)
+			if err != nil {
+				return fmt.Errorf("step '%s': %w", stepConfig.Name, err)
+			}
+			if complete {
+				return nil
+			}
+		}
+	}
+
+	var fp fingerprint
+	if r.cfg.Incremental {
+		current, reuse, err := r.reuseOutput(stepConfig)
 		if err != nil {
-			log.Error().Err(err).Msgf("step '%s' failed", stepConfig.Name)
 			return fmt.Errorf("step '%s': %w", stepConfig.Name, err)
 		}
+		if reuse {
+			return nil
+		}
+		if err := removeFingerprint(fingerprintPath(stepConfig)); err != nil {
+			return fmt.Errorf("step '%s': %w", stepConfig.Name, err)
+		}
+		fp = current
+	}
 
-		log.Info().Msgf("Completed step: %s", stepConfig.Name)
+	runner, err := step.NewStepRunner(stepConfig)
+	if err != nil {
+		log.Error().Err(err).Msg("failed to create step runner")
+		return err
 	}
 
+	if err := runner.Run(ctx, r.cfg, stepConfig, r.cfg.OutputFolder); err != nil {
+		log.Error().Err(err).Msgf("step '%s' failed", stepConfig.Name)
+		return fmt.Errorf("step '%s': %w", stepConfig.Name, err)
+	}
+
+	if fp != nil {
+		if err := saveFingerprint(fingerprintPath(stepConfig), fp); err != nil {
+			return fmt.Errorf("step '%s': %w", stepConfig.Name, err)
+		}
+	}
+
+	log.Info().Msgf("Completed step: %s", stepConfig.Name)
 	return nil
 }
+
+// outputComplete reports whether a resumed prompt or conversation step
+// already has all of its rows on disk, in which case it is skipped entirely.
+func outputComplete(stepConfig config.Step) (bool, error) {
+	next, _, err := jsonl.ValidPrefix(stepConfig.OutputFilename)
+	if err != nil {
+		return false, fmt.Errorf("failed to inspect existing output: %w", err)
+	}
+	if next < stepConfig.ResolvedCount {
+		return false, nil
+	}
+
+	if next > stepConfig.ResolvedCount {
+		log.Warn().Msgf("step '%s' has %d rows on disk but expects %d; keeping them — rerun without --resume to regenerate",
+			stepConfig.Name, next, stepConfig.ResolvedCount)
+	}
+	log.Info().Msgf("Skipping step '%s': output already covers all %d rows", stepConfig.Name, stepConfig.ResolvedCount)
+	return true, nil
+}
+
+// insertSorted adds a step index to the ready queue keeping it in config order.
+func insertSorted(queue []int, index int) []int {
+	pos := len(queue)
+	for i, q := range queue {
+		if q > index {
+			pos = i
+			break
+		}
+	}
+	return slices.Insert(queue, pos, index)
+}
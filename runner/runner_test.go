@@ -6,10 +6,12 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/mirpo/datamatic/config"
 	"github.com/mirpo/datamatic/fs"
 	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/llm"
 	"github.com/mirpo/datamatic/runner"
 	"github.com/mirpo/datamatic/utils"
 	"github.com/stretchr/testify/assert"
@@ -240,3 +242,327 @@ func TestRun_PerRowWritePipeline(t *testing.T) {
 		assert.Equal(t, want, string(data))
 	}
 }
+
+// parallelSiblingsConfig is a read step feeding two prompt steps that do not
+// depend on each other; each prompt step generates its rows one at a time.
+func parallelSiblingsConfig(t *testing.T, srvURL string) *config.Config {
+	t.Helper()
+	srcDir := t.TempDir()
+	leads := filepath.Join(srcDir, "leads.csv")
+	require.NoError(t, os.WriteFile(leads, []byte("company\nAcme\nGlobex\n"), 0o644))
+
+	cfg := config.NewConfig()
+	cfg.OutputFolder = t.TempDir()
+	cfg.Version = "1.0"
+	cfg.Steps = []config.Step{
+		{Name: "leads", Read: leads},
+		{
+			Name: "industry", Model: "ollama:test-model", ForEach: "leads",
+			Prompt:      "Industry of {{.item.company}}?",
+			ModelConfig: config.ModelConfig{BaseURL: srvURL},
+		},
+		{
+			Name: "slogan", Model: "ollama:test-model", ForEach: "leads",
+			Prompt:      "Slogan for {{.item.company}}?",
+			ModelConfig: config.ModelConfig{BaseURL: srvURL},
+		},
+		{Name: "report", From: "industry", Write: "report.json"},
+	}
+	require.NoError(t, utils.PreprocessConfig(cfg))
+	require.NoError(t, cfg.Validate())
+	return cfg
+}
+
+func TestRun_IndependentStepsRunConcurrently(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	srv.Delay = 50 * time.Millisecond
+
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	cfg.MaxParallelSteps = 2
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+
+	assert.Equal(t, 4, srv.CallCount())
+	assert.Equal(t, 2, srv.MaxConcurrent(), "both sibling prompt steps are in flight at once")
+	assert.Len(t, readOutputLines(t, cfg.Steps[1].OutputFilename), 2)
+	assert.Len(t, readOutputLines(t, cfg.Steps[2].OutputFilename), 2)
+	assert.FileExists(t, cfg.Steps[3].OutputFilename, "the write step ran after its source")
+}
+
+func TestRun_DefaultRunsStepsOneAtATime(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	srv.Delay = 20 * time.Millisecond
+
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+
+	assert.Equal(t, 1, srv.MaxConcurrent(), "max-parallel-steps defaults to 1")
+}
+
+func TestRun_FailingStepStopsTheRun(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	cfg.MaxParallelSteps = 2
+	cfg.Steps[1].ModelConfig.BaseURL = "http://127.0.0.1:1" // nothing listens here
+	cfg.RetryConfig.Enabled = false
+
+	err := runner.NewRunner(cfg).Run(context.Background())
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "industry")
+	assert.NoFileExists(t, cfg.Steps[3].OutputFilename, "a step whose source failed never starts")
+}
+
+func TestRun_ResumeSkipsCompleteStepsAndFillsPartialOnes(t *testing.T) {
+	cfg := parallelSiblingsConfig(t, llmtest.NewServer(t, "first run").URL)
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+
+	// simulate a crash in "slogan" after its first row
+	slogan := cfg.Steps[2].OutputFilename
+	first := readOutputLines(t, slogan)[0]
+	require.NoError(t, os.WriteFile(slogan, []byte(first+"\n"), 0o644))
+
+	srv := llmtest.NewServer(t, "resumed")
+	for i := range cfg.Steps {
+		cfg.Steps[i].ModelConfig.BaseURL = srv.URL
+	}
+	cfg.Resume = true
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+
+	assert.Equal(t, 1, srv.CallCount(), "only the missing slogan row is generated")
+	lines := readOutputLines(t, slogan)
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "first run")
+	assert.Contains(t, lines[1], "resumed")
+}
+
+func TestRun_IncrementalRebuildsOnlyChangedSteps(t *testing.T) {
+	srv := llmtest.NewServer(t)
+	srv.EchoPrompt = true
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	cfg.Incremental = true
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+	require.Equal(t, 4, srv.CallCount())
+
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+	assert.Equal(t, 4, srv.CallCount(), "an unchanged workflow reuses every prompt step")
+
+	cfg.Steps[2].Prompt = "Catchy slogan for {{.item.company}}?"
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+	assert.Equal(t, 6, srv.CallCount(), "only the edited step is regenerated")
+	assert.Contains(t, readOutputLines(t, cfg.Steps[2].OutputFilename)[0], "Catchy slogan")
+	assert.Contains(t, readOutputLines(t, cfg.Steps[1].OutputFilename)[0], "Industry of")
+}
+
+func TestRun_OnlyRunsTheSelectedStep(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+	require.Equal(t, 4, srv.CallCount())
+
+	cfg.OnlyStep = "slogan"
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+
+	assert.Equal(t, 6, srv.CallCount(), "only slogan's two rows are generated again")
+}
+
+func TestRun_UntilStopsAfterTheStep(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	cfg.UntilStep = "industry"
+
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+
+	assert.FileExists(t, cfg.Steps[1].OutputFilename)
+	assert.NoFileExists(t, cfg.Steps[2].OutputFilename, "steps after --until do not run")
+	assert.NoFileExists(t, cfg.Steps[3].OutputFilename)
+}
+
+func TestRun_SkippedInputWithoutOutputFails(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	cfg.FromStep = "industry"
+
+	err := runner.NewRunner(cfg).Run(context.Background())
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "'leads'", "the missing input is named instead of silently regenerated")
+	assert.Equal(t, 0, srv.CallCount())
+}
+
+func TestPlan_RendersPromptsWithoutCallingModels(t *testing.T) {
+	srv := llmtest.NewServer(t, "never used")
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	cfg.Steps = append(cfg.Steps, config.Step{
+		Name: "pitch", Type: config.PromptStepType, ForEach: "industry",
+		Prompt:         "Pitch for {{.item}}",
+		Model:          "ollama:test-model",
+		OutputFilename: filepath.Join(cfg.OutputFolder, "pitch.jsonl"),
+		ModelConfig:    cfg.Steps[1].ModelConfig,
+		DependsOn:      []string{"industry"},
+	})
+
+	var out strings.Builder
+	require.NoError(t, runner.NewRunner(cfg).Plan(context.Background(), &out, 1))
+	plan := out.String()
+
+	assert.Equal(t, 0, srv.CallCount())
+	assert.FileExists(t, cfg.Steps[0].OutputFilename, "read steps run for real")
+	assert.Contains(t, plan, "iterations: 2")
+	assert.Contains(t, plan, "Industry of Acme?", "prompts render from real upstream rows")
+	assert.NotContains(t, plan, "Globex", "only the requested number of rows is shown")
+	assert.Contains(t, plan, `"model": "test-model"`, "the request body is shown")
+	assert.Contains(t, plan, "Pitch for <industry>", "missing upstream rows become placeholders")
+	assert.Contains(t, plan, "iterations: ? (no output yet from industry)")
+	assert.NoFileExists(t, cfg.Steps[1].OutputFilename, "prompt steps do not run")
+}
+
+func TestPlan_ReportsBadWiring(t *testing.T) {
+	cfg := parallelSiblingsConfig(t, "http://127.0.0.1:1")
+	cfg.Steps[1].Prompt = "Industry of {{.item.missing_column}}?"
+
+	var out strings.Builder
+	err := runner.NewRunner(cfg).Plan(context.Background(), &out, 2)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "2 problem(s)")
+	assert.Contains(t, out.String(), "missing_column")
+}
+
+func TestRun_SkippedRowsKeepDownstreamAligned(t *testing.T) {
+	srv := llmtest.NewServer(t)
+	srv.EchoPrompt = true
+
+	srcDir := t.TempDir()
+	leads := filepath.Join(srcDir, "leads.jsonl")
+	// the middle lead has no company, so its classify prompt cannot render
+	require.NoError(t, os.WriteFile(leads, []byte(`{"company":"Acme"}`+"\n"+`{"name":"?"}`+"\n"+`{"company":"Initech"}`+"\n"), 0o644))
+
+	cfg := config.NewConfig()
+	cfg.OutputFolder = t.TempDir()
+	cfg.Version = "1.0"
+	cfg.Steps = []config.Step{
+		{Name: "leads", Read: leads},
+		{
+			Name: "classify", Model: "ollama:test-model", ForEach: "leads", OnError: config.OnErrorSkip,
+			Prompt:      "Industry of {{.item.company}}?",
+			ModelConfig: config.ModelConfig{BaseURL: srv.URL},
+		},
+		{
+			Name: "pitch", Model: "ollama:test-model", ForEach: "classify",
+			Prompt:      "Pitch {{.leads.company}}: {{.item}}",
+			ModelConfig: config.ModelConfig{BaseURL: srv.URL},
+		},
+	}
+	require.NoError(t, utils.PreprocessConfig(cfg))
+	require.NoError(t, cfg.Validate())
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+
+	rejects := readOutputLines(t, filepath.Join(cfg.OutputFolder, "classify.rejects.jsonl"))
+	require.Len(t, rejects, 1)
+	assert.Contains(t, rejects[0], `"row":1`)
+
+	pitches := readOutputLines(t, cfg.Steps[2].OutputFilename)
+	require.Len(t, pitches, 2)
+	assert.Contains(t, pitches[0], "Pitch Acme: Industry of Acme?")
+	assert.Contains(t, pitches[1], "Pitch Initech: Industry of Initech?", "the row after the gap still reads its own lead")
+}
+
+func TestRun_BudgetStopsTheRunCleanly(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	srv.PromptTokens, srv.CompletionTokens = 40, 10
+
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	// industry's two rows use 100; slogan's first prompt (~5 estimated
+	// tokens) would pass the limit, so it is never sent
+	cfg.Budget.MaxTokens = 102
+	cfg.MaxParallelSteps = 1
+	cfg.Steps[2].OnError = config.OnErrorSkip
+
+	err := runner.NewRunner(cfg).Run(context.Background())
+
+	require.ErrorIs(t, err, llm.ErrBudgetExceeded)
+	assert.Equal(t, 2, srv.CallCount())
+	lines := readOutputLines(t, cfg.Steps[1].OutputFilename)
+	require.Len(t, lines, 2, "rows generated before the stop are kept")
+	assert.Contains(t, lines[0], `"usage":{"promptTokens":40,"completionTokens":10}`)
+	assert.Empty(t, readOutputLines(t, filepath.Join(cfg.OutputFolder, "slogan.rejects.jsonl")),
+		"a budget stop is never skipped as a bad row")
+	_, total := cfg.Meter.Summary()
+	assert.Equal(t, 100, total.Usage.Total())
+}
+
+func TestRun_CachedRerunMakesNoRequests(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	cacheDir := t.TempDir()
+
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	cfg.Cache, cfg.CacheDir = true, cacheDir
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+	require.Equal(t, 4, srv.CallCount())
+	first := readOutputLines(t, cfg.Steps[1].OutputFilename)
+
+	rerun := parallelSiblingsConfig(t, srv.URL)
+	rerun.Cache, rerun.CacheDir = true, cacheDir
+	require.NoError(t, runner.NewRunner(rerun).Run(context.Background()))
+
+	assert.Equal(t, 4, srv.CallCount(), "every response came from the cache")
+	assert.Len(t, readOutputLines(t, rerun.Steps[1].OutputFilename), len(first))
+	assert.Equal(t, []llm.CacheStats{{Step: "industry", Hits: 2}, {Step: "slogan", Hits: 2}},
+		rerun.ResponseCache.Stats())
+}
+
+func TestRun_ReplayAnswersFromTheCassette(t *testing.T) {
+	srv := llmtest.NewServer(t)
+	srv.EchoPrompt = true
+	cassette := filepath.Join(t.TempDir(), "cassette.jsonl")
+
+	cfg := parallelSiblingsConfig(t, srv.URL)
+	cfg.Record = cassette
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+	require.Equal(t, 4, srv.CallCount())
+
+	replay := parallelSiblingsConfig(t, srv.URL)
+	replay.Replay = cassette
+	require.NoError(t, runner.NewRunner(replay).Run(context.Background()))
+	assert.Equal(t, 4, srv.CallCount(), "a replayed run calls no model")
+	assert.Contains(t, readOutputLines(t, replay.Steps[2].OutputFilename)[1], `"response":"Slogan for Globex?"`)
+
+	changed := parallelSiblingsConfig(t, srv.URL)
+	changed.Steps[2].Prompt = "Motto for {{.item.company}}?"
+	changed.Replay = cassette
+	err := runner.NewRunner(changed).Run(context.Background())
+	require.ErrorIs(t, err, llm.ErrNotRecorded)
+	assert.Contains(t, err.Error(), "- user: Slogan for Acme?\n+ user: Motto for Acme?")
+	assert.Equal(t, 4, srv.CallCount())
+}
+
+func TestRun_MockProviderRunsThePipelineWithoutAServer(t *testing.T) {
+	// generate -> fan out with jq -> describe each, and write the generated rows; all local
+	out := filepath.Join(t.TempDir(), "topics.csv")
+
+	cfg := config.NewConfig()
+	cfg.OutputFolder = t.TempDir()
+	cfg.Version = "1.0"
+	cfg.Steps = []config.Step{
+		{
+			Name: "seed", Model: "mock:test", Count: 2,
+			Prompt:        "Pick a topic with tags",
+			JSONSchemaRaw: `{"type":"object","properties":{"topic":{"type":"string"},"tags":{"type":"array","items":{"type":"string"},"minItems":2,"maxItems":2}},"required":["topic","tags"],"additionalProperties":false}`,
+		},
+		{Name: "tags", From: "seed", JQ: ".tags[] | {tag: .}"},
+		{Name: "describe", Model: "mock:test", ForEach: "tags", Prompt: "Describe {{.item.tag}}"},
+		{Name: "report", From: "seed", Write: out},
+	}
+	require.NoError(t, utils.PreprocessConfig(cfg))
+	require.NoError(t, cfg.Validate())
+	require.NoError(t, runner.NewRunner(cfg).Run(context.Background()))
+
+	assert.Len(t, readOutputLines(t, cfg.Steps[1].OutputFilename), 4)
+	described := readOutputLines(t, cfg.Steps[2].OutputFilename)
+	require.Len(t, described, 4)
+	assert.Contains(t, described[0], `"response":"Describe tags `, "without a schema the prompt is echoed")
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "topic")
+}
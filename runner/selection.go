@@ -0,0 +1,86 @@
+package runner
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/mirpo/datamatic/config"
+)
+
+// selectSteps marks which steps run for the --only/--from/--until flags; with
+// none set every step is selected. --from and --until bound an inclusive range
+// in config order, --only selects a single step.
+func selectSteps(cfg *config.Config) ([]bool, error) {
+	steps := cfg.Steps
+	selected := make([]bool, len(steps))
+
+	indexOf := func(flag, name string) (int, error) {
+		if i := stepIndex(steps, name); i >= 0 {
+			return i, nil
+		}
+		return 0, fmt.Errorf("--%s references unknown step '%s'", flag, name)
+	}
+
+	first, last := 0, len(steps)-1
+	if cfg.OnlyStep != "" {
+		i, err := indexOf("only", cfg.OnlyStep)
+		if err != nil {
+			return nil, err
+		}
+		first, last = i, i
+	}
+	if cfg.FromStep != "" {
+		i, err := indexOf("from", cfg.FromStep)
+		if err != nil {
+			return nil, err
+		}
+		first = i
+	}
+	if cfg.UntilStep != "" {
+		i, err := indexOf("until", cfg.UntilStep)
+		if err != nil {
+			return nil, err
+		}
+		last = i
+	}
+	if first > last {
+		return nil, fmt.Errorf("--from step '%s' comes after --until step '%s'", cfg.FromStep, cfg.UntilStep)
+	}
+
+	for i := first; i <= last; i++ {
+		selected[i] = true
+	}
+	return selected, nil
+}
+
+// checkSkippedInputs makes sure every step a selected step reads from is either
+// selected too or already has its output on disk: a skipped step is never
+// regenerated behind the user's back.
+func checkSkippedInputs(cfg *config.Config, selected []bool) error {
+	for i, s := range cfg.Steps {
+		if !selected[i] {
+			continue
+		}
+		for _, name := range s.DependsOn {
+			j := stepIndex(cfg.Steps, name)
+			if j < 0 || selected[j] {
+				continue
+			}
+			path := cfg.Steps[j].OutputFilename
+			if _, err := os.Stat(path); err != nil {
+				return fmt.Errorf("step '%s' reads from '%s', which is not selected and has no output at '%s': run it first or widen the selection",
+					s.Name, name, path)
+			}
+		}
+	}
+	return nil
+}
+
+func stepIndex(steps []config.Step, name string) int {
+	for i, s := range steps {
+		if s.Name == name {
+			return i
+		}
+	}
+	return -1
+}
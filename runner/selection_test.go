@@ -0,0 +1,53 @@
+package runner
+
+import (
+	"testing"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectSteps(t *testing.T) {
+	newCfg := func() *config.Config {
+		cfg := config.NewConfig()
+		cfg.Steps = []config.Step{{Name: "a"}, {Name: "b"}, {Name: "c"}, {Name: "d"}}
+		return cfg
+	}
+
+	t.Run("everything by default", func(t *testing.T) {
+		selected, err := selectSteps(newCfg())
+		require.NoError(t, err)
+		assert.Equal(t, []bool{true, true, true, true}, selected)
+	})
+
+	t.Run("from and until bound an inclusive range", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.FromStep, cfg.UntilStep = "b", "c"
+		selected, err := selectSteps(cfg)
+		require.NoError(t, err)
+		assert.Equal(t, []bool{false, true, true, false}, selected)
+	})
+
+	t.Run("only selects one step", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.OnlyStep = "c"
+		selected, err := selectSteps(cfg)
+		require.NoError(t, err)
+		assert.Equal(t, []bool{false, false, true, false}, selected)
+	})
+
+	t.Run("unknown step", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.FromStep = "z"
+		_, err := selectSteps(cfg)
+		assert.ErrorContains(t, err, "--from references unknown step 'z'")
+	})
+
+	t.Run("inverted range", func(t *testing.T) {
+		cfg := newCfg()
+		cfg.FromStep, cfg.UntilStep = "c", "a"
+		_, err := selectSteps(cfg)
+		assert.ErrorContains(t, err, "comes after")
+	})
+}
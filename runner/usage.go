@@ -0,0 +1,43 @@
+package runner
+
+import (
+	"fmt"
+
+	"github.com/mirpo/datamatic/llm"
+	"github.com/rs/zerolog/log"
+)
+
+// logUsage prints the token and cost summary of the run: one line per prompt
+// step that sent requests, then the total. Cost appears only where the price
+// table covers the model.
+func (r *Runner) logUsage() {
+	steps, total := r.cfg.Meter.Summary()
+	if total.Requests == 0 {
+		return
+	}
+
+	for _, s := range steps {
+		log.Info().Msgf("Usage: step '%s': %s", s.Step, describeUsage(s))
+	}
+	log.Info().Msgf("Usage: run total: %s", describeUsage(total))
+}
+
+func describeUsage(s llm.StepUsage) string {
+	text := fmt.Sprintf("%d request(s), %d prompt + %d completion = %d tokens",
+		s.Requests, s.Usage.PromptTokens, s.Usage.CompletionTokens, s.Usage.Total())
+	if s.Priced {
+		return text + fmt.Sprintf(", $%.4f", s.Cost)
+	}
+	return text + ", cost unknown (no price)"
+}
+
+// logCacheStats prints how many requests of each prompt step the response
+// cache answered.
+func (r *Runner) logCacheStats() {
+	if r.cfg.ResponseCache == nil {
+		return
+	}
+	for _, s := range r.cfg.ResponseCache.Stats() {
+		log.Info().Msgf("Cache: step '%s': %d hit(s), %d miss(es)", s.Step, s.Hits, s.Misses)
+	}
+}
@@ -0,0 +1,114 @@
+package step
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/mirpo/datamatic/llm"
+	"github.com/mirpo/datamatic/retry"
+	"github.com/rs/zerolog/log"
+)
+
+// adaptiveLimit is the number of rows a prompt step has in flight, adjusted
+// like TCP's congestion window (AIMD): halved when the provider answers 429,
+// then grown back by about one row per limit's worth of successful requests,
+// up to the configured concurrency. Retries alone would keep all rows hitting
+// the quota at once.
+type adaptiveLimit struct {
+	step    string
+	ceiling int
+
+	mu        sync.Mutex
+	limit     float64
+	inFlight  int
+	decreased time.Time     // when the limit was last cut
+	wake      chan struct{} // closed and replaced whenever a row may start
+}
+
+func newAdaptiveLimit(step string, concurrency int) *adaptiveLimit {
+	return &adaptiveLimit{step: step, ceiling: concurrency, limit: float64(concurrency), wake: make(chan struct{})}
+}
+
+// acquire waits until the step may start another row.
+func (a *adaptiveLimit) acquire(ctx context.Context) error {
+	for {
+		a.mu.Lock()
+		if a.inFlight < int(a.limit) {
+			a.inFlight++
+			a.mu.Unlock()
+			return nil
+		}
+		wake := a.wake
+		a.mu.Unlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wake:
+		}
+	}
+}
+
+func (a *adaptiveLimit) release() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inFlight--
+	a.broadcast()
+}
+
+// succeeded grows the limit additively after a request went through.
+func (a *adaptiveLimit) succeeded() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.limit >= float64(a.ceiling) {
+		return
+	}
+	before := int(a.limit)
+	a.limit = min(a.limit+1/a.limit, float64(a.ceiling))
+	if int(a.limit) > before {
+		log.Debug().Msgf("step '%s': concurrency back up to %d", a.step, int(a.limit))
+		a.broadcast()
+	}
+}
+
+// rateLimited halves the limit after a 429 to a request sent at start. The
+// other rows that were already in flight then are likely to get one too; they
+// belong to the same overload and don't cut it again.
+func (a *adaptiveLimit) rateLimited(start time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if start.Before(a.decreased) || a.limit <= 1 {
+		return
+	}
+	a.limit = max(a.limit/2, 1)
+	a.decreased = time.Now()
+	log.Warn().Msgf("step '%s': rate limited, reducing concurrency to %d", a.step, int(a.limit))
+}
+
+func (a *adaptiveLimit) broadcast() {
+	close(a.wake)
+	a.wake = make(chan struct{})
+}
+
+// wrap reports the outcome of every request the provider sends to the limit.
+func (a *adaptiveLimit) wrap(provider llm.Provider) llm.Provider {
+	return &adaptiveProvider{provider: provider, limit: a}
+}
+
+type adaptiveProvider struct {
+	provider llm.Provider
+	limit    *adaptiveLimit
+}
+
+func (p *adaptiveProvider) Generate(ctx context.Context, request llm.GenerateRequest) (*llm.GenerateResponse, error) {
+	start := time.Now()
+	resp, err := p.provider.Generate(ctx, request)
+	switch {
+	case err == nil:
+		p.limit.succeeded()
+	case retry.IsRateLimited(err):
+		p.limit.rateLimited(start)
+	}
+	return resp, err
+}
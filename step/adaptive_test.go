@@ -0,0 +1,52 @@
+package step
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveLimit_HalvesOnRateLimitAndGrowsBack(t *testing.T) {
+	a := newAdaptiveLimit("gen", 8)
+
+	a.rateLimited(time.Now())
+	assert.Equal(t, 4.0, a.limit)
+
+	for range 5 { // about a limit's worth of successes adds a row
+		a.succeeded()
+	}
+	assert.Equal(t, 5, int(a.limit))
+
+	for range 100 {
+		a.succeeded()
+	}
+	assert.Equal(t, 8.0, a.limit, "never past the configured concurrency")
+}
+
+func TestAdaptiveLimit_OneCutPerOverload(t *testing.T) {
+	a := newAdaptiveLimit("gen", 8)
+	sent := time.Now()
+
+	a.rateLimited(sent)
+	a.rateLimited(sent) // a row that was already in flight
+	assert.Equal(t, 4.0, a.limit)
+
+	a.rateLimited(time.Now())
+	assert.Equal(t, 2.0, a.limit)
+}
+
+func TestAdaptiveLimit_WaitsForAFreeSlot(t *testing.T) {
+	a := newAdaptiveLimit("gen", 2)
+	a.rateLimited(time.Now()) // down to 1
+	require.NoError(t, a.acquire(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, a.acquire(ctx), context.DeadlineExceeded)
+
+	a.release()
+	assert.NoError(t, a.acquire(context.Background()))
+}
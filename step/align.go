@@ -0,0 +1,103 @@
+package step
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/jsonl"
+)
+
+// sourceLines returns, for each of a prompt step's first `total` rows, the line
+// of ref that row reads. Rows normally line up by index: row i of a forEach
+// step comes from row i of its source, and so on up the chain. A step with
+// onError: skip breaks that — its output has gaps — so when ref is reached
+// through such a step, each row's index is mapped back hop by hop using the
+// row index recorded on every line of the gapped output. Preprocessing
+// rejects any other way of reading across a gap (validateAlignment), so rows
+// read by index always line up.
+func sourceLines(cfg *config.Config, step config.Step, ref config.Step, total int) ([]string, error) {
+	chain, ok := forEachChain(cfg, step, ref.Name)
+	if !ok || !hasGaps(chain) {
+		return readAllLines(ref.OutputFilename, total)
+	}
+
+	// index[j]: line of chain[k] that row j reads, advanced one hop at a time
+	index := make([]int, total)
+	for j := range index {
+		index[j] = j
+	}
+	for _, hop := range chain {
+		if hop.OnError != config.OnErrorSkip {
+			continue // no gaps: line n came from source row n
+		}
+		lines, err := readAllLines(hop.OutputFilename, 0)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read step '%s': %w", hop.Name, err)
+		}
+		for j, n := range index {
+			if n >= len(lines) {
+				return nil, fmt.Errorf("step '%s': row %d not found (only %d rows)", hop.Name, n, len(lines))
+			}
+			row, err := lineRow(lines[n], n)
+			if err != nil {
+				return nil, fmt.Errorf("step '%s' row %d: %w", hop.Name, n, err)
+			}
+			index[j] = row
+		}
+	}
+
+	all, err := readAllLines(ref.OutputFilename, 0)
+	if err != nil {
+		return nil, err
+	}
+	lines := make([]string, total)
+	for j, n := range index {
+		if n >= len(all) {
+			return nil, fmt.Errorf("step '%s': row %d not found (only %d rows)", ref.Name, n, len(all))
+		}
+		lines[j] = all[n]
+	}
+	return lines, nil
+}
+
+// forEachChain returns the steps between step and ref along forEach links —
+// step.ForEach, its forEach source, and so on, excluding ref itself — and
+// whether ref is on that chain at all.
+func forEachChain(cfg *config.Config, step config.Step, ref string) ([]config.Step, bool) {
+	var chain []config.Step
+	for name := step.ForEach; name != ""; {
+		if name == ref {
+			return chain, true
+		}
+		hop := cfg.GetStepByName(name)
+		if hop == nil || (hop.Type != config.PromptStepType && hop.Type != config.ConversationStepType) {
+			return nil, false
+		}
+		chain = append(chain, *hop)
+		name = hop.ForEach
+	}
+	return nil, false
+}
+
+func hasGaps(chain []config.Step) bool {
+	for _, hop := range chain {
+		if hop.OnError == config.OnErrorSkip {
+			return true
+		}
+	}
+	return false
+}
+
+// lineRow is the source row a prompt step's output line was generated from:
+// its recorded row index, or its line number when none was recorded.
+func lineRow(line string, lineNo int) (int, error) {
+	var entity jsonl.LineEntity
+	if err := json.Unmarshal([]byte(line), &entity); err != nil {
+		return 0, fmt.Errorf("failed to parse line: %w", err)
+	}
+	if entity.Row == nil {
+		return lineNo, nil
+	}
+	return *entity.Row, nil
+}
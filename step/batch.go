@@ -0,0 +1,471 @@
+package step
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/fs"
+	"github.com/mirpo/datamatic/jsonl"
+	"github.com/mirpo/datamatic/llm"
+	"github.com/mirpo/datamatic/promptbuilder"
+	"github.com/rs/zerolog/log"
+)
+
+// batchPollInterval is how often a submitted batch is checked on.
+var batchPollInterval = 30 * time.Second
+
+// batchState is a batch step's progress, kept next to its output so a rerun
+// picks up the job it left running instead of paying for it twice. Nothing
+// reaches the output until every row is settled.
+type batchState struct {
+	Key      string                   `json:"key"`            // hash of the rendered requests the state belongs to
+	Job      string                   `json:"job,omitempty"`  // the batch in progress, if any
+	Rows     []int                    `json:"rows,omitempty"` // the rows it holds
+	Attempts map[int]int              `json:"attempts"`
+	Usage    map[int]llm.Usage        `json:"usage"` // summed over every attempt a row took
+	Lines    map[int]jsonl.LineEntity `json:"lines"`
+	Rejected map[int]rejectedRow      `json:"rejected"`
+}
+
+// batchStateFilename places the state next to the step's output:
+// <step>.jsonl -> <step>.batch.json.
+func batchStateFilename(step config.Step) string {
+	return strings.TrimSuffix(step.OutputFilename, ".jsonl") + ".batch.json"
+}
+
+// batchRow is a rendered row waiting for its response.
+type batchRow struct {
+	request llm.GenerateRequest
+	values  map[string]promptbuilder.ValueShort
+}
+
+// runBatch generates rows start..total-1 through the provider's batch API:
+// all rows go out as one job, and rows whose response is missing or invalid
+// go out again in the next one, up to the retry attempts. Responses are
+// checked and turned into lines exactly as in runRow.
+func (p *PromptStep) runBatch(ctx context.Context, cfg *config.Config, step config.Step, writer *jsonl.Writer, sources []sourceRows, start, total int) error {
+	if start >= total {
+		return nil
+	}
+
+	provider, err := llm.NewProvider(newProviderConfig(step.ModelConfig, cfg.HTTPTimeout))
+	if err != nil {
+		return fmt.Errorf("failed to create LLM provider: %w", err)
+	}
+	batcher, ok := provider.(llm.BatchProvider)
+	if !ok {
+		return fmt.Errorf("provider %s has no batch API", step.ModelConfig.ModelProvider)
+	}
+	if cfg.Recorder != nil {
+		log.Warn().Msgf("step '%s': batch responses are not recorded to the cassette", step.Name)
+	}
+
+	hasSchema := step.JSONSchema.HasSchemaDefinition()
+	rows := map[int]batchRow{}
+	unrendered := map[int]error{}
+	for i := start; i < total; i++ {
+		req, pb, err := buildRequest(step, hasSchema, sources, i, fs.ImageToBase64)
+		if err != nil {
+			if step.OnError != config.OnErrorSkip {
+				return err
+			}
+			unrendered[i] = err
+			continue
+		}
+		rows[i] = batchRow{request: req, values: pb.GetValues()}
+	}
+
+	statePath := batchStateFilename(step)
+	state, err := loadBatchState(statePath, batchKey(step, rows, start, total))
+	if err != nil {
+		return err
+	}
+
+	b := &batchRun{cfg: cfg, step: step, batcher: batcher, state: state, path: statePath, rows: rows, hasSchema: hasSchema}
+	// a row that fails the step still gets the rows before it written, and
+	// the state kept for --resume
+	stop := func(err error) error {
+		if b.failedAt != nil {
+			if werr := b.write(writer, start, total); werr != nil {
+				return werr
+			}
+		}
+		return err
+	}
+	for i := start; i < total; i++ {
+		if err, ok := unrendered[i]; ok {
+			if err := b.reject(rejectedRow{Row: i, Error: err.Error()}, err); err != nil {
+				return stop(err)
+			}
+		}
+	}
+	for {
+		if state.Job == "" {
+			var pending []int
+			for i := start; i < total; i++ {
+				if _, ok := state.Lines[i]; ok {
+					continue
+				}
+				if _, ok := state.Rejected[i]; ok {
+					continue
+				}
+				pending = append(pending, i)
+			}
+			if len(pending) == 0 {
+				break
+			}
+			if err := b.submit(ctx, pending); err != nil {
+				return err
+			}
+		}
+
+		if err := b.collect(ctx); err != nil {
+			return stop(err)
+		}
+	}
+
+	return b.write(writer, start, total)
+}
+
+type batchRun struct {
+	cfg       *config.Config
+	step      config.Step
+	batcher   llm.BatchProvider
+	state     *batchState
+	path      string
+	rows      map[int]batchRow
+	hasSchema bool
+	// settle records the running job's usage with the meter
+	settle func(used llm.Usage, requests int)
+	// failedAt is the row that failed the step, if one did
+	failedAt *int
+}
+
+// submit sends the pending rows as a new job and saves its ID before anything
+// else can go wrong.
+func (b *batchRun) submit(ctx context.Context, pending []int) error {
+	items := make([]llm.BatchItem, 0, len(pending))
+	requests := make([]llm.GenerateRequest, 0, len(pending))
+	for _, i := range pending {
+		items = append(items, llm.BatchItem{ID: batchItemID(i), Request: b.rows[i].request})
+		requests = append(requests, b.rows[i].request)
+	}
+
+	if b.cfg.Meter != nil {
+		settle, err := b.cfg.Meter.ReserveBatch(b.step.Name, b.step.ModelConfig.ModelProvider, b.step.ModelConfig.ModelName, b.step.ModelConfig.MaxTokens, requests)
+		if err != nil {
+			return err
+		}
+		b.settle = settle
+	}
+
+	id, err := b.batcher.SubmitBatch(ctx, items)
+	if err != nil {
+		if b.settle != nil {
+			b.settle(llm.Usage{}, 0)
+			b.settle = nil
+		}
+		return fmt.Errorf("failed to submit batch: %w", err)
+	}
+	log.Info().Msgf("step '%s': submitted batch %s with %d rows", b.step.Name, id, len(items))
+
+	b.state.Job, b.state.Rows = id, pending
+	return b.save()
+}
+
+// collect waits for the running job, then settles each of its rows: accepted,
+// queued for the next job, or out of attempts.
+func (b *batchRun) collect(ctx context.Context) error {
+	job, err := b.wait(ctx)
+	if err != nil {
+		return err
+	}
+	results, err := b.batcher.BatchResults(ctx, job)
+	if err != nil {
+		return fmt.Errorf("failed to download results of batch %s: %w", job.ID, err)
+	}
+
+	byID := make(map[string]llm.BatchResult, len(results))
+	var used llm.Usage
+	for _, r := range results {
+		byID[r.ID] = r
+		if r.Response != nil {
+			used.Add(r.Response.Usage)
+		}
+	}
+	if b.settle == nil && b.cfg.Meter != nil {
+		// a job resumed from an earlier run: it is paid for already, so only
+		// record what it used
+		b.settle, _ = b.cfg.Meter.ReserveBatch(b.step.Name, b.step.ModelConfig.ModelProvider, b.step.ModelConfig.ModelName, nil, nil)
+	}
+	if b.settle != nil {
+		b.settle(used, len(results))
+		b.settle = nil
+	}
+
+	// every row of the job is settled even after one fails the step, so the
+	// kept state never points at a job that was already collected
+	var failed error
+	for _, i := range b.state.Rows {
+		result, ok := byID[batchItemID(i)]
+		if !ok {
+			result.Err = fmt.Errorf("batch %s ended %s without a result for the row", job.ID, job.Status)
+		}
+		if err := b.settleRow(i, result); err != nil && failed == nil {
+			failed = err
+		}
+	}
+
+	b.state.Job, b.state.Rows = "", nil
+	if err := b.save(); err != nil {
+		return err
+	}
+	return failed
+}
+
+// wait polls the job until it is done.
+func (b *batchRun) wait(ctx context.Context) (llm.BatchJob, error) {
+	ticker := time.NewTicker(batchPollInterval)
+	defer ticker.Stop()
+	for {
+		job, err := b.batcher.RetrieveBatch(ctx, b.state.Job)
+		if err != nil {
+			return llm.BatchJob{}, err
+		}
+		if job.Done() {
+			log.Info().Msgf("step '%s': batch %s %s", b.step.Name, job.ID, job.Status)
+			return job, nil
+		}
+		log.Info().Msgf("step '%s': batch %s %s (%d of %d requests done)", b.step.Name, job.ID, job.Status, job.Completed+job.Failed, job.Total)
+
+		select {
+		case <-ctx.Done():
+			return llm.BatchJob{}, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// settleRow validates a row's response like runRow does. A failed request
+// and an invalid response both take one of the row's attempts.
+func (b *batchRun) settleRow(i int, result llm.BatchResult) error {
+	row := b.rows[i]
+	response := ""
+	err := result.Err
+	if err == nil {
+		response = result.Response.Text
+		usage := b.state.Usage[i]
+		usage.Add(result.Response.Usage)
+		b.state.Usage[i] = usage
+		text, reasoning := splitReasoning(result.Response)
+		jsonRepaired := false
+		if b.step.JSONRepair && b.hasSchema {
+			text, jsonRepaired, err = jsonl.RepairJSON(text)
+		}
+
+		if err == nil && (b.cfg.ValidateResponse || result.Response.SchemaUnenforced) && b.hasSchema {
+			err = b.step.JSONSchema.ValidateJSONText(text)
+		}
+		if err == nil {
+			var line jsonl.LineEntity
+			line, err = jsonl.NewLineEntity(text, row.request.UserMessage, b.hasSchema, row.values)
+			if err == nil {
+				log.Info().Msgf("Response from LLM: '%s'", text)
+				if usage.Total() > 0 {
+					line.Usage = &usage
+				}
+				if b.step.KeepReasoning {
+					line.Reasoning = reasoning
+				}
+				line.JSONRepaired = jsonRepaired
+				if len(b.step.Messages) > 0 {
+					line.Messages = conversation(row.request)
+				}
+				b.state.Lines[i] = line
+				return nil
+			}
+		}
+	}
+
+	b.state.Attempts[i]++
+	attempts := b.state.Attempts[i]
+	log.Warn().Err(err).Msgf("row %d: no valid response from batch (attempt %d/%d): %s", i, attempts, b.cfg.RetryConfig.MaxAttempts, response)
+	if attempts < b.cfg.RetryConfig.MaxAttempts {
+		return nil
+	}
+
+	err = fmt.Errorf("row %d: no valid response after %d attempts: %w", i, attempts, err)
+	if b.step.OnError != config.OnErrorSkip {
+		return b.fail(i, err)
+	}
+	return b.reject(rejectedRow{Row: i, Prompt: row.request.UserMessage, Response: response, Error: err.Error()}, err)
+}
+
+// reject sets a row aside for the rejects file, failing the step once more
+// than maxErrors rows were.
+func (b *batchRun) reject(rejected rejectedRow, err error) error {
+	b.state.Rejected[rejected.Row] = rejected
+	n := len(b.state.Rejected)
+	log.Warn().Err(err).Msgf("step '%s': skipping row %d (%d skipped so far)", b.step.Name, rejected.Row, n)
+	if b.step.MaxErrors > 0 && n > b.step.MaxErrors {
+		return b.fail(rejected.Row, fmt.Errorf("%d rows failed, more than maxErrors (%d): %w", n, b.step.MaxErrors, err))
+	}
+	return nil
+}
+
+// fail ends the step at row i, the first row to fail it. Like a synchronous
+// run it leaves the rows before it on disk for --resume.
+func (b *batchRun) fail(i int, err error) error {
+	if b.failedAt == nil {
+		b.failedAt = &i
+	}
+	return err
+}
+
+// write puts the settled rows into the output in row order and removes the
+// state. After a failure only the rows before the failed one are written, and
+// the state is kept for the rows after them (see keep).
+func (b *batchRun) write(writer *jsonl.Writer, start, total int) error {
+	end := total
+	if b.failedAt != nil {
+		end = *b.failedAt
+	}
+
+	var rejects *rejectsWriter
+	if b.step.OnError == config.OnErrorSkip {
+		var err error
+		if rejects, err = openRejects(b.cfg, b.step, start); err != nil {
+			return err
+		}
+		defer rejects.Close()
+	}
+
+	next := start // where a resumed run picks up: after the last line written
+	for i := start; i < end; i++ {
+		if line, ok := b.state.Lines[i]; ok {
+			if b.step.OnError == config.OnErrorSkip {
+				row := i
+				line.Row = &row // output has gaps: readers align on the row index
+			}
+			if err := writer.WriteLine(line); err != nil {
+				return fmt.Errorf("failed to write output line: %w", err)
+			}
+			next = i + 1
+			continue
+		}
+		if rejected, ok := b.state.Rejected[i]; ok {
+			if err := rejects.writeRow(rejected); err != nil {
+				return err
+			}
+		}
+	}
+
+	if b.failedAt != nil {
+		return b.keep(next, total)
+	}
+	if n := len(b.state.Rejected); n > 0 {
+		log.Warn().Msgf("step '%s': skipped %d of %d rows, see %s", b.step.Name, n, total-start, rejectsFilename(b.step))
+	}
+	if err := os.Remove(b.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove batch state: %w", err)
+	}
+	return nil
+}
+
+// keep saves the state of a failed step for the run that resumes it at row
+// next: the rows settled from there on stay settled, and the row that failed
+// the step starts over with fresh attempts, so only it and the rows never
+// settled are submitted again.
+func (b *batchRun) keep(next, total int) error {
+	b.state.Key = batchKey(b.step, b.rows, next, total)
+	// the rows before next are on disk now
+	maps.DeleteFunc(b.state.Lines, func(i int, _ jsonl.LineEntity) bool { return i < next })
+	maps.DeleteFunc(b.state.Rejected, func(i int, _ rejectedRow) bool { return i < next })
+	maps.DeleteFunc(b.state.Attempts, func(i, _ int) bool { return i < next })
+	maps.DeleteFunc(b.state.Usage, func(i int, _ llm.Usage) bool { return i < next })
+	delete(b.state.Attempts, *b.failedAt)
+	delete(b.state.Rejected, *b.failedAt)
+	return b.save()
+}
+
+func (b *batchRun) save() error {
+	data, err := json.Marshal(b.state)
+	if err != nil {
+		return fmt.Errorf("failed to encode batch state: %w", err)
+	}
+	if err := os.WriteFile(b.path, data, 0o644); err != nil {
+		return fmt.Errorf("failed to save batch state: %w", err)
+	}
+	return nil
+}
+
+// loadBatchState reads the state a previous run left behind. State for other
+// requests (the prompt, the model or the source rows changed since) is
+// discarded: its job answers questions no longer asked.
+func loadBatchState(path, key string) (*batchState, error) {
+	fresh := &batchState{
+		Key:      key,
+		Attempts: map[int]int{},
+		Usage:    map[int]llm.Usage{},
+		Lines:    map[int]jsonl.LineEntity{},
+		Rejected: map[int]rejectedRow{},
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return fresh, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read batch state: %w", err)
+	}
+
+	var state batchState
+	if err := json.Unmarshal(data, &state); err != nil || state.Key != key {
+		log.Warn().Msgf("discarding batch state %s: it doesn't match the step's requests", path)
+		return fresh, nil
+	}
+	if state.Attempts == nil {
+		state.Attempts = fresh.Attempts
+	}
+	if state.Usage == nil {
+		state.Usage = fresh.Usage
+	}
+	if state.Lines == nil {
+		state.Lines = fresh.Lines
+	}
+	if state.Rejected == nil {
+		state.Rejected = fresh.Rejected
+	}
+	if state.Job != "" {
+		log.Info().Msgf("resuming batch %s", state.Job)
+	}
+	return &state, nil
+}
+
+// batchKey identifies the requests of rows start..total-1.
+func batchKey(step config.Step, rows map[int]batchRow, start, total int) string {
+	h := sha256.New()
+	enc := json.NewEncoder(h)
+	_ = enc.Encode([]interface{}{step.ModelConfig.ModelProvider, step.ModelConfig.ModelName, step.ModelConfig.BaseURL, step.JSONSchemaRaw, start, total})
+	for i := start; i < total; i++ {
+		req := rows[i].request
+		_ = enc.Encode([]string{req.SystemMessage, req.UserMessage, req.Base64Image})
+		if len(req.Messages) > 0 {
+			_ = enc.Encode(req.Messages)
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func batchItemID(row int) string {
+	return fmt.Sprintf("row-%d", row)
+}
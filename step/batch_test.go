@@ -0,0 +1,166 @@
+package step
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func batchStepConfig(t *testing.T, srv *llmtest.BatchServer) (*config.Config, config.Step, string) {
+	t.Helper()
+	interval := batchPollInterval
+	batchPollInterval = time.Millisecond
+	t.Cleanup(func() { batchPollInterval = interval })
+
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	step.Batch = true
+	step.ModelConfig.ModelProvider = llm.ProviderOpenAICompatible
+	return cfg, step, dir
+}
+
+func TestPromptStepRun_BatchWritesRowsInOrder(t *testing.T) {
+	srv := llmtest.NewBatchServer(t, `{"title": "a"}`, `{"wrong": true}`, `{"title": "c"}`, `{"title": "b"}`)
+	srv.PendingPolls = 2
+	srv.PromptTokens, srv.CompletionTokens = 10, 2
+	cfg, step, dir := batchStepConfig(t, srv)
+	step.JSONSchema = testSchema(t, titleSchema)
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+	require.NoError(t, err)
+
+	batches := srv.Batches()
+	require.Len(t, batches, 2, "the invalid row goes out again")
+	assert.Len(t, batches[0], 3)
+	assert.Equal(t, "generate something", lastMessage(batches[1][0]))
+
+	lines := readOutput(t, step.OutputFilename)
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], `"title":"a"`)
+	assert.Contains(t, lines[1], `"title":"b"`)
+	assert.Contains(t, lines[1], `"usage":{"promptTokens":20,"completionTokens":4}`, "both attempts count")
+	assert.Contains(t, lines[2], `"title":"c"`)
+	assert.NoFileExists(t, batchStateFilename(step))
+}
+
+func TestPromptStepRun_BatchResumesTheSubmittedJob(t *testing.T) {
+	srv := llmtest.NewBatchServer(t, "done")
+	srv.PendingPolls = 100
+	cfg, step, dir := batchStepConfig(t, srv)
+
+	// the first run is interrupted while the job is still running
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := (&PromptStep{}).Run(ctx, cfg, step, dir)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.FileExists(t, batchStateFilename(step))
+
+	srv.PendingPolls = 0
+	err = (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+	require.NoError(t, err)
+
+	assert.Len(t, srv.Batches(), 1, "the rerun waits for the same job")
+	assert.Equal(t, 3, countLines(t, step.OutputFilename))
+	assert.NoFileExists(t, batchStateFilename(step))
+}
+
+func TestPromptStepRun_BatchDiscardsStateOfOtherRequests(t *testing.T) {
+	srv := llmtest.NewBatchServer(t, "done")
+	cfg, step, dir := batchStepConfig(t, srv)
+	require.NoError(t, os.WriteFile(batchStateFilename(step), []byte(`{"key":"old","job":"batch-404"}`), 0o644))
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+	require.NoError(t, err)
+
+	assert.Len(t, srv.Batches(), 1)
+	assert.Equal(t, 3, countLines(t, step.OutputFilename))
+}
+
+func TestPromptStepRun_BatchSkipsRowsOutOfAttempts(t *testing.T) {
+	srv := llmtest.NewBatchServer(t, "ok")
+	srv.FailFirst = 1
+	cfg, step, dir := batchStepConfig(t, srv)
+	cfg.RetryConfig.MaxAttempts = 1
+	step.OnError = config.OnErrorSkip
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+	require.NoError(t, err)
+
+	lines := readOutput(t, step.OutputFilename)
+	require.Len(t, lines, 2)
+	assert.Contains(t, lines[0], `"row":1`)
+	rejects := readOutput(t, rejectsFilename(step))
+	require.Len(t, rejects, 1)
+	assert.Contains(t, rejects[0], `"row":0`)
+	assert.Contains(t, rejects[0], "500")
+}
+
+func TestPromptStepRun_BatchFailureKeepsThePrefix(t *testing.T) {
+	srv := llmtest.NewBatchServer(t, `{"title": "a"}`, `{"wrong": true}`, `{"title": "c"}`, `{"title": "b"}`)
+	cfg, step, dir := batchStepConfig(t, srv)
+	cfg.RetryConfig.MaxAttempts = 1
+	step.JSONSchema = testSchema(t, titleSchema)
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "row 1")
+	assert.Equal(t, 1, countLines(t, step.OutputFilename), "the rows before the failed one are kept for --resume")
+	assert.FileExists(t, batchStateFilename(step), "the rows settled after the failed one are kept too")
+
+	cfg.Resume = true
+	err = (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+	require.NoError(t, err)
+
+	batches := srv.Batches()
+	require.Len(t, batches, 2)
+	assert.Len(t, batches[1], 1, "only the failed row goes out again")
+	lines := readOutput(t, step.OutputFilename)
+	require.Len(t, lines, 3)
+	assert.Contains(t, lines[0], `"title":"a"`)
+	assert.Contains(t, lines[1], `"title":"b"`)
+	assert.Contains(t, lines[2], `"title":"c"`)
+	assert.NoFileExists(t, batchStateFilename(step))
+}
+
+func TestPromptStepRun_BatchUnrenderedRowsPastMaxErrorsKeepRejectsAndState(t *testing.T) {
+	srv := llmtest.NewBatchServer(t, "ok")
+	cfg, step, dir := batchStepConfig(t, srv)
+	srcPath := filepath.Join(dir, "src.jsonl")
+	require.NoError(t, os.WriteFile(srcPath, []byte(
+		`{"id":"r0","format":"json","prompt":"p","response":{"title":"t0"}}`+"\n"+
+			`{"id":"r1","format":"json","prompt":"p","response":{"other":1}}`+"\n"+
+			`{"id":"r2","format":"json","prompt":"p","response":{"other":2}}`+"\n"), 0o644))
+	cfg.Steps = []config.Step{{Name: "src", Type: config.PromptStepType, OutputFilename: srcPath, JSONSchema: testSchema(t, titleSchema)}}
+	step.ForEach = "src"
+	step.Prompt = "use {{.src.title}}"
+	step.OnError = config.OnErrorSkip
+	step.MaxErrors = 1
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "more than maxErrors (1)")
+	assert.Empty(t, srv.Batches(), "nothing is submitted")
+	rejects := readOutput(t, rejectsFilename(step))
+	require.Len(t, rejects, 1)
+	assert.Contains(t, rejects[0], `"row":1`)
+	assert.FileExists(t, batchStateFilename(step))
+}
+
+func lastMessage(body map[string]interface{}) string {
+	messages, _ := body["messages"].([]interface{})
+	if len(messages) == 0 {
+		return ""
+	}
+	msg, _ := messages[len(messages)-1].(map[string]interface{})
+	content, _ := msg["content"].(string)
+	return content
+}
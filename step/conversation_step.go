@@ -0,0 +1,232 @@
+package step
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/jsonl"
+	"github.com/mirpo/datamatic/llm"
+	"github.com/mirpo/datamatic/promptbuilder"
+	"github.com/rs/zerolog/log"
+)
+
+// ConversationStep simulates a dialogue for every row: a user model, told who
+// it plays by its own system prompt, talks to the step's model for up to
+// maxTurns exchanges, or until stopWhen holds for the transcript. Requests
+// are sent, retried and fall back like a prompt step's.
+type ConversationStep struct {
+	PromptStep
+}
+
+// conversationTranscript is a conversation step's response: the dialogue,
+// after the assistant's system prompt when it has one — the chat format
+// fine-tuning takes.
+type conversationTranscript struct {
+	Messages []llm.Message `json:"messages"`
+}
+
+func (c *ConversationStep) Run(ctx context.Context, cfg *config.Config, step config.Step, outputFolder string) error {
+	total := step.ResolvedCount
+	workers := max(step.Concurrency, 1) // see PromptStep.Run
+
+	writer, start, err := openPromptOutput(cfg, step)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	base, err := newConversationBuilder(step)
+	if err != nil {
+		return err
+	}
+	sources, err := loadSources(base, cfg, step, total)
+	if err != nil {
+		return err
+	}
+
+	limit := newAdaptiveLimit(step.Name, workers)
+	assistants, err := newStepModels(cfg, step, limit)
+	if err != nil {
+		return err
+	}
+	users, err := newStepModels(cfg, userStep(step), limit)
+	if err != nil {
+		return fmt.Errorf("user: %w", err)
+	}
+
+	return runRows(ctx, cfg, step, start, total, limit, writer, func(ctx context.Context, i int) (jsonl.LineEntity, error) {
+		return c.runConversation(ctx, cfg, step, assistants, users, sources, i)
+	})
+}
+
+// newConversationBuilder parses the templates a conversation step renders for
+// every row; the user's prompt is the one BuildPrompt renders.
+func newConversationBuilder(step config.Step) (*promptbuilder.PromptBuilder, error) {
+	return promptbuilder.NewPromptBuilder(step.User.Prompt, step.ForEach, step.User.SystemPrompt, step.SystemPrompt)
+}
+
+// userStep is the step as the simulated user's model sends requests for it:
+// metered, cached and recorded under the step's name.
+func userStep(step config.Step) config.Step {
+	step.Models = config.ModelChain{{Model: step.User.Model}}
+	step.Model = step.User.Model
+	step.ModelConfig = step.User.ModelConfig
+	return step
+}
+
+// runConversation simulates row i's conversation. Every exchange is a message
+// from the user's model, then the step model's answer to it; stopWhen is
+// checked after each answer.
+func (c *ConversationStep) runConversation(ctx context.Context, cfg *config.Config, step config.Step, assistants, users []stepModel, sources []sourceRows, i int) (jsonl.LineEntity, error) {
+	log.Info().
+		Str("step_name", step.Name).
+		Str("step_type", string(step.Type)).
+		Int("iteration", i).
+		Msg("Running step")
+
+	pb, err := newConversationBuilder(step)
+	if err != nil {
+		return jsonl.LineEntity{}, err
+	}
+	if err := addSourceValues(pb, sources, i); err != nil {
+		return jsonl.LineEntity{}, err
+	}
+	opener, err := pb.BuildPrompt()
+	if err != nil {
+		return jsonl.LineEntity{}, fmt.Errorf("failed to build the user's prompt: %w", err)
+	}
+	userSystem, err := pb.RenderString(step.User.SystemPrompt)
+	if err != nil {
+		return jsonl.LineEntity{}, fmt.Errorf("failed to render the user's systemPrompt: %w", err)
+	}
+	system, err := pb.RenderString(step.SystemPrompt)
+	if err != nil {
+		return jsonl.LineEntity{}, fmt.Errorf("failed to render systemPrompt: %w", err)
+	}
+
+	var usage llm.Usage
+	var turns []llm.Message
+	fail := func(err error) error {
+		last := ""
+		if len(turns) > 0 {
+			last = turns[len(turns)-1].Content
+		}
+		return &rowError{prompt: opener, response: last, err: err}
+	}
+
+	model := ""
+	for turn := 1; turn <= step.MaxTurns; turn++ {
+		message, _, err := c.say(ctx, cfg, users, userRequest(userSystem, opener, turns), i, &usage)
+		if err != nil {
+			return jsonl.LineEntity{}, fail(fmt.Errorf("row %d, turn %d: user: %w", i, turn, err))
+		}
+		turns = append(turns, llm.Message{Role: llm.RoleUser, Content: message})
+
+		answer, answeredBy, err := c.say(ctx, cfg, assistants, assistantRequest(system, turns), i, &usage)
+		if err != nil {
+			return jsonl.LineEntity{}, fail(fmt.Errorf("row %d, turn %d: assistant: %w", i, turn, err))
+		}
+		turns = append(turns, llm.Message{Role: llm.RoleAssistant, Content: answer})
+		model = answeredBy
+
+		stop, err := stopped(step, transcript(system, turns))
+		if err != nil {
+			return jsonl.LineEntity{}, fail(fmt.Errorf("row %d, turn %d: %w", i, turn, err))
+		}
+		if stop {
+			log.Debug().Msgf("row %d: stopWhen ended the conversation after %d turns", i, turn)
+			break
+		}
+	}
+
+	data, err := json.Marshal(transcript(system, turns))
+	if err != nil {
+		return jsonl.LineEntity{}, fmt.Errorf("row %d: failed to encode transcript: %w", i, err)
+	}
+	lineEntity, err := jsonl.NewLineEntity(string(data), opener, true, pb.GetValues())
+	if err != nil {
+		return jsonl.LineEntity{}, fmt.Errorf("row %d: %w", i, err)
+	}
+	if usage.Total() > 0 {
+		lineEntity.Usage = &usage
+	}
+	if len(assistants) > 1 {
+		lineEntity.Model = model
+	}
+	return lineEntity, nil
+}
+
+// say asks one side of the conversation for its next message, returning it
+// with the model that wrote it. A model's thinking is not part of the
+// conversation and is dropped.
+func (c *ConversationStep) say(ctx context.Context, cfg *config.Config, models []stepModel, req llm.GenerateRequest, row int, usage *llm.Usage) (string, string, error) {
+	response, model, err := c.generateWithFallback(ctx, cfg, models, req, row)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to get response from LLM after retries: %w", err)
+	}
+	usage.Add(response.Usage)
+
+	text, _ := splitReasoning(response)
+	text = strings.TrimSpace(text)
+	if text == "" {
+		return "", "", errors.New("LLM returned an empty message")
+	}
+	return text, model, nil
+}
+
+// userRequest is the conversation as the simulated user sees it, with the
+// roles turned around: the opener asked for its first message, it wrote the
+// user's turns itself, and every answer is a message it replies to.
+func userRequest(system, opener string, turns []llm.Message) llm.GenerateRequest {
+	seen := []llm.Message{{Role: llm.RoleUser, Content: opener}}
+	for _, turn := range turns {
+		role := llm.RoleUser
+		if turn.Role == llm.RoleUser {
+			role = llm.RoleAssistant
+		}
+		seen = append(seen, llm.Message{Role: role, Content: turn.Content})
+	}
+	last := len(seen) - 1
+	return llm.GenerateRequest{SystemMessage: system, Messages: seen[:last], UserMessage: seen[last].Content}
+}
+
+// assistantRequest asks the step's model to answer the last of the turns.
+func assistantRequest(system string, turns []llm.Message) llm.GenerateRequest {
+	last := len(turns) - 1
+	return llm.GenerateRequest{SystemMessage: system, Messages: turns[:last:last], UserMessage: turns[last].Content}
+}
+
+func transcript(system string, turns []llm.Message) conversationTranscript {
+	var messages []llm.Message
+	if system != "" {
+		messages = append(messages, llm.Message{Role: llm.RoleSystem, Content: system})
+	}
+	return conversationTranscript{Messages: append(messages, turns...)}
+}
+
+// stopped reports whether the step's stopWhen holds for the transcript: its
+// first result is anything but false or null, as in a jq if.
+func stopped(step config.Step, t conversationTranscript) (bool, error) {
+	if step.StopProgram == nil {
+		return false, nil
+	}
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return false, fmt.Errorf("failed to encode transcript: %w", err)
+	}
+	var input interface{}
+	if err := json.Unmarshal(data, &input); err != nil {
+		return false, fmt.Errorf("failed to decode transcript: %w", err)
+	}
+
+	results, err := step.StopProgram.Run(input)
+	if err != nil {
+		return false, fmt.Errorf("stopWhen: %w", err)
+	}
+	return len(results) > 0 && results[0] != nil && results[0] != false, nil
+}
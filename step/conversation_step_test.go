@@ -0,0 +1,115 @@
+package step
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/jq"
+	"github.com/mirpo/datamatic/jsonl"
+	"github.com/mirpo/datamatic/llm"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func conversationStepConfig(t *testing.T, srvURL string) (*config.Config, config.Step) {
+	t.Helper()
+	cfg, step, dir := promptStepConfig(t, srvURL)
+
+	personasPath := filepath.Join(dir, "personas.jsonl")
+	require.NoError(t, os.WriteFile(personasPath, []byte(`{"name":"Ann"}`+"\n"), 0o644))
+	cfg.Steps = []config.Step{{Name: "personas", Type: config.ReadStepType, OutputFilename: personasPath}}
+
+	step.Name = "chat"
+	step.Type = config.ConversationStepType
+	step.Prompt = ""
+	step.ForEach = "personas"
+	step.ResolvedCount = 1
+	step.OutputFilename = filepath.Join(dir, "chat.jsonl")
+	step.SystemPrompt = "You are a support agent."
+	step.User = &config.ConversationUser{
+		ModelConfig:  step.ModelConfig,
+		SystemPrompt: "You are {{.item.name}}, a customer.",
+		Prompt:       config.DefaultConversationOpener,
+	}
+	step.MaxTurns = 2
+	return cfg, step
+}
+
+func readTranscript(t *testing.T, path string) (jsonl.LineEntity, []llm.Message) {
+	t.Helper()
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	var line jsonl.LineEntity
+	require.NoError(t, json.Unmarshal(data, &line))
+
+	encoded, err := json.Marshal(line.Response)
+	require.NoError(t, err)
+	var transcript conversationTranscript
+	require.NoError(t, json.Unmarshal(encoded, &transcript))
+	return line, transcript.Messages
+}
+
+func sentMessages(req map[string]interface{}) []string {
+	var sent []string
+	for _, m := range req["messages"].([]interface{}) {
+		message := m.(map[string]interface{})
+		sent = append(sent, message["role"].(string)+": "+message["content"].(string))
+	}
+	return sent
+}
+
+func TestConversationStepRun_AlternatesTheTwoModels(t *testing.T) {
+	srv := llmtest.NewServer(t, "I need a refund.", "Which order?", "Order 42.", "Refund issued.")
+	cfg, step := conversationStepConfig(t, srv.URL)
+
+	err := (&ConversationStep{}).Run(context.Background(), cfg, step, "")
+	require.NoError(t, err)
+
+	line, messages := readTranscript(t, step.OutputFilename)
+	assert.Equal(t, config.DefaultConversationOpener, line.Prompt)
+	assert.Equal(t, []llm.Message{
+		{Role: llm.RoleSystem, Content: "You are a support agent."},
+		{Role: llm.RoleUser, Content: "I need a refund."},
+		{Role: llm.RoleAssistant, Content: "Which order?"},
+		{Role: llm.RoleUser, Content: "Order 42."},
+		{Role: llm.RoleAssistant, Content: "Refund issued."},
+	}, messages)
+
+	// the simulated user sees the conversation with the roles turned around
+	requests := srv.Requests()
+	require.Len(t, requests, 4)
+	assert.Equal(t, []string{
+		"system: You are Ann, a customer.",
+		"user: " + config.DefaultConversationOpener,
+		"assistant: I need a refund.",
+		"user: Which order?",
+	}, sentMessages(requests[2]))
+	assert.Equal(t, []string{
+		"system: You are a support agent.",
+		"user: I need a refund.",
+		"assistant: Which order?",
+		"user: Order 42.",
+	}, sentMessages(requests[3]))
+}
+
+func TestConversationStepRun_StopWhenEndsTheConversation(t *testing.T) {
+	srv := llmtest.NewServer(t, "Hi.", "Hello!", "Thanks, bye.", "Goodbye!")
+	cfg, step := conversationStepConfig(t, srv.URL)
+	step.MaxTurns = 5
+	program, err := jq.Compile(`.messages[-2].content | contains("bye")`)
+	require.NoError(t, err)
+	step.StopProgram = program
+
+	err = (&ConversationStep{}).Run(context.Background(), cfg, step, "")
+	require.NoError(t, err)
+
+	_, messages := readTranscript(t, step.OutputFilename)
+	require.Len(t, messages, 5)
+	assert.Equal(t, "Goodbye!", messages[4].Content)
+	assert.Equal(t, 4, srv.CallCount())
+}
@@ -0,0 +1,137 @@
+package step
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/jsonl"
+	"github.com/mirpo/datamatic/llm"
+	"github.com/mirpo/datamatic/promptbuilder"
+)
+
+// RowPreview is one rendered row of a prompt step: the request it would send
+// and the provider's request body for it, or why either could not be built.
+type RowPreview struct {
+	Request llm.GenerateRequest
+	Err     error
+	Body    []byte
+	BodyErr error
+}
+
+// PreviewRequests renders the requests of a prompt step's first `rows` rows
+// without calling the model. Referenced steps with output on disk supply their
+// real rows; for the others a placeholder row is synthesized (schema-shaped for
+// prompt steps with a jsonSchema, "<step.field>" strings otherwise), and their
+// names are returned so the caller can say which values are not real.
+func PreviewRequests(cfg *config.Config, step config.Step, rows int) ([]RowPreview, []string, error) {
+	base, err := promptbuilder.NewPromptBuilder(step.PromptTemplate(), step.ForEach, step.Image)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var sources []sourceRows
+	var placeholders []string
+	for stepName, fieldPaths := range base.GroupPlaceholdersByStep() {
+		refStep := cfg.GetStepByName(stepName)
+		if refStep == nil {
+			return nil, nil, fmt.Errorf("prompt references unknown step '%s'", stepName)
+		}
+
+		lines, err := sourceLines(cfg, step, *refStep, rows)
+		if errors.Is(err, os.ErrNotExist) {
+			line, err := placeholderLine(*refStep, fieldPaths)
+			if err != nil {
+				return nil, nil, fmt.Errorf("failed to build placeholder row for step '%s': %w", stepName, err)
+			}
+			lines = make([]string, rows)
+			for i := range lines {
+				lines[i] = line
+			}
+			placeholders = append(placeholders, stepName)
+		} else if err != nil {
+			return nil, nil, fmt.Errorf("failed to read values from step '%s': %w", stepName, err)
+		}
+
+		sources = append(sources, sourceRows{step: *refStep, fieldPaths: fieldPaths, lines: lines})
+	}
+	sort.Strings(placeholders)
+
+	// images are not read: the body shows which file would be attached
+	describeImage := func(path string) (string, error) {
+		return "<image " + path + ">", nil
+	}
+
+	// the body is optional: a missing API key or a provider that cannot
+	// preview only loses that part of the plan
+	var previewer llm.RequestPreviewer
+	provider, bodyErr := llm.NewProvider(newProviderConfig(step.ModelConfig, cfg.HTTPTimeout))
+	if bodyErr == nil {
+		var ok bool
+		if previewer, ok = provider.(llm.RequestPreviewer); !ok {
+			bodyErr = fmt.Errorf("provider '%s' cannot preview requests", step.ModelConfig.ModelProvider)
+		}
+	}
+
+	hasSchema := step.JSONSchema.HasSchemaDefinition()
+	previews := make([]RowPreview, rows)
+	for i := range previews {
+		req, _, err := buildRequest(step, hasSchema, sources, i, describeImage)
+		previews[i] = RowPreview{Request: req, Err: err, BodyErr: bodyErr}
+		if err == nil && previewer != nil {
+			previews[i].Body, previews[i].BodyErr = previewer.PreviewRequest(req)
+		}
+	}
+	return previews, placeholders, nil
+}
+
+// placeholderLine builds an output line in the format refStep writes, holding
+// stand-in values for the fields a prompt reads from it.
+func placeholderLine(refStep config.Step, fieldPaths []string) (string, error) {
+	if refStep.Type == config.PromptStepType {
+		var response interface{} = "<" + refStep.Name + ">"
+		format := "text"
+		if refStep.JSONSchema.HasSchemaDefinition() {
+			response = refStep.JSONSchema.Placeholder(refStep.Name)
+			format = "json"
+		}
+		data, err := json.Marshal(jsonl.LineEntity{ID: "placeholder", Format: format, Response: response})
+		return string(data), err
+	}
+	if refStep.Type == config.ConversationStepType {
+		transcript := conversationTranscript{Messages: []llm.Message{
+			{Role: llm.RoleUser, Content: "<" + refStep.Name + ".user>"},
+			{Role: llm.RoleAssistant, Content: "<" + refStep.Name + ".assistant>"},
+		}}
+		data, err := json.Marshal(jsonl.LineEntity{ID: "placeholder", Format: "json", Response: transcript})
+		return string(data), err
+	}
+
+	// other steps write plain JSON rows; nest each read path into one object
+	row := map[string]interface{}{}
+	for _, path := range fieldPaths {
+		if path == "" {
+			continue // the whole row: the object itself stands in
+		}
+		node := row
+		parts := strings.Split(path, ".")
+		for _, part := range parts[:len(parts)-1] {
+			child, ok := node[part].(map[string]interface{})
+			if !ok {
+				child = map[string]interface{}{}
+				node[part] = child
+			}
+			node = child
+		}
+		last := parts[len(parts)-1]
+		if _, ok := node[last]; !ok {
+			node[last] = "<" + refStep.Name + "." + path + ">"
+		}
+	}
+	data, err := json.Marshal(row)
+	return string(data), err
+}
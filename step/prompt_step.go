@@ -2,12 +2,16 @@ package step
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
+	"strings"
+	"sync/atomic"
 
 	"github.com/mirpo/datamatic/config"
 	"github.com/mirpo/datamatic/fs"
 	"github.com/mirpo/datamatic/jsonl"
+	"github.com/mirpo/datamatic/jsonschema"
 	"github.com/mirpo/datamatic/llm"
 	"github.com/mirpo/datamatic/promptbuilder"
 	"github.com/mirpo/datamatic/retry"
@@ -15,18 +19,107 @@ import (
 	"golang.org/x/sync/errgroup"
 )
 
-func newProviderConfigFromStep(step config.Step, httpTimeout int) llm.ProviderConfig {
+func newProviderConfig(modelConfig config.ModelConfig, httpTimeout int) llm.ProviderConfig {
 	return llm.ProviderConfig{
-		BaseURL:      step.ModelConfig.BaseURL,
-		ProviderType: step.ModelConfig.ModelProvider,
-		ModelName:    step.ModelConfig.ModelName,
-		AuthToken:    "token",
-		HTTPTimeout:  httpTimeout,
-		Temperature:  step.ModelConfig.Temperature,
-		MaxTokens:    step.ModelConfig.MaxTokens,
+		BaseURL:          modelConfig.BaseURL,
+		ProviderType:     modelConfig.ModelProvider,
+		ModelName:        modelConfig.ModelName,
+		AuthToken:        "token",
+		HTTPTimeout:      httpTimeout,
+		Temperature:      modelConfig.Temperature,
+		MaxTokens:        modelConfig.MaxTokens,
+		TopP:             modelConfig.TopP,
+		Seed:             modelConfig.Seed,
+		Stop:             modelConfig.Stop,
+		PresencePenalty:  modelConfig.PresencePenalty,
+		FrequencyPenalty: modelConfig.FrequencyPenalty,
+		ReasoningEffort:  modelConfig.ReasoningEffort,
+		ExtraBody:        modelConfig.ExtraBody,
+		StructuredOutput: modelConfig.StructuredOutput,
+		APIKeyEnv:        modelConfig.APIKeyEnv,
+		Headers:          modelConfig.Headers,
+		Organization:     modelConfig.Organization,
+		Project:          modelConfig.Project,
+		Options:          modelConfig.Options,
+		KeepAlive:        modelConfig.KeepAlive,
+		Think:            modelConfig.Think,
+		Endpoints:        endpoints(modelConfig.Endpoints),
 	}
 }
 
+func endpoints(configured []config.Endpoint) []llm.Endpoint {
+	var list []llm.Endpoint
+	for _, e := range configured {
+		list = append(list, llm.Endpoint{URL: e.URL, Concurrency: e.Concurrency})
+	}
+	return list
+}
+
+// newProvider returns the provider a step sends its requests to: the cassette
+// when replaying, which needs no API key, otherwise the configured model.
+func newProvider(cfg *config.Config, step config.Step, providerConfig llm.ProviderConfig) (llm.Provider, error) {
+	if cfg.Cassette != nil {
+		return cfg.Cassette.Provider(step.Name, providerConfig), nil
+	}
+	provider, err := llm.NewProvider(providerConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create LLM provider: %w", err)
+	}
+	return provider, nil
+}
+
+// stepModel is one model of a step's fallback chain, wrapped for metering,
+// caching and recording like any step provider.
+type stepModel struct {
+	name     string // "provider:model", as recorded in the rows it answers
+	provider llm.Provider
+}
+
+// newStepModels returns the step's model followed by its fallbacks. Their
+// requests adjust the step's concurrency limit.
+func newStepModels(cfg *config.Config, step config.Step, limit *adaptiveLimit) ([]stepModel, error) {
+	models := []stepModel{}
+	add := func(name string, modelConfig config.ModelConfig) error {
+		providerConfig := newProviderConfig(modelConfig, cfg.HTTPTimeout)
+		provider, err := newProvider(cfg, step, providerConfig)
+		if err != nil {
+			return err
+		}
+		provider = limit.wrap(provider)
+		// a replayed response is never sent, so it takes no quota
+		if cfg.RateLimiters != nil && cfg.Cassette == nil {
+			var modelLimit llm.RateLimit
+			if modelConfig.RateLimit != nil {
+				modelLimit = *modelConfig.RateLimit
+			}
+			provider = cfg.RateLimiters.Wrap(provider, providerConfig, cfg.RateLimits[string(modelConfig.ModelProvider)], modelLimit)
+		}
+		if cfg.Meter != nil {
+			provider = cfg.Meter.Wrap(provider, step.Name, modelConfig.ModelProvider, modelConfig.ModelName, modelConfig.MaxTokens)
+		}
+		// outside the meter: a cached response is never sent, so it is not metered
+		if cfg.ResponseCache != nil {
+			provider = cfg.ResponseCache.Wrap(provider, step.Name, providerConfig)
+		}
+		// outermost: the cassette holds every response the step saw, cached or not
+		if cfg.Recorder != nil {
+			provider = cfg.Recorder.Wrap(provider, step.Name, providerConfig)
+		}
+		models = append(models, stepModel{name: name, provider: provider})
+		return nil
+	}
+
+	if err := add(step.Model, step.ModelConfig); err != nil {
+		return nil, err
+	}
+	for _, fallback := range step.Fallbacks() {
+		if err := add(fallback.Model, *fallback.ModelConfig); err != nil {
+			return nil, fmt.Errorf("fallback model '%s': %w", fallback.Model, err)
+		}
+	}
+	return models, nil
+}
+
 type PromptStep struct{}
 
 // sourceRows holds every line of a referenced step's output, read once so the
@@ -48,6 +141,30 @@ func (p *PromptStep) retryLLMGeneration(ctx context.Context, cfg *config.Config,
 	}, retry.ShouldRetryHTTPError)
 }
 
+// generateWithFallback asks each model in turn, moving on once the retries on
+// one are exhausted, and returns the response with the model that gave it.
+// A cancelled run or an exhausted budget ends the chain: no model can answer.
+func (p *PromptStep) generateWithFallback(ctx context.Context, cfg *config.Config, models []stepModel, req llm.GenerateRequest, row int) (*llm.GenerateResponse, string, error) {
+	req.Row = row
+	var lastErr error
+	for i, model := range models {
+		if i > 0 {
+			log.Warn().Err(lastErr).Msgf("row %d: model '%s' gave up, falling back to '%s'", row, models[i-1].name, model.name)
+		}
+
+		var response *llm.GenerateResponse
+		err := p.retryLLMGeneration(ctx, cfg, model.provider, req, &response)
+		if err == nil {
+			return response, model.name, nil
+		}
+		if ctx.Err() != nil || errors.Is(err, llm.ErrBudgetExceeded) {
+			return nil, "", err
+		}
+		lastErr = err
+	}
+	return nil, "", lastErr
+}
+
 func (p *PromptStep) Run(ctx context.Context, cfg *config.Config, step config.Step, outputFolder string) error {
 	total := step.ResolvedCount
 	// PreprocessConfig resolves the default (0 → 1); this clamp only guards
@@ -58,137 +175,384 @@ func (p *PromptStep) Run(ctx context.Context, cfg *config.Config, step config.St
 		workers = 1
 	}
 
-	writer, err := jsonl.NewWriter(step.OutputFilename)
+	writer, start, err := openPromptOutput(cfg, step)
 	if err != nil {
-		return fmt.Errorf("failed to create JSONL writer: %w", err)
+		return err
 	}
 	defer writer.Close()
 
-	provider, err := llm.NewProvider(newProviderConfigFromStep(step, cfg.HTTPTimeout))
-	if err != nil {
-		return fmt.Errorf("failed to create LLM provider: %w", err)
-	}
-
 	hasSchema := step.JSONSchema.HasSchemaDefinition()
 
 	// parse the prompt (plus the image path, which may reference row fields
 	// like {{.item.path}}) once to discover which steps it references, then read
 	// each referenced file a single time up front (rows only differ by values)
-	base, err := promptbuilder.NewPromptBuilder(step.Prompt, step.ForEach, step.Image)
+	base, err := promptbuilder.NewPromptBuilder(step.PromptTemplate(), step.ForEach, step.Image)
 	if err != nil {
 		return err
 	}
-	sources, err := loadSources(base, cfg, total)
+	sources, err := loadSources(base, cfg, step, total)
 	if err != nil {
 		return err
 	}
 
-	runRow := func(ctx context.Context, i int) (jsonl.LineEntity, error) {
-		return p.runRow(ctx, cfg, step, hasSchema, provider, sources, i)
+	// a replayed run has its responses at hand: no job to wait for
+	if step.Batch && cfg.Cassette == nil {
+		return p.runBatch(ctx, cfg, step, writer, sources, start, total)
 	}
 
-	return generate(ctx, total, workers, writer, runRow)
+	limit := newAdaptiveLimit(step.Name, workers)
+	models, err := newStepModels(cfg, step, limit)
+	if err != nil {
+		return err
+	}
+
+	recovered := &recoveries{}
+	defer recovered.log(step.Name)
+
+	return runRows(ctx, cfg, step, start, total, limit, writer, func(ctx context.Context, i int) (jsonl.LineEntity, error) {
+		return p.runRow(ctx, cfg, step, hasSchema, models, sources, recovered, i)
+	})
 }
 
-// runRow produces a single output row: build its prompt from the preloaded
-// source values, call the LLM, and retry within the per-row attempt budget
-// when the response fails validation.
-func (p *PromptStep) runRow(ctx context.Context, cfg *config.Config, step config.Step, hasSchema bool, provider llm.Provider, sources []sourceRows, i int) (jsonl.LineEntity, error) {
-	log.Info().
-		Str("step_name", step.Name).
-		Str("step_type", string(step.Type)).
-		Int("iteration", i).
-		Msg("Running step")
+// runRows generates rows start..total-1 with runRow and writes them in order.
+// A row that fails stops the step, unless the step skips failed rows
+// (onError: skip): those are recorded in its rejects file instead.
+func runRows(ctx context.Context, cfg *config.Config, step config.Step, start, total int, limit *adaptiveLimit, writer *jsonl.Writer, runRow func(context.Context, int) (jsonl.LineEntity, error)) error {
+	if step.OnError != config.OnErrorSkip {
+		return generate(ctx, start, total, limit, writer, func(ctx context.Context, i int) (*jsonl.LineEntity, error) {
+			line, err := runRow(ctx, i)
+			if err != nil {
+				return nil, err
+			}
+			return &line, nil
+		})
+	}
 
-	pb, err := promptbuilder.NewPromptBuilder(step.Prompt, step.ForEach)
+	rejects, err := openRejects(cfg, step, start)
 	if err != nil {
-		return jsonl.LineEntity{}, err
+		return err
 	}
+	defer rejects.Close()
 
-	for _, src := range sources {
-		if i >= len(src.lines) {
-			return jsonl.LineEntity{}, fmt.Errorf("step '%s': row %d not found (only %d rows)", src.step.Name, i, len(src.lines))
+	var skipped atomic.Int64
+	skipRow := func(ctx context.Context, i int) (*jsonl.LineEntity, error) {
+		line, err := runRow(ctx, i)
+		if err == nil {
+			row := i
+			line.Row = &row // output has gaps: readers align on the row index
+			return &line, nil
 		}
-		values, err := extractStepValues(src.step, src.lines[i], src.fieldPaths)
-		if err != nil {
-			return jsonl.LineEntity{}, fmt.Errorf("failed to read values from step '%s' row %d: %w", src.step.Name, i, err)
+		if ctx.Err() != nil || errors.Is(err, llm.ErrBudgetExceeded) || errors.Is(err, llm.ErrNotRecorded) {
+			return nil, err // the run can't go on; not a bad row
 		}
-		pb.AddStepValues(src.step.Name, values)
-	}
 
-	var base64Image string
-	if step.Image != "" {
-		imagePath, err := pb.RenderString(step.Image)
-		if err != nil {
-			return jsonl.LineEntity{}, fmt.Errorf("failed to resolve image path '%s': %w", step.Image, err)
+		if werr := rejects.write(i, err); werr != nil {
+			return nil, werr
+		}
+		n := int(skipped.Add(1))
+		log.Warn().Err(err).Msgf("step '%s': skipping row %d (%d skipped so far)", step.Name, i, n)
+		if step.MaxErrors > 0 && n > step.MaxErrors {
+			return nil, fmt.Errorf("%d rows failed, more than maxErrors (%d): %w", n, step.MaxErrors, err)
 		}
+		return nil, nil
+	}
+
+	if err := generate(ctx, start, total, limit, writer, skipRow); err != nil {
+		return err
+	}
+	if n := skipped.Load(); n > 0 {
+		log.Warn().Msgf("step '%s': skipped %d of %d rows, see %s", step.Name, n, total-start, rejectsFilename(step))
+	}
+	return nil
+}
 
-		base64Image, err = fs.ImageToBase64(imagePath)
+// openPromptOutput opens the step's output file and returns the first row
+// still to generate. Normally that is a fresh file and row 0; with --resume
+// the valid prefix a previous run left behind is kept and generation picks up
+// right after it, so an interrupted run only pays for the missing rows.
+func openPromptOutput(cfg *config.Config, step config.Step) (*jsonl.Writer, int, error) {
+	if !cfg.Resume {
+		writer, err := jsonl.NewWriter(step.OutputFilename)
 		if err != nil {
-			return jsonl.LineEntity{}, fmt.Errorf("failed to encode image '%s': %w", imagePath, err)
+			return nil, 0, fmt.Errorf("failed to create JSONL writer: %w", err)
 		}
+		return writer, 0, nil
 	}
 
-	userPrompt, err := pb.BuildPrompt()
+	next, size, err := jsonl.ValidPrefix(step.OutputFilename)
 	if err != nil {
-		return jsonl.LineEntity{}, fmt.Errorf("failed to build prompt: %w", err)
+		return nil, 0, fmt.Errorf("failed to inspect existing output: %w", err)
 	}
 
-	req := llm.GenerateRequest{
-		UserMessage:   userPrompt,
-		SystemMessage: step.SystemPrompt,
-		IsJSON:        hasSchema,
-		JSONSchema:    step.JSONSchema,
-		Base64Image:   base64Image,
+	writer, err := jsonl.NewResumeWriter(step.OutputFilename, size)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to reopen JSONL output: %w", err)
 	}
 
+	if next > 0 {
+		log.Info().Msgf("Resuming step '%s' at row %d of %d", step.Name, next, step.ResolvedCount)
+	}
+	return writer, next, nil
+}
+
+// recoveries counts a step's rows whose first answer was invalid, by how the
+// valid one came about.
+type recoveries struct {
+	repaired    atomic.Int64 // a repair turn corrected the invalid answer
+	regenerated atomic.Int64 // the request was sent again from scratch
+}
+
+func (r *recoveries) log(step string) {
+	repaired, regenerated := r.repaired.Load(), r.regenerated.Load()
+	if repaired+regenerated > 0 {
+		log.Info().Msgf("step '%s': %d rows repaired, %d regenerated from scratch after an invalid response", step, repaired, regenerated)
+	}
+}
+
+// runRow produces a single output row: build its prompt from the preloaded
+// source values, call the LLM, and retry within the per-row attempt budget
+// when the response fails validation. With repair, a retry follows up on the
+// invalid answer with what was wrong with it instead of starting over.
+func (p *PromptStep) runRow(ctx context.Context, cfg *config.Config, step config.Step, hasSchema bool, models []stepModel, sources []sourceRows, recovered *recoveries, i int) (jsonl.LineEntity, error) {
+	log.Info().
+		Str("step_name", step.Name).
+		Str("step_type", string(step.Type)).
+		Int("iteration", i).
+		Msg("Running step")
+
+	req, pb, err := buildRequest(step, hasSchema, sources, i, fs.ImageToBase64)
+	if err != nil {
+		return jsonl.LineEntity{}, err
+	}
+	userPrompt := req.UserMessage
+
+	lastResponse := ""
+	fail := func(err error) error {
+		return &rowError{prompt: userPrompt, response: lastResponse, err: err}
+	}
+
+	var usage llm.Usage // summed over every attempt this row takes
 	invalidAttempts := 0
 	// registerInvalid records an unusable response (schema violation or
 	// malformed line) and returns a terminal error once the attempt budget is
 	// exhausted; nil means "retry this row".
 	registerInvalid := func(cause error, responseText string) error {
 		invalidAttempts++
-		log.Warn().Err(cause).Msgf("row %d: invalid LLM response (attempt %d/%d): %s",
-			i, invalidAttempts, cfg.RetryConfig.MaxAttempts, responseText)
+		problem := "invalid LLM response"
+		if errors.Is(cause, jsonl.ErrTruncated) {
+			problem = "truncated LLM response" // not the model's mistake: maxTokens
+		}
+		log.Warn().Err(cause).Msgf("row %d: %s (attempt %d/%d): %s",
+			i, problem, invalidAttempts, cfg.RetryConfig.MaxAttempts, responseText)
 		if invalidAttempts >= cfg.RetryConfig.MaxAttempts {
 			return fmt.Errorf("row %d: LLM returned invalid response %d times in a row: %w", i, invalidAttempts, cause)
 		}
 		return nil
 	}
 
+	// a repaired answer that is still invalid isn't repaired again: the next
+	// attempt starts over, since a model stuck on its mistake is better off
+	// with a fresh sample than with a longer conversation about it
+	rowRequest := req
+	repairing := false
+	retryInvalid := func(cause error, responseText, answer string) error {
+		if failErr := registerInvalid(cause, responseText); failErr != nil {
+			return failErr
+		}
+		req = rowRequest
+		repairing = step.Repair && !repairing
+		if repairing {
+			req.Followups = []llm.Message{
+				{Role: llm.RoleAssistant, Content: answer},
+				{Role: llm.RoleUser, Content: repairMessage(cause)},
+			}
+		}
+		return nil
+	}
+
 	for {
-		var response *llm.GenerateResponse
-		if err := p.retryLLMGeneration(ctx, cfg, provider, req, &response); err != nil {
-			return jsonl.LineEntity{}, fmt.Errorf("row %d: failed to get response from LLM after retries: %w", i, err)
+		response, model, err := p.generateWithFallback(ctx, cfg, models, req, i)
+		if err != nil {
+			return jsonl.LineEntity{}, fail(fmt.Errorf("row %d: failed to get response from LLM after retries: %w", i, err))
+		}
+		lastResponse = response.Text
+		usage.Add(response.Usage)
+		text, reasoning := splitReasoning(response)
+		jsonRepaired := false
+		if step.JSONRepair && hasSchema {
+			repaired, changed, err := jsonl.RepairJSON(text)
+			if err != nil {
+				if failErr := retryInvalid(err, response.Text, text); failErr != nil {
+					return jsonl.LineEntity{}, fail(failErr)
+				}
+				continue
+			}
+			text, jsonRepaired = repaired, changed
 		}
 
-		if cfg.ValidateResponse && hasSchema {
+		// an answer the server didn't hold to the schema is always checked
+		if (cfg.ValidateResponse || response.SchemaUnenforced) && hasSchema {
 			log.Debug().Msg("Validating response from LLM using JSON schema")
-			if err := step.JSONSchema.ValidateJSONText(response.Text); err != nil {
-				if failErr := registerInvalid(err, response.Text); failErr != nil {
-					return jsonl.LineEntity{}, failErr
+			if err := step.JSONSchema.ValidateJSONText(text); err != nil {
+				if failErr := retryInvalid(err, response.Text, text); failErr != nil {
+					return jsonl.LineEntity{}, fail(failErr)
 				}
 				continue
 			}
 		}
 
-		log.Info().Msgf("Response from LLM: '%s'", response.Text)
+		log.Info().Msgf("Response from LLM: '%s'", text)
 
-		lineEntity, err := jsonl.NewLineEntity(response.Text, userPrompt, hasSchema, pb.GetValues())
+		lineEntity, err := jsonl.NewLineEntity(text, userPrompt, hasSchema, pb.GetValues())
 		if err != nil {
-			if failErr := registerInvalid(err, response.Text); failErr != nil {
-				return jsonl.LineEntity{}, failErr
+			if failErr := retryInvalid(err, response.Text, text); failErr != nil {
+				return jsonl.LineEntity{}, fail(failErr)
 			}
 			continue
 		}
+		if usage.Total() > 0 {
+			lineEntity.Usage = &usage
+		}
+		if len(models) > 1 {
+			lineEntity.Model = model
+		}
+		if step.KeepReasoning {
+			lineEntity.Reasoning = reasoning
+		}
+		lineEntity.JSONRepaired = jsonRepaired
+		if len(step.Messages) > 0 {
+			lineEntity.Messages = conversation(rowRequest)
+		}
+		switch {
+		case repairing:
+			recovered.repaired.Add(1)
+		case invalidAttempts > 0:
+			recovered.regenerated.Add(1)
+		}
 
 		return lineEntity, nil
 	}
 }
 
+// repairMessage asks the model to correct its answer, listing every way it
+// failed validation.
+func repairMessage(cause error) string {
+	problems := []string{cause.Error()}
+	var validationErr *jsonschema.ValidationError
+	if errors.As(cause, &validationErr) {
+		problems = validationErr.Errors
+	}
+	return "Your answer is invalid:\n- " + strings.Join(problems, "\n- ") +
+		"\n\nReply with the corrected JSON only, matching the required schema."
+}
+
+// splitReasoning separates a response's answer from the model's thinking: the
+// reasoning the provider returned on its own plus any <think> block in the
+// text, which would otherwise end up in the output and break JSON parsing.
+func splitReasoning(response *llm.GenerateResponse) (text, reasoning string) {
+	text, reasoning = jsonl.SplitReasoning(response.Text)
+	if response.Reasoning != "" {
+		reasoning = strings.TrimSpace(response.Reasoning + "\n\n" + reasoning)
+	}
+	return text, reasoning
+}
+
+// buildRequest renders row i's request from the preloaded source values. The
+// returned builder carries the values used, for the row's lineage. loadImage
+// turns the rendered image path into the request's image payload.
+func buildRequest(step config.Step, hasSchema bool, sources []sourceRows, i int, loadImage func(path string) (string, error)) (llm.GenerateRequest, *promptbuilder.PromptBuilder, error) {
+	pb, err := promptbuilder.NewPromptBuilder(step.PromptTemplate(), step.ForEach)
+	if err != nil {
+		return llm.GenerateRequest{}, nil, err
+	}
+
+	if err := addSourceValues(pb, sources, i); err != nil {
+		return llm.GenerateRequest{}, nil, err
+	}
+
+	var base64Image string
+	if step.Image != "" {
+		imagePath, err := pb.RenderString(step.Image)
+		if err != nil {
+			return llm.GenerateRequest{}, nil, fmt.Errorf("failed to resolve image path '%s': %w", step.Image, err)
+		}
+
+		base64Image, err = loadImage(imagePath)
+		if err != nil {
+			return llm.GenerateRequest{}, nil, fmt.Errorf("failed to encode image '%s': %w", imagePath, err)
+		}
+	}
+
+	userPrompt, err := pb.BuildPrompt()
+	if err != nil {
+		return llm.GenerateRequest{}, nil, fmt.Errorf("failed to build prompt: %w", err)
+	}
+
+	req := llm.GenerateRequest{
+		UserMessage:   userPrompt,
+		SystemMessage: step.SystemPrompt,
+		IsJSON:        hasSchema,
+		JSONSchema:    step.JSONSchema,
+		Base64Image:   base64Image,
+	}
+	if len(step.Messages) > 0 {
+		if err := setConversation(&req, config.SplitMessages(userPrompt)); err != nil {
+			return llm.GenerateRequest{}, nil, err
+		}
+	}
+	return req, pb, nil
+}
+
+// addSourceValues gives the builder row i's values from the preloaded sources.
+func addSourceValues(pb *promptbuilder.PromptBuilder, sources []sourceRows, i int) error {
+	for _, src := range sources {
+		if i >= len(src.lines) {
+			return fmt.Errorf("step '%s': row %d not found (only %d rows)", src.step.Name, i, len(src.lines))
+		}
+		values, err := extractStepValues(src.step, src.lines[i], src.fieldPaths)
+		if err != nil {
+			return fmt.Errorf("failed to read values from step '%s' row %d: %w", src.step.Name, i, err)
+		}
+		pb.AddStepValues(src.step.Name, values)
+	}
+	return nil
+}
+
+// setConversation spreads a step's rendered messages over the request: the
+// leading system turns join its system prompt, the last turn is the one the
+// model answers, and the turns between go before it.
+func setConversation(req *llm.GenerateRequest, turns []llm.Message) error {
+	system := []string{}
+	if req.SystemMessage != "" {
+		system = append(system, req.SystemMessage)
+	}
+	for len(turns) > 0 && turns[0].Role == llm.RoleSystem {
+		system = append(system, turns[0].Content)
+		turns = turns[1:]
+	}
+	if len(turns) == 0 || turns[len(turns)-1].Role != llm.RoleUser {
+		return fmt.Errorf("messages must end with a user turn")
+	}
+
+	req.SystemMessage = strings.Join(system, "\n\n")
+	req.UserMessage = turns[len(turns)-1].Content
+	req.Messages = turns[:len(turns)-1]
+	return nil
+}
+
+// conversation is a request's conversation, as a row records it.
+func conversation(req llm.GenerateRequest) []llm.Message {
+	var turns []llm.Message
+	if req.SystemMessage != "" {
+		turns = append(turns, llm.Message{Role: llm.RoleSystem, Content: req.SystemMessage})
+	}
+	turns = append(turns, req.Messages...)
+	return append(turns, llm.Message{Role: llm.RoleUser, Content: req.UserMessage})
+}
+
 // loadSources resolves the steps referenced by the prompt and reads each of
 // their output files once into memory, indexed by row.
-func loadSources(base *promptbuilder.PromptBuilder, cfg *config.Config, total int) ([]sourceRows, error) {
+func loadSources(base *promptbuilder.PromptBuilder, cfg *config.Config, step config.Step, total int) ([]sourceRows, error) {
 	var sources []sourceRows
 	for stepName, fieldPaths := range base.GroupPlaceholdersByStep() {
 		refStep := cfg.GetStepByName(stepName)
@@ -196,7 +560,7 @@ func loadSources(base *promptbuilder.PromptBuilder, cfg *config.Config, total in
 			return nil, fmt.Errorf("prompt references unknown step '%s'", stepName)
 		}
 
-		lines, err := readAllLines(refStep.OutputFilename, total)
+		lines, err := sourceLines(cfg, step, *refStep, total)
 		if err != nil {
 			return nil, fmt.Errorf("failed to read values from step '%s': %w", stepName, err)
 		}
@@ -229,30 +593,36 @@ func readAllLines(path string, limit int) ([]string, error) {
 	return lines, nil
 }
 
-// generate runs rows through runRow with up to `workers` in flight and writes
-// their results to the writer in row order. A single collector goroutine keeps
-// output deterministic and streams each row as soon as its predecessors are
-// done, so a mid-run failure still leaves the completed prefix on disk.
-func generate(ctx context.Context, total, workers int, writer *jsonl.Writer, runRow func(context.Context, int) (jsonl.LineEntity, error)) error {
-	if total == 0 {
+// generate runs rows start..total-1 through runRow with as many in flight as
+// the adaptive limit allows and writes their results to the writer in row order. A single
+// collector goroutine keeps output deterministic and streams each row as soon
+// as its predecessors are done, so a mid-run failure still leaves the completed
+// prefix on disk — which is exactly what a resumed run continues from. A nil
+// line from runRow is a skipped row: it holds its place in the order but
+// writes nothing.
+func generate(ctx context.Context, start, total int, limit *adaptiveLimit, writer *jsonl.Writer, runRow func(context.Context, int) (*jsonl.LineEntity, error)) error {
+	if start >= total {
 		return nil
 	}
 
-	results := make([]jsonl.LineEntity, total)
-	done := make(chan int, total)
+	pending := total - start
+	results := make([]*jsonl.LineEntity, pending)
+	done := make(chan int, pending)
 	writeErr := make(chan error, 1)
 
 	go func() {
-		arrived := make([]bool, total)
+		arrived := make([]bool, pending)
 		next := 0
 		for i := range done {
 			arrived[i] = true
-			for next < total && arrived[next] {
-				if err := writer.WriteLine(results[next]); err != nil {
-					writeErr <- fmt.Errorf("failed to write output line: %w", err)
-					return
+			for next < pending && arrived[next] {
+				if results[next] != nil {
+					if err := writer.WriteLine(*results[next]); err != nil {
+						writeErr <- fmt.Errorf("failed to write output line: %w", err)
+						return
+					}
 				}
-				results[next] = jsonl.LineEntity{} // let the written row be GC'd
+				results[next] = nil // let the written row be GC'd
 				next++
 			}
 		}
@@ -260,15 +630,19 @@ func generate(ctx context.Context, total, workers int, writer *jsonl.Writer, run
 	}()
 
 	g, gctx := errgroup.WithContext(ctx)
-	g.SetLimit(workers)
-	for i := range total {
+	g.SetLimit(limit.ceiling)
+	for i := start; i < total; i++ {
 		g.Go(func() error {
+			if err := limit.acquire(gctx); err != nil {
+				return err
+			}
 			line, err := runRow(gctx, i)
+			limit.release()
 			if err != nil {
 				return err
 			}
-			results[i] = line
-			done <- i
+			results[i-start] = line
+			done <- i - start
 			return nil
 		})
 	}
@@ -11,6 +11,7 @@ import (
 	"github.com/mirpo/datamatic/config"
 	"github.com/mirpo/datamatic/fs"
 	"github.com/mirpo/datamatic/internal/llmtest"
+	"github.com/mirpo/datamatic/jsonl"
 	"github.com/mirpo/datamatic/jsonschema"
 	"github.com/mirpo/datamatic/llm"
 	"github.com/stretchr/testify/assert"
@@ -71,6 +72,28 @@ func TestPromptStepRun_WritesResolvedCountLines(t *testing.T) {
 	assert.Equal(t, 3, srv.CallCount())
 }
 
+func TestPromptStepRun_ResumeGeneratesOnlyMissingRows(t *testing.T) {
+	srv := llmtest.NewServer(t, "hello world")
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	cfg.Resume = true
+	step.ResolvedCount = 5
+
+	// two complete rows from an interrupted run, plus a torn third line
+	prefix := `{"id":"r0","format":"text","prompt":"p","response":"kept 0"}` + "\n" +
+		`{"id":"r1","format":"text","prompt":"p","response":"kept 1"}` + "\n"
+	require.NoError(t, os.WriteFile(step.OutputFilename, []byte(prefix+`{"id":"r2","fo`), 0o644))
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	assert.Equal(t, 3, srv.CallCount(), "only the missing rows are requested")
+	lines := readOutput(t, step.OutputFilename)
+	require.Len(t, lines, 5)
+	assert.Contains(t, lines[0], "kept 0")
+	assert.Contains(t, lines[1], "kept 1")
+	assert.Contains(t, lines[2], "hello world")
+}
+
 func TestPromptStepRun_UnknownRefStepReturnsError(t *testing.T) {
 	srv := llmtest.NewServer(t, "never reached")
 	cfg, step, dir := promptStepConfig(t, srv.URL)
@@ -220,11 +243,24 @@ func TestPromptStepRun_ConcurrentRowFailureCancelsAndPreservesPrefix(t *testing.
 	// the step must fail and stop, not hang.
 	srv := llmtest.NewServer(t, `{"title":"ok"}`)
 	cfg, step, dir := promptStepConfig(t, srv.URL)
+	titledSource(t, cfg, dir)
+	step.ForEach = "src"
+	step.ResolvedCount = 6
+	step.Concurrency = 2
+	step.Prompt = "use {{.src.title}}"
 
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+	require.Error(t, err, "a failing row must fail the whole step")
+	assert.Contains(t, err.Error(), "title")
+}
+
+// titledSource writes a 6-row source whose row 3 has no "title" field, so a
+// prompt reading {{.src.title}} fails on that row only.
+func titledSource(t *testing.T, cfg *config.Config, dir string) {
+	t.Helper()
 	srcPath := filepath.Join(dir, "src.jsonl")
 	var lines string
 	for i := range 6 {
-		// row 3 has no "title" field, others do
 		if i == 3 {
 			lines += `{"id":"r3","format":"json","prompt":"p","response":{"other":1}}` + "\n"
 		} else {
@@ -232,18 +268,104 @@ func TestPromptStepRun_ConcurrentRowFailureCancelsAndPreservesPrefix(t *testing.
 		}
 	}
 	require.NoError(t, os.WriteFile(srcPath, []byte(lines), 0o644))
-
 	cfg.Steps = []config.Step{
 		{Name: "src", Type: config.PromptStepType, OutputFilename: srcPath, JSONSchema: testSchema(t, titleSchema)},
 	}
+}
+
+func TestPromptStepRun_SkipRecordsRejectAndContinues(t *testing.T) {
+	srv := llmtest.NewServer(t, "ok")
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	titledSource(t, cfg, dir)
 	step.ForEach = "src"
 	step.ResolvedCount = 6
 	step.Concurrency = 2
 	step.Prompt = "use {{.src.title}}"
+	step.OnError = config.OnErrorSkip
 
 	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
-	require.Error(t, err, "a failing row must fail the whole step")
-	assert.Contains(t, err.Error(), "title")
+	require.NoError(t, err)
+
+	lines := readOutput(t, step.OutputFilename)
+	require.Len(t, lines, 5, "the failed row is left out")
+	assert.Contains(t, lines[3], `"row":4`, "rows record their index once the output has gaps")
+
+	rejects := readOutput(t, filepath.Join(dir, "gen.rejects.jsonl"))
+	require.Len(t, rejects, 1)
+	var rejected map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(rejects[0]), &rejected))
+	assert.EqualValues(t, 3, rejected["row"])
+	assert.Contains(t, rejected["error"], "title")
+}
+
+func TestPromptStepRun_SkipFailsPastMaxErrors(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"wrong":true}`)
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	cfg.RetryConfig.MaxAttempts = 1
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 4
+	step.OnError = config.OnErrorSkip
+	step.MaxErrors = 2
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "more than maxErrors (2)")
+	rejects := readOutput(t, filepath.Join(dir, "gen.rejects.jsonl"))
+	assert.Contains(t, rejects[0], `"response":"{\"wrong\":true}"`, "the last raw response is kept")
+}
+
+func TestPromptStepRun_ResumeDropsRejectsOfRowsGeneratedAgain(t *testing.T) {
+	srv := llmtest.NewServer(t, "hello world")
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	cfg.Resume = true
+	step.ResolvedCount = 4
+	step.OnError = config.OnErrorSkip
+
+	// the interrupted run wrote rows 0 and 2 and rejected rows 1 and 3; it
+	// resumes after row 2, so row 3 is generated again
+	prefix := `{"id":"r0","format":"text","prompt":"p","response":"kept 0","row":0}` + "\n" +
+		`{"id":"r2","format":"text","prompt":"p","response":"kept 2","row":2}` + "\n"
+	require.NoError(t, os.WriteFile(step.OutputFilename, []byte(prefix), 0o644))
+	rejectsPath := filepath.Join(dir, "gen.rejects.jsonl")
+	require.NoError(t, os.WriteFile(rejectsPath, []byte(`{"row":3,"error":"stale"}`+"\n"+`{"row":1,"error":"kept"}`+"\n"+`{"row":2,"er`), 0o644))
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	assert.Equal(t, 1, srv.CallCount())
+	rejects := readOutput(t, rejectsPath)
+	require.Len(t, rejects, 1)
+	assert.Contains(t, rejects[0], `"row":1`)
+}
+
+func TestPromptStepRun_MockRowsAreStableAcrossConcurrentRuns(t *testing.T) {
+	cfg, step, dir := promptStepConfig(t, "")
+	step.ModelConfig = config.ModelConfig{ModelProvider: llm.ProviderMock, ModelName: "dev"}
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 64
+	step.Concurrency = 8
+
+	responses := func() []string {
+		err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+		require.NoError(t, err)
+		var responses []string
+		for _, line := range readOutput(t, step.OutputFilename) {
+			var entity jsonl.LineEntity
+			require.NoError(t, json.Unmarshal([]byte(line), &entity))
+			response, err := json.Marshal(entity.Response)
+			require.NoError(t, err)
+			responses = append(responses, string(response))
+		}
+		return responses
+	}
+
+	first := responses()
+	require.Len(t, first, 64)
+	assert.NotEqual(t, first[0], first[1], "identical prompts still give each row its own value")
+	for range 3 {
+		assert.Equal(t, first, responses(), "rows finishing in another order get the same values")
+	}
 }
 
 func TestPromptStepRun_NativeTemplateRendering(t *testing.T) {
@@ -280,3 +402,191 @@ func TestPromptStepRun_NativeTemplateRendering(t *testing.T) {
 	assert.Contains(t, string(data), `"value":["Kyrgyz","Russian"]`, "arrays stay arrays in values")
 	assert.Contains(t, string(data), `"value":false`, "booleans stay boolean in values")
 }
+
+func TestPromptStepRun_AnthropicStructuredOutputRetriesOverload(t *testing.T) {
+	t.Setenv("ANTHROPIC_API_KEY", "test-key")
+	srv := llmtest.NewAnthropicServer(t, `{"title":"Tides"}`)
+	srv.FailFirst = 1 // 529 overloaded, then answers
+
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	cfg.RetryConfig.InitialDelay = time.Millisecond
+	step.ModelConfig.ModelProvider = llm.ProviderAnthropic
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 1
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, srv.CallCount())
+	data, err := os.ReadFile(step.OutputFilename)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"response":{"title":"Tides"}`)
+}
+
+func TestPromptStepRun_FallsBackWhenTheModelGivesUp(t *testing.T) {
+	primary := llmtest.NewServer(t, `{"title":"never"}`)
+	primary.FailFirst = 100
+	fallback := llmtest.NewServer(t, `{"title":"Tides"}`)
+
+	cfg, step, dir := promptStepConfig(t, primary.URL)
+	cfg.RetryConfig.MaxAttempts = 2
+	cfg.RetryConfig.InitialDelay = time.Millisecond
+	step.Model = "ollama:test-model"
+	step.Models = config.ModelChain{
+		{Model: step.Model},
+		{Model: "lmstudio:backup", ModelConfig: &config.ModelConfig{ModelProvider: llm.ProviderLmStudio, ModelName: "backup", BaseURL: fallback.URL}},
+	}
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 2
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	assert.Equal(t, 4, primary.CallCount(), "each row exhausts its retries on the primary first")
+	assert.Equal(t, 2, fallback.CallCount())
+
+	data, err := os.ReadFile(step.OutputFilename)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"response":{"title":"Tides"}`)
+	assert.Contains(t, string(data), `"model":"lmstudio:backup"`)
+}
+
+func TestPromptStepRun_StripsReasoningAndKeepsItOnRequest(t *testing.T) {
+	srv := llmtest.NewServer(t, "<think>\nThe user wants a title.\n</think>\n\n{\"title\":\"Tides\"}")
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 1
+	step.KeepReasoning = true
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	data, err := os.ReadFile(step.OutputFilename)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"response":{"title":"Tides"}`)
+	assert.Contains(t, string(data), `"reasoning":"The user wants a title."`)
+}
+
+func TestPromptStepRun_DropsReasoningContentByDefault(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"title":"Tides"}`)
+	srv.Reasoning = "Short and evocative."
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	step.ModelConfig.ModelProvider = llm.ProviderLmStudio
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 1
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	data, err := os.ReadFile(step.OutputFilename)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"response":{"title":"Tides"}`)
+	assert.NotContains(t, string(data), "reasoning")
+}
+
+func TestPromptStepRun_RepairFollowsUpOnTheInvalidAnswer(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"wrong":true}`, `{"still":"wrong"}`, `{"title":"Tides"}`)
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 1
+	step.Repair = true
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	requests := srv.Requests()
+	require.Len(t, requests, 3)
+
+	repair := requests[1]["messages"].([]interface{})
+	require.Len(t, repair, 3)
+	answer := repair[1].(map[string]interface{})
+	assert.Equal(t, "assistant", answer["role"])
+	assert.Equal(t, `{"wrong":true}`, answer["content"])
+	followup := repair[2].(map[string]interface{})
+	assert.Equal(t, "user", followup["role"])
+	assert.Contains(t, followup["content"], "title")
+
+	assert.Len(t, requests[2]["messages"], 1, "a failed repair is not repaired again")
+}
+
+func TestPromptStepRun_ChecksAnswersTheServerDidNotHoldToTheSchema(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"wrong":true}`, `{"title":"Tides"}`)
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	cfg.ValidateResponse = false
+	step.ModelConfig.StructuredOutput = llm.StructuredOutputPrompt
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 1
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, srv.CallCount(), "the invalid answer is caught despite --validate-response=false")
+	assert.Nil(t, srv.Requests()[0]["response_format"])
+}
+
+func TestPromptStepRun_JSONRepairFixesTheAnswerAndRecordsIt(t *testing.T) {
+	srv := llmtest.NewServer(t, `{"title": "Ti`, `Here you go: {'title': 'Tides',} Enjoy!`)
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+	step.JSONSchema = testSchema(t, titleSchema)
+	step.ResolvedCount = 1
+	step.JSONRepair = true
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+
+	require.NoError(t, err)
+	assert.Equal(t, 2, srv.CallCount(), "a truncated answer can't be repaired")
+	data, err := os.ReadFile(step.OutputFilename)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"response":{"title":"Tides"}`)
+	assert.Contains(t, string(data), `"jsonRepaired":true`)
+}
+
+func TestPromptStepRun_MessagesWithFewShotTurnsFromAnEarlierStep(t *testing.T) {
+	srv := llmtest.NewServer(t, "10")
+	cfg, step, dir := promptStepConfig(t, srv.URL)
+
+	examplesPath := filepath.Join(dir, "examples.jsonl")
+	line := `{"id":"e1","format":"json","prompt":"p","response":{"pairs":[{"q":"2+2","a":"4"},{"q":"3+3","a":"6"}]}}` + "\n"
+	require.NoError(t, os.WriteFile(examplesPath, []byte(line), 0o644))
+	cfg.Steps = []config.Step{
+		{Name: "examples", Type: config.PromptStepType, OutputFilename: examplesPath, JSONSchema: testSchema(t, `{
+			"type":"object",
+			"properties":{"pairs":{"type":"array"}},
+			"required":["pairs"],
+			"additionalProperties":false
+		}`)},
+	}
+	step.Prompt = ""
+	step.Messages = []config.Message{
+		{Role: "system", Content: "You answer arithmetic."},
+		{Range: ".examples.pairs", Messages: []config.Message{
+			{Role: "user", Content: "{{.q}}"},
+			{Role: "assistant", Content: "{{.a}}"},
+		}},
+		{Role: "user", Content: "5+5"},
+	}
+	step.ResolvedCount = 1
+
+	err := (&PromptStep{}).Run(context.Background(), cfg, step, dir)
+	require.NoError(t, err)
+
+	var sent []string
+	for _, m := range srv.Requests()[0]["messages"].([]interface{}) {
+		message := m.(map[string]interface{})
+		sent = append(sent, message["role"].(string)+": "+message["content"].(string))
+	}
+	assert.Equal(t, []string{
+		"system: You answer arithmetic.",
+		"user: 2+2", "assistant: 4",
+		"user: 3+3", "assistant: 6",
+		"user: 5+5",
+	}, sent)
+
+	data, err := os.ReadFile(step.OutputFilename)
+	require.NoError(t, err)
+	var written jsonl.LineEntity
+	require.NoError(t, json.Unmarshal(data, &written))
+	assert.Equal(t, "5+5", written.Prompt)
+	require.Len(t, written.Messages, 6)
+	assert.Equal(t, llm.Message{Role: "assistant", Content: "6"}, written.Messages[4])
+}
@@ -0,0 +1,127 @@
+package step
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mirpo/datamatic/config"
+	"github.com/mirpo/datamatic/jsonl"
+)
+
+// rowError is a row that could not be generated, with what the rejects file
+// records about it: the prompt sent and the last raw response received.
+type rowError struct {
+	prompt   string
+	response string
+	err      error
+}
+
+func (e *rowError) Error() string { return e.err.Error() }
+func (e *rowError) Unwrap() error { return e.err }
+
+// rejectedRow is one line of a step's rejects file.
+type rejectedRow struct {
+	Row      int    `json:"row"`
+	Prompt   string `json:"prompt,omitempty"`
+	Response string `json:"response,omitempty"`
+	Error    string `json:"error"`
+}
+
+// rejectsFilename places the rejects next to the step's output:
+// <step>.jsonl -> <step>.rejects.jsonl.
+func rejectsFilename(step config.Step) string {
+	return strings.TrimSuffix(step.OutputFilename, ".jsonl") + ".rejects.jsonl"
+}
+
+// rejectsWriter records skipped rows; rows fail concurrently, so writes are
+// serialized.
+type rejectsWriter struct {
+	mu     sync.Mutex
+	writer *jsonl.Writer
+}
+
+// openRejects opens the rejects file of a step with onError: skip. A run
+// resumed at row start keeps the rejects of the rows before it; the rows from
+// start on are generated again, and so are their rejects.
+func openRejects(cfg *config.Config, step config.Step, start int) (*rejectsWriter, error) {
+	path := rejectsFilename(step)
+	var kept []rejectedRow
+	if cfg.Resume {
+		var err error
+		if kept, err = readRejects(path, start); err != nil {
+			return nil, err
+		}
+	}
+
+	writer, err := jsonl.NewWriter(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rejects file: %w", err)
+	}
+	rejects := &rejectsWriter{writer: writer}
+	for _, rejected := range kept {
+		if err := rejects.writeRow(rejected); err != nil {
+			rejects.Close()
+			return nil, err
+		}
+	}
+	return rejects, nil
+}
+
+// readRejects returns the rejects recorded for rows before start. Rows are
+// rejected concurrently, so the file is not in row order. A line cut off by a
+// crash is dropped.
+func readRejects(path string, start int) ([]rejectedRow, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open rejects file: %w", err)
+	}
+	defer file.Close()
+
+	var kept []rejectedRow
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			return kept, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read rejects file: %w", err)
+		}
+
+		var rejected rejectedRow
+		if json.Unmarshal(line, &rejected) == nil && rejected.Row < start {
+			kept = append(kept, rejected)
+		}
+	}
+}
+
+func (r *rejectsWriter) write(row int, err error) error {
+	rejected := rejectedRow{Row: row, Error: err.Error()}
+	if re, ok := err.(*rowError); ok {
+		rejected.Prompt = re.prompt
+		rejected.Response = re.response
+	}
+	return r.writeRow(rejected)
+}
+
+func (r *rejectsWriter) writeRow(rejected rejectedRow) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := r.writer.WriteJSON(rejected); err != nil {
+		return fmt.Errorf("failed to write rejected row: %w", err)
+	}
+	return nil
+}
+
+func (r *rejectsWriter) Close() error {
+	return r.writer.Close()
+}
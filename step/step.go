@@ -23,6 +23,8 @@ func NewStepRunner(step config.Step) (StepRunner, error) {
 		return &ReadStep{}, nil
 	case config.WriteStepType:
 		return &WriteStep{}, nil
+	case config.ConversationStepType:
+		return &ConversationStep{}, nil
 	default:
 		return nil, errors.New("unsupported step type")
 	}
@@ -33,7 +33,7 @@ func TestNewStepRunner_UnsupportedStep(t *testing.T) {
 	assert.EqualError(t, err, "unsupported step type")
 }
 
-func TestNewProviderConfigFromStep(t *testing.T) {
+func TestNewProviderConfig(t *testing.T) {
 	temp := 0.7
 	maxTokens := 1000
 
@@ -47,7 +47,7 @@ func TestNewProviderConfigFromStep(t *testing.T) {
 		},
 	}
 
-	result := newProviderConfigFromStep(step, 30)
+	result := newProviderConfig(step.ModelConfig, 30)
 
 	assert.Equal(t, "http://example.com/api", result.BaseURL)
 	assert.Equal(t, llm.ProviderOllama, result.ProviderType)
@@ -3,6 +3,7 @@ package step
 import (
 	"encoding/json"
 	"fmt"
+	"slices"
 	"strings"
 
 	"github.com/google/uuid"
@@ -20,8 +21,9 @@ func uuidFromString(input string) string {
 // getSourceDataFromLine extracts the data, record ID and raw lineage values
 // from a step line.
 // Shell steps: full line is an unknown JSON, no lineage.
-// Prompt steps: line is a datamatic LineEntity — data is the response;
-// lineage values come back as-is (unfold them lazily via jsonl.UnfoldLineage).
+// Prompt and conversation steps: line is a datamatic LineEntity — data is the
+// response; lineage values come back as-is (unfold them lazily via
+// jsonl.UnfoldLineage).
 // Transform and read steps: full line is a raw JSON value, no lineage.
 func getSourceDataFromLine(step config.Step, line string) (interface{}, string, map[string]promptbuilder.ValueShort, error) {
 	switch step.Type {
@@ -32,10 +34,10 @@ func getSourceDataFromLine(step config.Step, line string) (interface{}, string,
 		}
 		return decoded, "", nil, nil
 
-	case config.PromptStepType:
+	case config.PromptStepType, config.ConversationStepType:
 		var decoded jsonl.LineEntity
 		if err := json.Unmarshal([]byte(line), &decoded); err != nil {
-			return nil, "", nil, fmt.Errorf("prompt step: failed to parse JSON: %w", err)
+			return nil, "", nil, fmt.Errorf("%s step: failed to parse JSON: %w", step.Type, err)
 		}
 		return decoded.Response, decoded.ID, decoded.Values, nil
 
@@ -88,11 +90,18 @@ func extractStepValues(step config.Step, line string, fieldPaths []string) (map[
 		return nil, err
 	}
 
+	reasoning, err := keptReasoning(step, line, fieldPaths)
+	if err != nil {
+		return nil, err
+	}
+
 	result := make(map[string]promptbuilder.StepValue)
 	for _, fieldPath := range fieldPaths {
 		var value interface{}
 
-		if step.Type == config.PromptStepType && !step.JSONSchema.HasSchemaDefinition() {
+		if reasoning != nil && fieldPath == config.ReasoningField {
+			value = *reasoning
+		} else if step.Type == config.PromptStepType && !step.JSONSchema.HasSchemaDefinition() {
 			str, ok := sourceData.(string)
 			if !ok {
 				return nil, fmt.Errorf("prompt step: expected string response, got %T", sourceData)
@@ -119,3 +128,18 @@ func extractStepValues(step config.Step, line string, fieldPaths []string) (map[
 
 	return result, nil
 }
+
+// keptReasoning returns the reasoning of a prompt step's line when the step
+// keeps it and a template asks for it, and nil otherwise.
+func keptReasoning(step config.Step, line string, fieldPaths []string) (*string, error) {
+	if step.Type != config.PromptStepType || !step.KeepReasoning || !slices.Contains(fieldPaths, config.ReasoningField) {
+		return nil, nil
+	}
+	var decoded struct {
+		Reasoning string `json:"reasoning"`
+	}
+	if err := json.Unmarshal([]byte(line), &decoded); err != nil {
+		return nil, fmt.Errorf("prompt step: failed to parse JSON: %w", err)
+	}
+	return &decoded.Reasoning, nil
+}
@@ -4,7 +4,9 @@ import (
 	"errors"
 	"fmt"
 	"path/filepath"
+	"reflect"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/mirpo/datamatic/config"
@@ -24,9 +26,9 @@ const jqParentVar = "$parent"
 // setStepType determines and sets the step type based on step configuration
 func setStepType(step *config.Step) error {
 	switch step.Type {
-	case "", config.PromptStepType, config.ShellStepType, config.TransformStepType, config.ReadStepType, config.WriteStepType:
+	case "", config.PromptStepType, config.ShellStepType, config.TransformStepType, config.ReadStepType, config.WriteStepType, config.ConversationStepType:
 	default:
-		return fmt.Errorf("unknown step type '%s' (expected 'prompt', 'shell', 'transform', 'read' or 'write')", step.Type)
+		return fmt.Errorf("unknown step type '%s' (expected 'prompt', 'shell', 'transform', 'read', 'write' or 'conversation')", step.Type)
 	}
 
 	var inferred config.StepType
@@ -34,6 +36,8 @@ func setStepType(step *config.Step) error {
 	count := 0
 	if step.Prompt != "" {
 		inferred, sourceField, count = config.PromptStepType, "prompt", count+1
+	} else if len(step.Messages) > 0 {
+		inferred, sourceField, count = config.PromptStepType, "messages", count+1
 	}
 	if step.Run != "" {
 		inferred, sourceField, count = config.ShellStepType, "run", count+1
@@ -47,8 +51,11 @@ func setStepType(step *config.Step) error {
 	if step.Write != "" {
 		inferred, sourceField, count = config.WriteStepType, "write", count+1
 	}
+	if step.User != nil {
+		inferred, sourceField, count = config.ConversationStepType, "user", count+1
+	}
 	if count != 1 {
-		return errors.New("exactly one of 'prompt', 'run', 'jq', 'read' or 'write' must be defined")
+		return errors.New("exactly one of 'prompt', 'run', 'jq', 'read', 'write' or 'user' must be defined")
 	}
 
 	if step.Type != "" && step.Type != inferred {
@@ -74,6 +81,16 @@ func PreprocessConfig(cfg *config.Config) error {
 		return fmt.Errorf("setting root output folder: %w", err)
 	}
 
+	if err := setCache(cfg); err != nil {
+		return fmt.Errorf("setting response cache: %w", err)
+	}
+
+	for provider := range cfg.RateLimits {
+		if !isValidProvider(llm.ProviderType(provider)) {
+			return fmt.Errorf("rateLimits: unsupported provider: %s", provider)
+		}
+	}
+
 	// retryConfig not set in YAML (zero values) falls back to defaults
 	if cfg.RetryConfig.MaxAttempts == 0 {
 		cfg.RetryConfig = retry.NewDefaultConfig()
@@ -123,6 +140,13 @@ func PreprocessConfig(cfg *config.Config) error {
 			}
 		}
 
+		// Conversation steps
+		if step.Type == config.ConversationStepType {
+			if err := setConversationDetails(step); err != nil {
+				return fmt.Errorf("step '%s': %w", step.Name, err)
+			}
+		}
+
 		// Shell steps
 		if step.Type == config.ShellStepType {
 			if step.OutputFilename == "" {
@@ -142,8 +166,8 @@ func PreprocessConfig(cfg *config.Config) error {
 			step.OutputFilename = filepath.Join(step.WorkDir, step.OutputFilename)
 		}
 
-		// Prompt steps
-		if step.Type == config.PromptStepType {
+		// Prompt and conversation steps
+		if step.Type == config.PromptStepType || step.Type == config.ConversationStepType {
 			if err := setOutputFilename(step, cfg.OutputFolder); err != nil {
 				return fmt.Errorf("step '%s': %w", step.Name, err)
 			}
@@ -238,12 +262,44 @@ func PreprocessConfig(cfg *config.Config) error {
 			return fmt.Errorf("step '%s': %w", step.Name, err)
 		}
 
-		if step.Type == config.PromptStepType {
+		if err := validateErrorHandling(step); err != nil {
+			return fmt.Errorf("step '%s': %w", step.Name, err)
+		}
+
+		if err := validateBatch(step); err != nil {
+			return fmt.Errorf("step '%s': %w", step.Name, err)
+		}
+
+		if step.KeepReasoning && step.Type != config.PromptStepType {
+			return fmt.Errorf("step '%s': 'keepReasoning' is only valid on prompt steps", step.Name)
+		}
+
+		if step.Type != config.ConversationStepType && (step.MaxTurns != 0 || step.StopWhen != "") {
+			return fmt.Errorf("step '%s': 'maxTurns' and 'stopWhen' are only valid on conversation steps", step.Name)
+		}
+
+		if err := validateMessages(step); err != nil {
+			return fmt.Errorf("step '%s': %w", step.Name, err)
+		}
+
+		if err := validateRepair(step); err != nil {
+			return fmt.Errorf("step '%s': %w", step.Name, err)
+		}
+
+		if err := validateJSONRepair(step); err != nil {
+			return fmt.Errorf("step '%s': %w", step.Name, err)
+		}
+
+		if step.Type == config.PromptStepType || step.Type == config.ConversationStepType {
 			if err := validatePromptPlaceholders(step, stepByName); err != nil {
 				return fmt.Errorf("step '%s': %w", step.Name, err)
 			}
 		}
 
+		if err := setDependencies(step); err != nil {
+			return fmt.Errorf("step '%s': %w", step.Name, err)
+		}
+
 		stepNames[step.Name] = true
 		stepByName[step.Name] = step
 	}
@@ -257,7 +313,7 @@ func PreprocessConfig(cfg *config.Config) error {
 // must match their JSON schema, and a step may not be referenced both as a
 // whole and by field in one prompt.
 func validatePromptPlaceholders(step *config.Step, stepByName map[string]*config.Step) error {
-	builder, err := promptbuilder.NewPromptBuilder(step.Prompt, step.ForEach, step.Image)
+	builder, err := newTemplateBuilder(step)
 	if err != nil {
 		return err
 	}
@@ -276,11 +332,29 @@ func validatePromptPlaceholders(step *config.Step, stepByName map[string]*config
 			return fmt.Errorf("prompt references write step '%s', which is terminal and produces no rows", ref.Step)
 		}
 
+		if err := validateAlignment(step, ref.Step, stepByName); err != nil {
+			return err
+		}
+
 		if keysByStep[ref.Step] == nil {
 			keysByStep[ref.Step] = map[bool]bool{}
 		}
 		keysByStep[ref.Step][ref.Key == ""] = true
 
+		if ref.Key == config.ReasoningField && refStep.Type == config.PromptStepType && refStep.KeepReasoning {
+			if refStep.JSONSchema.HasSchemaDefinition() && refStep.JSONSchema.HasFieldPath(ref.Key) {
+				return fmt.Errorf("'%s' of step '%s' is ambiguous: the step keeps its reasoning and its schema has a '%s' field too; rename the schema field",
+					ref.Key, ref.Step, ref.Key)
+			}
+			continue
+		}
+
+		if ref.Key != "" && refStep.Type == config.ConversationStepType {
+			if field, _, _ := strings.Cut(ref.Key, "."); field != "messages" {
+				return fmt.Errorf("field path '%s' not found in conversation step '%s' (its rows have 'messages')", ref.Key, ref.Step)
+			}
+		}
+
 		if ref.Key != "" && refStep.Type == config.PromptStepType {
 			if !refStep.JSONSchema.HasSchemaDefinition() {
 				return fmt.Errorf("step '%s' must have a JSON schema to reference field '%s'", ref.Step, ref.Key)
@@ -300,13 +374,169 @@ func validatePromptPlaceholders(step *config.Step, stepByName map[string]*config
 	return nil
 }
 
-// setModelDetails extracts and sets provider and model details in step config
+// validateAlignment checks that the rows of a referenced step can be lined
+// up with the step's own. The output of a step that skips failed rows
+// (onError: skip) has gaps, and its recorded row indexes are only followed
+// along forEach links between prompt and conversation steps; reading such a
+// step any other way, or reading anything off that chain while iterating past
+// one, would silently give a row another row's values.
+func validateAlignment(step *config.Step, refName string, stepByName map[string]*config.Step) error {
+	if onForEachChain(step, refName, stepByName) {
+		return nil
+	}
+	if ref := stepByName[refName]; ref != nil && ref.OnError == config.OnErrorSkip {
+		return fmt.Errorf("step '%s' skips failed rows, so its rows can't be lined up with this step's: reference it through a forEach chain of prompt steps (forEach: %s)", refName, refName)
+	}
+	for name := step.ForEach; name != ""; {
+		hop := stepByName[name]
+		if hop == nil {
+			break
+		}
+		if hop.OnError == config.OnErrorSkip {
+			return fmt.Errorf("rows come from step '%s', which skips failed rows, through a chain '%s' is not on: its rows can't be lined up with this step's", hop.Name, refName)
+		}
+		name = hop.ForEach
+		if name == "" {
+			name = hop.From
+		}
+	}
+	return nil
+}
+
+// onForEachChain reports whether a step reaches ref by following forEach
+// links through prompt and conversation steps: the chain along which rows
+// are mapped back across gaps.
+func onForEachChain(step *config.Step, ref string, stepByName map[string]*config.Step) bool {
+	for name := step.ForEach; name != ""; {
+		if name == ref {
+			return true
+		}
+		hop := stepByName[name]
+		if hop == nil || (hop.Type != config.PromptStepType && hop.Type != config.ConversationStepType) {
+			return false
+		}
+		name = hop.ForEach
+	}
+	return false
+}
+
+// setDependencies records which earlier steps a step reads: the from/forEach
+// source plus, for prompt and conversation steps, every step their templates
+// reference. The references were already checked against earlier steps above,
+// so this only collects their names. Shell steps declare nothing — their
+// command may read anything, so the runner orders them conservatively.
+func setDependencies(step *config.Step) error {
+	deps := map[string]bool{}
+	for _, name := range []string{step.From, step.ForEach} {
+		if name != "" {
+			deps[name] = true
+		}
+	}
+
+	if step.Type == config.PromptStepType || step.Type == config.ConversationStepType {
+		builder, err := newTemplateBuilder(step)
+		if err != nil {
+			return err
+		}
+		for name := range builder.GroupPlaceholdersByStep() {
+			deps[name] = true
+		}
+	}
+
+	step.DependsOn = make([]string, 0, len(deps))
+	for name := range deps {
+		step.DependsOn = append(step.DependsOn, name)
+	}
+	sort.Strings(step.DependsOn)
+	return nil
+}
+
+// newTemplateBuilder parses every template a step renders per row, and its
+// image path, to find the steps they reference.
+func newTemplateBuilder(step *config.Step) (*promptbuilder.PromptBuilder, error) {
+	templates := step.Templates()
+	return promptbuilder.NewPromptBuilder(templates[0], step.ForEach, append(templates[1:], step.Image)...)
+}
+
+// setConversationDetails resolves a conversation step's two models and its
+// defaults. A user without a model of its own is played by the step's model.
+func setConversationDetails(step *config.Step) error {
+	if err := setModelDetails(step); err != nil {
+		return fmt.Errorf("processing model details: %w", err)
+	}
+
+	user := step.User
+	if user.Model == "" {
+		if !reflect.DeepEqual(user.ModelConfig, config.ModelConfig{}) {
+			return errors.New("user: 'modelConfig' needs a 'model'")
+		}
+		user.Model, user.ModelConfig = step.Model, step.ModelConfig
+	} else if err := parseModel(user.Model, &user.ModelConfig); err != nil {
+		return fmt.Errorf("user: %w", err)
+	}
+	if user.Prompt == "" {
+		user.Prompt = config.DefaultConversationOpener
+	}
+
+	if step.JSONSchemaRaw != nil {
+		return errors.New("'jsonSchema' is not valid on conversation steps: their rows are transcripts")
+	}
+	if step.MaxTurns < 0 {
+		return errors.New("maxTurns must be >= 1")
+	}
+	if step.MaxTurns == 0 {
+		step.MaxTurns = config.DefaultMaxTurns
+	}
+	if step.StopWhen != "" {
+		program, err := jq.Compile(step.StopWhen)
+		if err != nil {
+			return fmt.Errorf("stopWhen: %w", err)
+		}
+		step.StopProgram = program
+	}
+	return nil
+}
+
+// setModelDetails extracts and sets provider and model details in step config.
+// The first model of the step's chain is the step's own; every fallback gets
+// a resolved copy of the step's modelConfig unless it brings its own.
 func setModelDetails(step *config.Step) error {
-	if step.Model == "" {
+	if len(step.Models) == 0 && step.Model != "" {
+		step.Models = config.ModelChain{{Model: step.Model}}
+	}
+	if len(step.Models) == 0 {
+		return errors.New("model definition can't be empty")
+	}
+	if step.Models[0].ModelConfig != nil {
+		return errors.New("the first model uses the step's modelConfig and can't set its own")
+	}
+
+	step.Model = step.Models[0].Model
+	if err := parseModel(step.Model, &step.ModelConfig); err != nil {
+		return err
+	}
+
+	for i := 1; i < len(step.Models); i++ {
+		fallback := &step.Models[i]
+		modelConfig := step.ModelConfig
+		if fallback.ModelConfig != nil {
+			modelConfig = *fallback.ModelConfig
+		}
+		if err := parseModel(fallback.Model, &modelConfig); err != nil {
+			return fmt.Errorf("fallback model %d: %w", i, err)
+		}
+		fallback.ModelConfig = &modelConfig
+	}
+	return nil
+}
+
+// parseModel sets the provider and model name of a "provider:model" reference.
+func parseModel(ref string, modelConfig *config.ModelConfig) error {
+	if ref == "" {
 		return errors.New("model definition can't be empty")
 	}
 
-	provider, model, found := strings.Cut(step.Model, ":")
+	provider, model, found := strings.Cut(ref, ":")
 	if !found {
 		return fmt.Errorf("model should follow pattern 'provider:model', examples: 'ollama:llama3.2'")
 	}
@@ -320,15 +550,16 @@ func setModelDetails(step *config.Step) error {
 		return fmt.Errorf("unsupported provider: %s", provider)
 	}
 
-	step.ModelConfig.ModelProvider = providerType
-	step.ModelConfig.ModelName = model
+	modelConfig.ModelProvider = providerType
+	modelConfig.ModelName = model
 	return nil
 }
 
 func isValidProvider(provider llm.ProviderType) bool {
 	switch provider {
 	case llm.ProviderOllama, llm.ProviderLmStudio, llm.ProviderOpenAI,
-		llm.ProviderOpenRouter, llm.ProviderGemini:
+		llm.ProviderOpenRouter, llm.ProviderGemini, llm.ProviderAnthropic, llm.ProviderOllamaNative, llm.ProviderMock,
+		llm.ProviderOpenAICompatible:
 		return true
 	default:
 		return false
@@ -509,7 +740,7 @@ func requireEarlierStep(stepNames map[string]bool, field, name string) error {
 // validateIterationSettings checks count/forEach consistency; iteration
 // counts themselves are resolved at runtime by the runner.
 func validateIterationSettings(step *config.Step, stepNames map[string]bool) error {
-	if step.Type != config.PromptStepType {
+	if step.Type != config.PromptStepType && step.Type != config.ConversationStepType {
 		// write steps use forEach too, to emit one file per source row; that
 		// mode is validated in setWriteStepMode
 		if step.Type == config.WriteStepType {
@@ -519,10 +750,10 @@ func validateIterationSettings(step *config.Step, stepNames map[string]bool) err
 			return nil
 		}
 		if step.Count != 0 || step.ForEach != "" {
-			return fmt.Errorf("'count' and 'forEach' are only valid on prompt steps")
+			return fmt.Errorf("'count' and 'forEach' are only valid on prompt and conversation steps")
 		}
 		if step.Concurrency != 0 {
-			return fmt.Errorf("'concurrency' is only valid on prompt steps")
+			return fmt.Errorf("'concurrency' is only valid on prompt and conversation steps")
 		}
 		return nil
 	}
@@ -531,7 +762,11 @@ func validateIterationSettings(step *config.Step, stepNames map[string]bool) err
 		return fmt.Errorf("concurrency must be >= 1")
 	}
 	if step.Concurrency == 0 {
-		step.Concurrency = 1
+		// with endpoints, enough rows to keep every one of them busy
+		for _, e := range step.ModelConfig.Endpoints {
+			step.Concurrency += max(e.Concurrency, 1)
+		}
+		step.Concurrency = max(step.Concurrency, 1)
 	}
 
 	if step.Count < 0 {
@@ -549,6 +784,137 @@ func validateIterationSettings(step *config.Step, stepNames map[string]bool) err
 	return nil
 }
 
+// validateErrorHandling checks onError/maxErrors and resolves the default
+// (fail). Both only apply to prompt and conversation steps, the only ones
+// that can lose a row to a bad response.
+func validateErrorHandling(step *config.Step) error {
+	if step.Type != config.PromptStepType && step.Type != config.ConversationStepType {
+		if step.OnError != "" || step.MaxErrors != 0 {
+			return fmt.Errorf("'onError' and 'maxErrors' are only valid on prompt and conversation steps")
+		}
+		return nil
+	}
+
+	switch step.OnError {
+	case "":
+		step.OnError = config.OnErrorFail
+	case config.OnErrorFail, config.OnErrorSkip:
+	default:
+		return fmt.Errorf("unknown onError '%s' (expected '%s' or '%s')", step.OnError, config.OnErrorFail, config.OnErrorSkip)
+	}
+
+	if step.MaxErrors < 0 {
+		return fmt.Errorf("maxErrors must be >= 0")
+	}
+	if step.MaxErrors > 0 && step.OnError != config.OnErrorSkip {
+		return fmt.Errorf("'maxErrors' requires onError: %s", config.OnErrorSkip)
+	}
+	return nil
+}
+
+// validateBatch checks that a batch step's model has a batch API: only the
+// OpenAI client submits batches, to a single server and with no fallback to
+// switch to mid-job.
+func validateBatch(step *config.Step) error {
+	if !step.Batch {
+		return nil
+	}
+	if step.Type != config.PromptStepType {
+		return fmt.Errorf("'batch' is only valid on prompt steps")
+	}
+
+	provider := step.ModelConfig.ModelProvider
+	if provider != llm.ProviderOpenAI && provider != llm.ProviderOpenAICompatible {
+		return fmt.Errorf("'batch' needs the %s or %s provider, not %s", llm.ProviderOpenAI, llm.ProviderOpenAICompatible, provider)
+	}
+	if len(step.Fallbacks()) > 0 {
+		return fmt.Errorf("'batch' can't be combined with fallback models")
+	}
+	if len(step.ModelConfig.Endpoints) > 0 {
+		return fmt.Errorf("'batch' can't be combined with endpoints")
+	}
+	return nil
+}
+
+// validateMessages checks a step's conversation: every turn has a known role,
+// system turns come first, and the last turn is the user's, for the model to
+// answer.
+func validateMessages(step *config.Step) error {
+	if len(step.Messages) == 0 {
+		return nil
+	}
+	if step.Prompt != "" {
+		return fmt.Errorf("'prompt' and 'messages' can't both be set")
+	}
+	if err := validateTurns(step.Messages, true); err != nil {
+		return err
+	}
+	if last := step.Messages[len(step.Messages)-1]; last.Range != "" || last.Role != llm.RoleUser {
+		return fmt.Errorf("the last of 'messages' must be a user turn")
+	}
+	return nil
+}
+
+func validateTurns(messages []config.Message, first bool) error {
+	for i, m := range messages {
+		switch {
+		case m.Range != "":
+			if m.Role != "" || m.Content != "" {
+				return fmt.Errorf("message %d: a range has messages, not a role and content", i+1)
+			}
+			if len(m.Messages) == 0 {
+				return fmt.Errorf("message %d: range has no messages", i+1)
+			}
+			if err := validateTurns(m.Messages, false); err != nil {
+				return fmt.Errorf("message %d: %w", i+1, err)
+			}
+		case len(m.Messages) > 0:
+			return fmt.Errorf("message %d: only a range has messages", i+1)
+		case m.Role == llm.RoleSystem:
+			if !first {
+				return fmt.Errorf("message %d: system messages must come first", i+1)
+			}
+			continue
+		case m.Role != llm.RoleUser && m.Role != llm.RoleAssistant:
+			return fmt.Errorf("message %d: unknown role '%s' (expected %s, %s or %s)", i+1, m.Role, llm.RoleSystem, llm.RoleUser, llm.RoleAssistant)
+		}
+		first = false
+	}
+	return nil
+}
+
+// validateRepair checks that a repairing step has answers to repair: only a
+// schema makes an answer invalid, and a batch job can't follow up on one.
+func validateRepair(step *config.Step) error {
+	if !step.Repair {
+		return nil
+	}
+	if step.Type != config.PromptStepType {
+		return fmt.Errorf("'repair' is only valid on prompt steps")
+	}
+	if step.JSONSchemaRaw == nil {
+		return fmt.Errorf("'repair' needs a jsonSchema to check answers against")
+	}
+	if step.Batch {
+		return fmt.Errorf("'repair' can't be combined with 'batch'")
+	}
+	return nil
+}
+
+// validateJSONRepair checks that a step repairing JSON answers with JSON.
+func validateJSONRepair(step *config.Step) error {
+	if !step.JSONRepair {
+		return nil
+	}
+	if step.Type != config.PromptStepType {
+		return fmt.Errorf("'jsonRepair' is only valid on prompt steps")
+	}
+	if step.JSONSchemaRaw == nil {
+		return fmt.Errorf("'jsonRepair' needs a jsonSchema: text answers aren't parsed")
+	}
+	return nil
+}
+
 // isValidName validates filename according to filesystem rules
 func isValidName(name string) error {
 	if len(name) == 0 {
@@ -602,6 +968,51 @@ func setRootOutputFolder(cfg *config.Config) error {
 	return nil
 }
 
+// defaultCacheFolder is where cached responses are kept unless --cache-dir
+// says otherwise: next to the config like the default output, but outside the
+// output folder, so clearing a dataset never throws away paid-for responses.
+const defaultCacheFolder = ".datamatic-cache"
+
+// setCache settles whether this run uses the response cache and where it lives.
+// --no-cache wins, and so does --replay: a replayed run answers from its
+// cassette alone. Otherwise `cache: true` or an explicit --cache-dir turns it
+// on. Like --output, a relative --cache-dir is resolved against the working
+// directory.
+func setCache(cfg *config.Config) error {
+	if cfg.NoCache || cfg.Replay != "" {
+		cfg.Cache = false
+		return nil
+	}
+	if cfg.CacheDir != "" {
+		cfg.Cache = true
+	}
+	if !cfg.Cache {
+		return nil
+	}
+
+	dir, err := CacheDir(cfg)
+	if err != nil {
+		return err
+	}
+	cfg.CacheDir = dir
+	return nil
+}
+
+// CacheDir returns the absolute response cache folder for cfg: the --cache-dir
+// value, or the default next to the config file.
+func CacheDir(cfg *config.Config) (string, error) {
+	dir := cfg.CacheDir
+	if dir == "" {
+		dir = resolveDataPath(cfg.ConfigFile, defaultCacheFolder)
+	}
+
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to get absolute path for cache folder '%s': %w", dir, err)
+	}
+	return absDir, nil
+}
+
 // setWorkDir sets and normalizes the working directory for shell steps. It
 // anchors like any other generated path (see resolveOutputPath), defaulting to
 // the output folder itself.
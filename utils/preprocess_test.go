@@ -43,6 +43,8 @@ func TestIsValidName(t *testing.T) {
 func TestIsValidProvider(t *testing.T) {
 	assert.True(t, isValidProvider(llm.ProviderOllama))
 	assert.True(t, isValidProvider(llm.ProviderOpenAI))
+	assert.True(t, isValidProvider(llm.ProviderMock))
+	assert.True(t, isValidProvider(llm.ProviderOpenAICompatible))
 	assert.False(t, isValidProvider(llm.ProviderUnknown))
 	assert.False(t, isValidProvider(llm.ProviderType("INVALID")))
 }
@@ -107,6 +109,38 @@ func TestPreprocessConfig_Success(t *testing.T) {
 	assert.Equal(t, 0, cfg.Steps[3].Count)
 }
 
+func TestPreprocessConfig_ModelFallbacks(t *testing.T) {
+	temp := 0.2
+	cfg := &config.Config{
+		OutputFolder: t.TempDir(),
+		Steps: []config.Step{{
+			Name:   "gen",
+			Prompt: "p",
+			Models: config.ModelChain{
+				{Model: "openai:gpt-4o-mini"},
+				{Model: "openrouter:meta-llama/llama-3.2-3b"},
+				{Model: "ollama:llama3.2", ModelConfig: &config.ModelConfig{BaseURL: "http://gpu-box:11434/v1"}},
+			},
+			ModelConfig: config.ModelConfig{Temperature: &temp},
+		}},
+	}
+
+	require.NoError(t, PreprocessConfig(cfg))
+
+	step := cfg.Steps[0]
+	assert.Equal(t, "openai:gpt-4o-mini", step.Model)
+	assert.Equal(t, llm.ProviderOpenAI, step.ModelConfig.ModelProvider)
+
+	fallbacks := step.Fallbacks()
+	require.Len(t, fallbacks, 2)
+	assert.Equal(t, llm.ProviderOpenRouter, fallbacks[0].ModelConfig.ModelProvider)
+	assert.Equal(t, "meta-llama/llama-3.2-3b", fallbacks[0].ModelConfig.ModelName)
+	assert.Equal(t, &temp, fallbacks[0].ModelConfig.Temperature, "a plain fallback shares the step's modelConfig")
+	assert.Equal(t, llm.ProviderOllama, fallbacks[1].ModelConfig.ModelProvider)
+	assert.Equal(t, "http://gpu-box:11434/v1", fallbacks[1].ModelConfig.BaseURL)
+	assert.Nil(t, fallbacks[1].ModelConfig.Temperature, "a fallback with its own modelConfig doesn't inherit")
+}
+
 func TestSetWorkDir(t *testing.T) {
 	absDataset, _ := filepath.Abs(filepath.Join("tmp", "dataset"))
 	absVarTmp, _ := filepath.Abs(filepath.Join(string(filepath.Separator), "var", "tmp"))
@@ -159,7 +193,7 @@ func TestPreprocessConfig_Failures(t *testing.T) {
 			&config.Config{OutputFolder: "/tmp", Steps: []config.Step{
 				{Name: "bad", Prompt: "p", Run: "c"},
 			}},
-			"exactly one of 'prompt', 'run', 'jq', 'read' or 'write' must be defined",
+			"exactly one of 'prompt', 'run', 'jq', 'read', 'write' or 'user' must be defined",
 		},
 		{
 			"Missing provider colon",
@@ -168,6 +202,27 @@ func TestPreprocessConfig_Failures(t *testing.T) {
 			}},
 			"model should follow pattern",
 		},
+		{
+			"Invalid fallback provider",
+			&config.Config{OutputFolder: "/tmp", Steps: []config.Step{
+				{Name: "bad", Prompt: "p", Models: config.ModelChain{{Model: "ollama:llama3.2"}, {Model: "nope:m"}}},
+			}},
+			"fallback model 1: unsupported provider: nope",
+		},
+		{
+			"First model with its own modelConfig",
+			&config.Config{OutputFolder: "/tmp", Steps: []config.Step{
+				{Name: "bad", Prompt: "p", Models: config.ModelChain{{Model: "ollama:llama3.2", ModelConfig: &config.ModelConfig{}}}},
+			}},
+			"can't set its own",
+		},
+		{
+			"Rate limit for an unknown provider",
+			&config.Config{OutputFolder: "/tmp", RateLimits: map[string]llm.RateLimit{"openAI": {RequestsPerMinute: 10}}, Steps: []config.Step{
+				{Name: "gen", Prompt: "p", Model: "openai:gpt-4o-mini"},
+			}},
+			"rateLimits: unsupported provider: openAI",
+		},
 		{
 			"Invalid filename",
 			&config.Config{OutputFolder: "/tmp", Steps: []config.Step{
@@ -408,6 +463,13 @@ func TestPreprocessConfig_Concurrency(t *testing.T) {
 		assert.Equal(t, 4, cfg.Steps[0].Concurrency)
 	})
 
+	t.Run("unset concurrency covers every endpoint", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[0].ModelConfig.Endpoints = []config.Endpoint{{URL: "http://box1:11434/v1", Concurrency: 2}, {URL: "http://box2:11434/v1"}}
+		assert.NoError(t, PreprocessConfig(cfg))
+		assert.Equal(t, 3, cfg.Steps[0].Concurrency)
+	})
+
 	t.Run("negative concurrency fails", func(t *testing.T) {
 		cfg := base()
 		cfg.Steps[0].Concurrency = -1
@@ -431,6 +493,300 @@ func TestPreprocessConfig_Concurrency(t *testing.T) {
 	})
 }
 
+func TestPreprocessConfig_OnError(t *testing.T) {
+	base := func() *config.Config {
+		cfg := config.NewConfig()
+		cfg.OutputFolder = t.TempDir()
+		cfg.Steps = []config.Step{
+			{Name: "seed", Prompt: "p", Model: "ollama:m", Count: 2},
+		}
+		return cfg
+	}
+
+	t.Run("defaults to fail", func(t *testing.T) {
+		cfg := base()
+		assert.NoError(t, PreprocessConfig(cfg))
+		assert.Equal(t, config.OnErrorFail, cfg.Steps[0].OnError)
+	})
+
+	t.Run("skip with maxErrors", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[0].OnError = config.OnErrorSkip
+		cfg.Steps[0].MaxErrors = 5
+		assert.NoError(t, PreprocessConfig(cfg))
+	})
+
+	t.Run("unknown value fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[0].OnError = "ignore"
+		assert.ErrorContains(t, PreprocessConfig(cfg), "unknown onError")
+	})
+
+	t.Run("maxErrors without skip fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[0].MaxErrors = 5
+		assert.ErrorContains(t, PreprocessConfig(cfg), "requires onError")
+	})
+
+	t.Run("onError on transform step fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps = append(cfg.Steps, config.Step{Name: "t", JQ: ".", From: "seed", OnError: config.OnErrorSkip})
+		assert.ErrorContains(t, PreprocessConfig(cfg), "only valid on prompt and conversation steps")
+	})
+}
+
+func TestPreprocessConfig_GappedReferences(t *testing.T) {
+	base := func() *config.Config {
+		cfg := config.NewConfig()
+		cfg.OutputFolder = t.TempDir()
+		cfg.Steps = []config.Step{
+			{Name: "leads", Prompt: "p", Model: "ollama:m", Count: 2},
+			{Name: "classify", Prompt: "{{.item}}", Model: "ollama:m", ForEach: "leads", OnError: config.OnErrorSkip},
+			{Name: "picked", JQ: ".", From: "classify"},
+		}
+		return cfg
+	}
+	withStep := func(step config.Step) *config.Config {
+		cfg := base()
+		step.Model = "ollama:m"
+		cfg.Steps = append(cfg.Steps, step)
+		return cfg
+	}
+
+	t.Run("through the forEach chain", func(t *testing.T) {
+		cfg := withStep(config.Step{Name: "summary", ForEach: "classify", Prompt: "{{.item}} {{.leads}}"})
+		assert.NoError(t, PreprocessConfig(cfg))
+	})
+
+	t.Run("transform between the skip step and the forEach fails", func(t *testing.T) {
+		cfg := withStep(config.Step{Name: "summary", ForEach: "picked", Prompt: "{{.item}} {{.classify}}"})
+		assert.ErrorContains(t, PreprocessConfig(cfg), "step 'classify' skips failed rows")
+	})
+
+	t.Run("an upstream step read past a transform fails", func(t *testing.T) {
+		cfg := withStep(config.Step{Name: "summary", ForEach: "picked", Prompt: "{{.item}} {{.leads}}"})
+		assert.ErrorContains(t, PreprocessConfig(cfg), "rows come from step 'classify'")
+	})
+
+	t.Run("iterating the skip step's source fails", func(t *testing.T) {
+		cfg := withStep(config.Step{Name: "summary", ForEach: "leads", Prompt: "{{.item}} {{.classify}}"})
+		assert.ErrorContains(t, PreprocessConfig(cfg), "step 'classify' skips failed rows")
+	})
+
+	t.Run("a skip step off the chain fails", func(t *testing.T) {
+		cfg := withStep(config.Step{Name: "summary", Count: 2, Prompt: "{{.classify}}"})
+		assert.ErrorContains(t, PreprocessConfig(cfg), "step 'classify' skips failed rows")
+	})
+}
+
+func TestPreprocessConfig_Batch(t *testing.T) {
+	base := func(model string) *config.Config {
+		cfg := config.NewConfig()
+		cfg.OutputFolder = t.TempDir()
+		cfg.Steps = []config.Step{
+			{Name: "seed", Prompt: "p", Model: model, Count: 2, Batch: true},
+		}
+		return cfg
+	}
+
+	t.Run("openai", func(t *testing.T) {
+		assert.NoError(t, PreprocessConfig(base("openai:gpt-4o-mini")))
+	})
+
+	t.Run("other providers fail", func(t *testing.T) {
+		assert.ErrorContains(t, PreprocessConfig(base("ollama:m")), "'batch' needs the openai or openai-compatible provider")
+	})
+
+	t.Run("fallbacks fail", func(t *testing.T) {
+		cfg := base("")
+		cfg.Steps[0].Models = config.ModelChain{{Model: "openai:gpt-4o-mini"}, {Model: "openai:gpt-4o"}}
+		assert.ErrorContains(t, PreprocessConfig(cfg), "fallback models")
+	})
+
+	t.Run("transform step fails", func(t *testing.T) {
+		cfg := base("openai:gpt-4o-mini")
+		cfg.Steps = append(cfg.Steps, config.Step{Name: "t", JQ: ".", From: "seed", Batch: true})
+		assert.ErrorContains(t, PreprocessConfig(cfg), "only valid on prompt steps")
+	})
+}
+
+func TestPreprocessConfig_Repair(t *testing.T) {
+	base := func() *config.Config {
+		cfg := config.NewConfig()
+		cfg.OutputFolder = t.TempDir()
+		cfg.Steps = []config.Step{
+			{Name: "seed", Prompt: "p", Model: "ollama:m", Repair: true, JSONSchemaRaw: `{
+				"type": "object",
+				"properties": {"title": {"type": "string"}},
+				"required": ["title"],
+				"additionalProperties": false
+			}`},
+		}
+		return cfg
+	}
+
+	t.Run("schema step passes", func(t *testing.T) {
+		assert.NoError(t, PreprocessConfig(base()))
+	})
+
+	t.Run("schema-less step fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[0].JSONSchemaRaw = nil
+		assert.ErrorContains(t, PreprocessConfig(cfg), "'repair' needs a jsonSchema")
+	})
+
+	t.Run("batch fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[0].Model = "openai:gpt-4o-mini"
+		cfg.Steps[0].Batch = true
+		assert.ErrorContains(t, PreprocessConfig(cfg), "can't be combined with 'batch'")
+	})
+
+	t.Run("jsonRepair needs a schema", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[0].Repair = false
+		cfg.Steps[0].JSONRepair = true
+		assert.NoError(t, PreprocessConfig(cfg))
+
+		cfg = base()
+		cfg.Steps[0].Repair = false
+		cfg.Steps[0].JSONRepair = true
+		cfg.Steps[0].JSONSchemaRaw = nil
+		assert.ErrorContains(t, PreprocessConfig(cfg), "'jsonRepair' needs a jsonSchema")
+	})
+}
+
+func TestPreprocessConfig_Messages(t *testing.T) {
+	base := func() *config.Config {
+		cfg := config.NewConfig()
+		cfg.OutputFolder = t.TempDir()
+		cfg.Steps = []config.Step{
+			{Name: "examples", Prompt: "p", Model: "ollama:m", JSONSchemaRaw: `{
+				"type": "object",
+				"properties": {"question": {"type": "string"}, "answer": {"type": "string"}},
+				"required": ["question", "answer"],
+				"additionalProperties": false
+			}`},
+			{Name: "chat", Model: "ollama:m", Messages: []config.Message{
+				{Role: "system", Content: "Be brief."},
+				{Role: "user", Content: "{{.examples.question}}"},
+				{Role: "assistant", Content: "{{.examples.answer}}"},
+				{Role: "user", Content: "And why?"},
+			}},
+		}
+		return cfg
+	}
+
+	t.Run("messages make a prompt step", func(t *testing.T) {
+		cfg := base()
+		require.NoError(t, PreprocessConfig(cfg))
+		assert.Equal(t, config.PromptStepType, cfg.Steps[1].Type)
+		assert.Equal(t, []string{"examples"}, cfg.Steps[1].DependsOn)
+	})
+
+	t.Run("references are checked", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].Messages[1].Content = "{{.examples.nope}}"
+		assert.ErrorContains(t, PreprocessConfig(cfg), "nope")
+	})
+
+	t.Run("prompt and messages fail", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].Prompt = "p"
+		assert.ErrorContains(t, PreprocessConfig(cfg), "'prompt' and 'messages' can't both be set")
+	})
+
+	t.Run("ending on an assistant turn fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].Messages = cfg.Steps[1].Messages[:3]
+		assert.ErrorContains(t, PreprocessConfig(cfg), "must be a user turn")
+	})
+
+	t.Run("late system message fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].Messages[2].Role = "system"
+		assert.ErrorContains(t, PreprocessConfig(cfg), "system messages must come first")
+	})
+
+	t.Run("unknown role fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].Messages[2].Role = "tool"
+		assert.ErrorContains(t, PreprocessConfig(cfg), "unknown role 'tool'")
+	})
+}
+
+func TestPreprocessConfig_Conversation(t *testing.T) {
+	base := func() *config.Config {
+		cfg := config.NewConfig()
+		cfg.OutputFolder = t.TempDir()
+		cfg.Steps = []config.Step{
+			{Name: "personas", Read: "personas.jsonl"},
+			{Name: "chat", Model: "ollama:m", ForEach: "personas", SystemPrompt: "You are a support agent.",
+				User: &config.ConversationUser{SystemPrompt: "You are {{.item.name}}."}},
+			{Name: "review", Model: "ollama:m", ForEach: "chat", Prompt: "Rate: {{.item.messages}}"},
+		}
+		return cfg
+	}
+
+	t.Run("user makes a conversation step with defaults", func(t *testing.T) {
+		cfg := base()
+		require.NoError(t, PreprocessConfig(cfg))
+		chat := cfg.Steps[1]
+		assert.Equal(t, config.ConversationStepType, chat.Type)
+		assert.Equal(t, []string{"personas"}, chat.DependsOn)
+		assert.Equal(t, "ollama:m", chat.User.Model)
+		assert.Equal(t, "m", chat.User.ModelConfig.ModelName)
+		assert.Equal(t, config.DefaultConversationOpener, chat.User.Prompt)
+		assert.Equal(t, config.DefaultMaxTurns, chat.MaxTurns)
+		assert.Nil(t, chat.StopProgram)
+	})
+
+	t.Run("user with its own model", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].User.Model = "openai:gpt-4o-mini"
+		require.NoError(t, PreprocessConfig(cfg))
+		assert.Equal(t, llm.ProviderOpenAI, cfg.Steps[1].User.ModelConfig.ModelProvider)
+	})
+
+	t.Run("user modelConfig without a model fails", func(t *testing.T) {
+		cfg := base()
+		temperature := 0.9
+		cfg.Steps[1].User.ModelConfig.Temperature = &temperature
+		assert.ErrorContains(t, PreprocessConfig(cfg), "'modelConfig' needs a 'model'")
+	})
+
+	t.Run("stopWhen is compiled", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].StopWhen = `.messages[-1].content | test("bye"; "i")`
+		require.NoError(t, PreprocessConfig(cfg))
+		assert.NotNil(t, cfg.Steps[1].StopProgram)
+	})
+
+	t.Run("invalid stopWhen fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].StopWhen = ".messages[["
+		assert.ErrorContains(t, PreprocessConfig(cfg), "stopWhen")
+	})
+
+	t.Run("jsonSchema fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].JSONSchemaRaw = `{"type": "object"}`
+		assert.ErrorContains(t, PreprocessConfig(cfg), "'jsonSchema' is not valid on conversation steps")
+	})
+
+	t.Run("fields other than messages fail", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[2].Prompt = "Rate: {{.item.turns}}"
+		assert.ErrorContains(t, PreprocessConfig(cfg), "field path 'turns' not found in conversation step 'chat'")
+	})
+
+	t.Run("maxTurns on a prompt step fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[2].MaxTurns = 4
+		assert.ErrorContains(t, PreprocessConfig(cfg), "'maxTurns' and 'stopWhen' are only valid on conversation steps")
+	})
+}
+
 func TestPreprocessConfig_PromptPlaceholders(t *testing.T) {
 	base := func() *config.Config {
 		cfg := config.NewConfig()
@@ -489,6 +845,25 @@ func TestPreprocessConfig_PromptPlaceholders(t *testing.T) {
 		cfg.Steps[1].Prompt = "all: {{.src}} title: {{.src.title}}"
 		assert.ErrorContains(t, PreprocessConfig(cfg), "both as a whole")
 	})
+
+	t.Run("kept reasoning can be referenced", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[0].KeepReasoning = true
+		cfg.Steps[1].Prompt = "x {{.src.title}} because {{.src.reasoning}}"
+		assert.NoError(t, PreprocessConfig(cfg))
+	})
+
+	t.Run("reasoning reference without keepReasoning fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps[1].Prompt = "because {{.src.reasoning}}"
+		assert.ErrorContains(t, PreprocessConfig(cfg), "reasoning")
+	})
+
+	t.Run("keepReasoning on a non-prompt step fails", func(t *testing.T) {
+		cfg := base()
+		cfg.Steps = append(cfg.Steps, config.Step{Name: "t", JQ: ".", From: "src", KeepReasoning: true})
+		assert.ErrorContains(t, PreprocessConfig(cfg), "'keepReasoning' is only valid on prompt steps")
+	})
 }
 
 func TestPreprocessConfig_CollectValidation(t *testing.T) {
@@ -828,6 +1203,43 @@ func TestPreprocessConfig_OutputFolderResolution(t *testing.T) {
 	}
 }
 
+// TestPreprocessConfig_CacheSettings pins when the response cache is on and
+// where it lives: --no-cache always wins, --cache-dir turns it on by itself.
+func TestPreprocessConfig_CacheSettings(t *testing.T) {
+	configDir := t.TempDir()
+	cwd, err := os.Getwd()
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		cache    bool   // cache: in the config
+		cacheDir string // --cache-dir
+		noCache  bool   // --no-cache
+		want     string // resolved folder, "" when the cache is off
+	}{
+		{name: "off by default"},
+		{name: "cache: true defaults next to the config", cache: true, want: filepath.Join(configDir, defaultCacheFolder)},
+		{name: "--cache-dir turns it on, relative to the working directory", cacheDir: "cache", want: filepath.Join(cwd, "cache")},
+		{name: "--no-cache wins over cache: true", cache: true, noCache: true},
+		{name: "--no-cache wins over --cache-dir", cacheDir: "cache", noCache: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := config.NewConfig()
+			cfg.ConfigFile = filepath.Join(configDir, "flow.yaml")
+			cfg.Steps = []config.Step{{Name: "gen", Prompt: "p", Model: "ollama:m", Count: 1}}
+			cfg.Cache, cfg.CacheDir, cfg.NoCache = tc.cache, tc.cacheDir, tc.noCache
+
+			require.NoError(t, PreprocessConfig(cfg))
+			assert.Equal(t, tc.want != "", cfg.Cache)
+			if tc.want != "" {
+				assert.Equal(t, tc.want, cfg.CacheDir)
+			}
+		})
+	}
+}
+
 // TestPreprocessConfig_WriteDeliverablesLandInOutputFolder pins the split: an
 // input path travels with the config, everything generated goes to the one
 // output folder, and an absolute path is an escape hatch from both.
@@ -856,3 +1268,25 @@ func TestPreprocessConfig_WriteDeliverablesLandInOutputFolder(t *testing.T) {
 			"a write step's OutputFilename is its deliverable")
 	}
 }
+
+func TestPreprocessConfig_Dependencies(t *testing.T) {
+	cfg := config.NewConfig()
+	cfg.OutputFolder = t.TempDir()
+	cfg.Steps = []config.Step{
+		{Name: "docs", Read: "docs/*.md"},
+		{Name: "topics", Prompt: "p", Model: "ollama:m", Count: 2},
+		{Name: "summary", Prompt: "Summarize {{.item.content}} about {{.topics}}", Model: "ollama:m", ForEach: "docs"},
+		{Name: "flat", JQ: ".", From: "summary"},
+		{Name: "out", From: "flat", Write: "out.csv"},
+		{Name: "sh", Run: "echo hi > sh.jsonl", OutputFilename: "sh.jsonl"},
+	}
+
+	require.NoError(t, PreprocessConfig(cfg))
+
+	assert.Empty(t, cfg.Steps[0].DependsOn)
+	assert.Empty(t, cfg.Steps[1].DependsOn)
+	assert.Equal(t, []string{"docs", "topics"}, cfg.Steps[2].DependsOn, "forEach source plus template references")
+	assert.Equal(t, []string{"summary"}, cfg.Steps[3].DependsOn)
+	assert.Equal(t, []string{"flat"}, cfg.Steps[4].DependsOn)
+	assert.Empty(t, cfg.Steps[5].DependsOn, "shell steps declare nothing; the runner treats them as barriers")
+}